@@ -0,0 +1,36 @@
+package main
+
+import (
+	"embed"
+	"final-project/pdfs"
+	"io/fs"
+	"os"
+)
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// Templates and PDFs are read from the binary. For development, TEMPLATE_DIR
+// and PDF_DIR point these at directories on disk instead; see useAssetDirs.
+var templateFS fs.FS = mustSub(embeddedTemplates, "templates")
+var pdfFS fs.FS = pdfs.FS
+
+// useAssetDirs switches to on-disk templates and PDFs for any directory
+// that is set.
+func useAssetDirs(templateDir, pdfDir string) {
+	if templateDir != "" {
+		templateFS = os.DirFS(templateDir)
+	}
+
+	if pdfDir != "" {
+		pdfFS = os.DirFS(pdfDir)
+	}
+}
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"final-project/data"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// BillingScheduler renews subscriptions as their periods end. Every
+// instance runs one, but only the one holding Lock, a Postgres advisory
+// lock, bills; if that instance stops or dies, another takes the lock on
+// its next tick.
+type BillingScheduler struct {
+	Lock  data.LockType
+	Store data.PlanType
+	// bills one subscription whose period has ended, and moves it on
+	Renew func(ctx context.Context, sub *data.Subscription) error
+	Every time.Duration
+	Batch int
+	// a renewal that errors isn't tried again until it has backed off
+	RetryBase time.Duration
+	RetryMax  time.Duration
+	Log       *slog.Logger
+	ErrorChan chan ErrorEvent
+
+	// whether we held the lock at the last tick
+	leader bool
+
+	// lifecycle; see start and Stop
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	ctx      context.Context
+	abort    context.CancelFunc
+}
+
+// start launches the scheduler. It bills straight away, then every Every.
+func (s *BillingScheduler) start() {
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.ctx, s.abort = context.WithCancel(context.Background())
+
+	go s.run()
+}
+
+// Stop stops billing once the subscription being renewed is done, or
+// when ctx is, and gives up the lock.
+func (s *BillingScheduler) Stop(ctx context.Context) {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.abort()
+		s.Log.Warn("stopped billing before it finished")
+		// the lock goes when the database pool closes
+		return
+	}
+
+	if err := s.Lock.Release(); err != nil {
+		s.Log.Error("could not release the billing lock", "error", err)
+	}
+}
+
+func (s *BillingScheduler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.Every)
+	defer ticker.Stop()
+
+	for {
+		s.tick()
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// tick renews up to Batch subscriptions that are due, if we are the
+// leader. One that can't be renewed backs off before it is tried again,
+// so a few that keep failing don't take up every batch.
+func (s *BillingScheduler) tick() {
+	if !s.lead() {
+		return
+	}
+
+	subs, err := s.Store.DueSubscriptions(time.Now(), s.Batch)
+	if err != nil {
+		s.report(ErrorEvent{Source: "billing", Severity: SeverityWarning,
+			Err: fmt.Errorf("could not find due subscriptions: %w", err), Time: time.Now()})
+		return
+	}
+
+	for _, sub := range subs {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		if err := s.Renew(s.ctx, sub); err != nil {
+			retryAt := time.Now().Add(backoff(sub.RenewalAttempts+1, s.RetryBase, s.RetryMax))
+			s.report(ErrorEvent{
+				Source:   "billing",
+				Severity: SeverityError,
+				Err:      fmt.Errorf("could not renew subscription %d: %w", sub.ID, err),
+				Payload: map[string]any{"subscription_id": sub.ID, "user_id": sub.UserID,
+					"attempts": sub.RenewalAttempts + 1, "retry_at": retryAt},
+				Time: time.Now(),
+			})
+
+			if err := s.Store.DeferRenewal(sub.ID, retryAt); err != nil {
+				s.report(ErrorEvent{Source: "billing", Severity: SeverityWarning,
+					Err: fmt.Errorf("could not defer renewal of subscription %d: %w", sub.ID, err), Time: time.Now()})
+			}
+		}
+	}
+}
+
+// lead says whether this instance should bill: it still holds the lock,
+// or has just taken it.
+func (s *BillingScheduler) lead() bool {
+	if s.leader {
+		err := s.Lock.Check()
+		if err == nil {
+			return true
+		}
+		s.Log.Warn("lost the billing lock", "error", err)
+		s.leader = false
+	}
+
+	acquired, err := s.Lock.TryAcquire()
+	if err != nil {
+		s.report(ErrorEvent{Source: "billing", Severity: SeverityWarning,
+			Err: fmt.Errorf("could not try the billing lock: %w", err), Time: time.Now()})
+		return false
+	}
+
+	if acquired {
+		s.Log.Info("took the billing lock; this instance bills")
+		s.leader = true
+	}
+	return acquired
+}
+
+// report passes ev to the error listener, unless we are past the shutdown
+// deadline and it may be gone; then ev is only logged.
+func (s *BillingScheduler) report(ev ErrorEvent) {
+	select {
+	case s.ErrorChan <- ev:
+	case <-s.ctx.Done():
+		s.Log.Log(context.Background(), ev.Severity.level(), "billing error", ev.logAttrs()...)
+	}
+}
+
+// renewSubscription bills a subscription whose period has ended for the
+// next period, and moves it on; one set to cancel is just canceled. If
+// the charge is declined, the subscription still moves on, but past due,
+// and dunning starts. A renewal cut short is finished on the next tick
+// without charging twice: the invoice is the one for the period, and an
+// invoice with a payment under way isn't charged again.
+func (app *Config) renewSubscription(ctx context.Context, sub *data.Subscription) error {
+	if sub.CancelAtPeriodEnd {
+		return app.Models.Plan.RenewSubscription(sub.ID)
+	}
+
+	// the next period starts where this one ends
+	job := SubscriptionJob{
+		UserID:       sub.UserID,
+		PlanID:       sub.PlanID,
+		SubscribedAt: sub.CurrentPeriodEnd,
+		Renewal:      true,
+	}
+	ctx = job.context(ctx)
+
+	user, plan, err := app.loadSubscription(job)
+	if err != nil {
+		return err
+	}
+
+	invoice, err := app.subscriptionInvoice(*user, *plan, job)
+	if err != nil {
+		return fmt.Errorf("issuing invoice: %w", err)
+	}
+
+	// an invoice already paid was charged by an earlier try
+	if invoice.Status != data.InvoicePaid && invoice.Total > 0 {
+		payment, charge, err := app.payInvoice(ctx, invoice, "", job)
+		switch {
+		case errors.Is(err, errPaymentOpen) && payment.Status == data.PaymentPending:
+			// an earlier try is still going through; its webhook finishes it
+			return app.Models.Plan.RenewSubscription(sub.ID)
+		case errors.Is(err, errPaymentOpen):
+			// paid, but cut short before the invoice was marked paid
+		case errors.Is(err, errNoPaymentMethod):
+			return app.renewalDeclined(ctx, sub, job, invoice.ID, "no payment method")
+		case errors.Is(err, errUnknownCustomer):
+			// the provider has no record of them; they can add a card again
+			return app.renewalDeclined(ctx, sub, job, invoice.ID, "no customer at the payment provider")
+		case err != nil:
+			return fmt.Errorf("charging invoice %s: %w", invoice.DisplayNumber(), err)
+		case charge.Status == chargeFailed:
+			return app.renewalDeclined(ctx, sub, job, invoice.ID, charge.FailureMessage)
+		case charge.Status == chargePending:
+			// the user keeps their plan while the payment goes through; the
+			// webhook finishes the renewal
+			return app.Models.Plan.RenewSubscription(sub.ID)
+		}
+	}
+
+	if invoice.Status != data.InvoicePaid {
+		if err := app.renewalPaid(ctx, job, invoice.ID); err != nil {
+			return err
+		}
+	}
+
+	return app.Models.Plan.RenewSubscription(sub.ID)
+}
+
+// renewalDeclined starts dunning for a subscription whose renewal was
+// declined, then moves it on to its next period, past due. Dunning comes
+// first so that if either fails the renewal is still due and tried again;
+// a subscription already past due isn't dunned twice.
+func (app *Config) renewalDeclined(ctx context.Context, sub *data.Subscription, job SubscriptionJob, invoiceID int, reason string) error {
+	if err := app.startDunning(ctx, job, invoiceID, reason); err != nil {
+		return err
+	}
+	return app.Models.Plan.RenewSubscription(sub.ID)
+}
+
+// renewalPaid marks a renewal's invoice paid, makes the subscription
+// active again if it was past due, and queues the receipt.
+func (app *Config) renewalPaid(ctx context.Context, job SubscriptionJob, invoiceID int) error {
+	if err := app.Models.Invoice.UpdateStatus(invoiceID, data.InvoicePaid); err != nil {
+		return fmt.Errorf("marking invoice %d paid: %w", invoiceID, err)
+	}
+
+	// it may have ended while the payment was pending; the user can
+	// subscribe again, and the payment stands
+	err := app.Models.Plan.RecoverSubscription(job.UserID)
+	if err != nil && !errors.Is(err, data.ErrNoSubscription) {
+		return fmt.Errorf("recovering subscription: %w", err)
+	}
+
+	app.enqueueSubscriptionJobs(ctx, job, jobInvoice)
+	return nil
+}
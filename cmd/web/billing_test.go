@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"final-project/data"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLock is an advisory lock that another instance may be holding.
+type testLock struct {
+	mu       sync.Mutex
+	taken    bool
+	held     bool
+	released int
+}
+
+func (l *testLock) TryAcquire() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.taken {
+		return false, nil
+	}
+	l.held = true
+	return true, nil
+}
+
+func (l *testLock) Check() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.held {
+		return errors.New("lost")
+	}
+	return nil
+}
+
+func (l *testLock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.held = false
+	l.released++
+	return nil
+}
+
+// lose drops the lock, as if its connection broke, and lets another
+// instance take it.
+func (l *testLock) lose() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.held, l.taken = false, true
+}
+
+// memoryPayments is a payments table in memory, so a webhook finds the
+// payment that was actually made.
+type memoryPayments struct {
+	mu       sync.Mutex
+	payments []*data.Payment
+}
+
+func (s *memoryPayments) Insert(payment data.Payment) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.payments {
+		if p.InvoiceID == payment.InvoiceID && p.Open() {
+			return 0, data.ErrPaymentOpen
+		}
+	}
+
+	payment.ID = len(s.payments) + 1
+	s.payments = append(s.payments, &payment)
+	return payment.ID, nil
+}
+
+func (s *memoryPayments) SetCharge(id int, chargeID, status, failureMessage string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.payments[id-1]
+	if p.ChargeID == "" {
+		p.ChargeID, p.Status, p.FailureMessage = chargeID, status, failureMessage
+	}
+	return nil
+}
+
+func (s *memoryPayments) GetByChargeID(chargeID string) (*data.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.payments {
+		if p.ChargeID == chargeID {
+			copied := *p
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *memoryPayments) GetForInvoice(invoiceID int) ([]*data.Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var payments []*data.Payment
+	for _, p := range s.payments {
+		if p.InvoiceID == invoiceID {
+			copied := *p
+			payments = append(payments, &copied)
+		}
+	}
+	return payments, nil
+}
+
+func (s *memoryPayments) SetStatus(id int, from, to, failureMessage string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.payments[id-1]
+	if p.Status != from {
+		return false, nil
+	}
+	p.Status, p.FailureMessage = to, failureMessage
+	return true, nil
+}
+
+func newTestBilling(lock data.LockType, renew func(ctx context.Context, sub *data.Subscription) error) *BillingScheduler {
+	return &BillingScheduler{
+		Lock:      lock,
+		Store:     testApp.Models.Plan,
+		Renew:     renew,
+		Every:     time.Hour,
+		Batch:     10,
+		Log:       testApp.Log,
+		ErrorChan: testApp.ErrorChan,
+	}
+}
+
+func TestBillingScheduler_lead(t *testing.T) {
+	lock := &testLock{taken: true}
+	renewed := 0
+	s := newTestBilling(lock, func(ctx context.Context, sub *data.Subscription) error {
+		renewed++
+		return nil
+	})
+
+	// another instance bills
+	s.tick()
+	if renewed != 0 {
+		t.Fatalf("expected no renewals without the lock, got %d", renewed)
+	}
+
+	// it stops, and we take over
+	lock.taken = false
+	s.tick()
+	if renewed != 1 || !s.leader {
+		t.Fatalf("expected to lead and renew once, got leader %v and %d renewals", s.leader, renewed)
+	}
+
+	// our connection breaks, and another instance takes over
+	lock.lose()
+	s.tick()
+	if renewed != 1 || s.leader {
+		t.Errorf("expected to stop billing once the lock is lost, got leader %v and %d renewals", s.leader, renewed)
+	}
+}
+
+func TestBillingScheduler_Stop(t *testing.T) {
+	lock := &testLock{}
+	renewed := make(chan int, 10)
+	s := newTestBilling(lock, func(ctx context.Context, sub *data.Subscription) error {
+		renewed <- sub.ID
+		return nil
+	})
+
+	s.start()
+
+	select {
+	case <-renewed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the scheduler to bill as soon as it started")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Stop(ctx)
+
+	if lock.released != 1 {
+		t.Errorf("expected the lock to be released once, got %d", lock.released)
+	}
+}
+
+// deferringPlans records the renewals put off.
+type deferringPlans struct {
+	data.PlanTest
+	deferred map[int]time.Time
+}
+
+func (p *deferringPlans) DeferRenewal(id int, retryAt time.Time) error {
+	p.deferred[id] = retryAt
+	return nil
+}
+
+func TestBillingScheduler_tick_backoff(t *testing.T) {
+	store := &deferringPlans{deferred: make(map[int]time.Time)}
+	s := newTestBilling(&testLock{}, func(ctx context.Context, sub *data.Subscription) error {
+		return errors.New("gateway down")
+	})
+	s.Store = store
+	s.RetryBase, s.RetryMax = time.Minute, time.Hour
+	s.ctx = context.Background()
+
+	s.tick()
+
+	retryAt, ok := store.deferred[1]
+	if !ok {
+		t.Fatal("expected the failed renewal to be put off")
+	}
+	if wait := time.Until(retryAt); wait < 29*time.Second || wait > time.Minute {
+		t.Errorf("expected a retry within a minute, got one in %s", wait)
+	}
+}
+
+func TestConfig_renewSubscription(t *testing.T) {
+	payments := testApp.Models.Payment
+	defer func() {
+		testApp.Models.Payment = payments
+	}()
+
+	// a declined renewal is chased on days 1, 3 and 7, and given up on at
+	// the end of the 14 day grace period
+	tests := []struct {
+		name        string
+		card        string
+		cancelAtEnd bool
+		subject     string
+		dunning     []int
+	}{
+		{"paid", "pm_card_visa", false, "Your Receipt for Our Fake Plan", nil},
+		{"declined", "pm_card_declined", false, "", []int{1, 3, 7, 14}},
+		{"no card", "", false, "", []int{1, 3, 7, 14}},
+		// the fake gateway forgets its customers when it restarts
+		{"no customer", "forgotten", false, "", []int{1, 3, 7, 14}},
+		{"pending", "pm_card_delayed", false, "Your Receipt for Our Fake Plan", nil},
+		{"pending, then declined", "pm_card_delayed_declined", false, "", []int{1, 3, 7, 14}},
+		{"canceling", "pm_card_visa", true, "", nil},
+	}
+
+	jobs := testApp.Jobs.Store.(*memoryJobs)
+
+	for _, tt := range tests {
+		testTransport.Reset()
+		// each case renews the same invoice, unpaid
+		testApp.Models.Payment = &memoryPayments{}
+		testGateway.forgetCharges()
+		testGateway.setCard("cus_test", tt.card)
+		if tt.card == "forgotten" {
+			testGateway.forgetCustomer("cus_test")
+		}
+		queued := jobs.count()
+
+		subs, err := testApp.Models.Plan.DueSubscriptions(time.Now(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub := subs[0]
+		sub.CancelAtPeriodEnd = tt.cancelAtEnd
+
+		if err := testApp.renewSubscription(context.Background(), sub); err != nil {
+			t.Errorf("%s: expected no error, got %v", tt.name, err)
+			continue
+		}
+
+		for _, id := range testGateway.pendingCharges() {
+			if err := testGateway.Settle(id); err != nil {
+				t.Fatalf("%s: settling the charge: %v", tt.name, err)
+			}
+		}
+
+		want := 1
+		if tt.subject == "" {
+			want = 0
+		}
+
+		deadline := time.Now().Add(10 * time.Second)
+		for len(testTransport.Messages()) < want && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		messages := testTransport.Messages()
+		if len(messages) != want {
+			t.Errorf("%s: expected %d mail messages, got %d", tt.name, want, len(messages))
+			continue
+		}
+		if want == 1 && messages[0].Subject != tt.subject {
+			t.Errorf("%s: expected subject %q, got %q", tt.name, tt.subject, messages[0].Subject)
+		}
+
+		var days []int
+		for _, job := range jobs.since(queued) {
+			if job.Kind == jobDunning {
+				days = append(days, int(time.Until(job.RunAt).Hours()+1)/24)
+			}
+		}
+		if !slices.Equal(days, tt.dunning) {
+			t.Errorf("%s: expected dunning on days %v, got %v", tt.name, tt.dunning, days)
+		}
+	}
+}
+
+// unrenewablePlans can't move subscriptions on to their next period.
+type unrenewablePlans struct {
+	data.PlanTest
+}
+
+func (p *unrenewablePlans) RenewSubscription(id int) error {
+	return errors.New("connection reset")
+}
+
+func TestConfig_renewSubscription_declinedUnrenewed(t *testing.T) {
+	payments, plans := testApp.Models.Payment, testApp.Models.Plan
+	testApp.Models.Payment = &memoryPayments{}
+	testApp.Models.Plan = &unrenewablePlans{}
+	defer func() {
+		testApp.Models.Payment, testApp.Models.Plan = payments, plans
+	}()
+	testGateway.forgetCharges()
+	testGateway.setCard("cus_test", "pm_card_declined")
+	defer testGateway.setCard("cus_test", "")
+
+	jobs := testApp.Jobs.Store.(*memoryJobs)
+	queued := jobs.count()
+
+	subs, err := testApp.Models.Plan.DueSubscriptions(time.Now(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the renewal is tried again, but the member is chased already
+	if err := testApp.renewSubscription(context.Background(), subs[0]); err == nil {
+		t.Error("expected an error when the subscription can't be moved on")
+	}
+
+	dunning := 0
+	for _, job := range jobs.since(queued) {
+		if job.Kind == jobDunning {
+			dunning++
+		}
+	}
+	if dunning != 4 {
+		t.Errorf("expected 4 dunning steps queued, got %d", dunning)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"final-project/data"
+	"fmt"
+	"time"
+)
+
+// paymentCustomer returns the user's customer ID at the payment gateway,
+// registering them the first time, and makes method their way to pay if
+// it is set.
+func (app *Config) paymentCustomer(userID int, method string) (string, error) {
+	// the session's copy of the user may be older than their customer ID
+	user, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		return "", fmt.Errorf("loading user %d: %w", userID, err)
+	}
+
+	if user.PaymentCustomerID == "" {
+		user.PaymentCustomerID, err = app.Payments.CreateCustomer(*user)
+		if err != nil {
+			return "", fmt.Errorf("creating customer: %w", err)
+		}
+
+		err = app.Models.User.Update(*user)
+		if err != nil {
+			return "", fmt.Errorf("saving customer %s: %w", user.PaymentCustomerID, err)
+		}
+	}
+
+	if method != "" {
+		err = app.Payments.AttachPaymentMethod(user.PaymentCustomerID, method)
+		if err != nil {
+			return "", fmt.Errorf("attaching payment method: %w", err)
+		}
+	}
+
+	return user.PaymentCustomerID, nil
+}
+
+// payInvoice charges the user an invoice's total, with method if it is
+// set, or else the way they paid before, and records the payment. A
+// pending payment keeps job, to finish the subscription once it goes
+// through. An invoice that has a payment pending, or paid, isn't charged
+// again: that payment is returned, with errPaymentOpen.
+func (app *Config) payInvoice(ctx context.Context, invoice *data.Invoice, method string, job SubscriptionJob) (*data.Payment, *Charge, error) {
+	payments, err := app.Models.Payment.GetForInvoice(invoice.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading payments for invoice %d: %w", invoice.ID, err)
+	}
+
+	checkout, err := json.Marshal(job)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the payment is stored before the charge is made, so that the money
+	// is never taken without a record of it, and so that of two tries at
+	// paying the invoice at once, only one charges it
+	payment := data.Payment{
+		UserID:    invoice.UserID,
+		InvoiceID: invoice.ID,
+		Status:    data.PaymentPending,
+		Amount:    invoice.Total,
+		Currency:  invoice.Currency,
+		Checkout:  checkout,
+	}
+	payment.ID, err = app.Models.Payment.Insert(payment)
+	if errors.Is(err, data.ErrPaymentOpen) {
+		open, err := app.openPayment(invoice.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return open, nil, errPaymentOpen
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("recording payment for invoice %d: %w", invoice.ID, err)
+	}
+
+	// each try at paying the invoice is a new attempt, once the one
+	// before it has failed. The key makes a retried charge for the same
+	// attempt a no-op.
+	attempt := len(payments)
+	key := fmt.Sprintf("invoice-%d", invoice.ID)
+	if attempt != 0 {
+		key = fmt.Sprintf("invoice-%d-%d", invoice.ID, attempt)
+	}
+
+	customerID, err := app.paymentCustomer(invoice.UserID, method)
+	if err == nil {
+		var charge *Charge
+		charge, err = app.Payments.Charge(ChargeRequest{
+			CustomerID:     customerID,
+			Amount:         invoice.Total,
+			Currency:       invoice.Currency,
+			Description:    fmt.Sprintf("Invoice %s", invoice.DisplayNumber()),
+			IdempotencyKey: key,
+		})
+		if err == nil {
+			return app.recordCharge(ctx, payment, charge)
+		}
+	}
+
+	// nothing was charged, so the invoice is free to be paid another way
+	if _, failErr := app.Models.Payment.SetStatus(payment.ID, data.PaymentPending, data.PaymentFailed, err.Error()); failErr != nil {
+		app.logger(ctx).Error("could not fail payment", "payment_id", payment.ID, "error", failErr)
+	}
+	return nil, nil, err
+}
+
+// recordCharge records the charge made for payment. If that fails, money
+// that was taken is given back; a charge still pending can't be, and is
+// reported.
+func (app *Config) recordCharge(ctx context.Context, payment data.Payment, charge *Charge) (*data.Payment, *Charge, error) {
+	// payments have the same statuses as charges
+	payment.ChargeID = charge.ID
+	payment.Status = charge.Status
+	payment.FailureMessage = charge.FailureMessage
+
+	err := app.Models.Payment.SetCharge(payment.ID, charge.ID, charge.Status, charge.FailureMessage)
+	if err == nil {
+		return &payment, charge, nil
+	}
+	err = fmt.Errorf("recording charge %s: %w", charge.ID, err)
+
+	switch charge.Status {
+	case chargeSucceeded:
+		if _, refundErr := app.Payments.Refund(charge.ID, charge.Amount); refundErr != nil {
+			app.reportError(ctx, ErrorEvent{
+				Source:   "payments",
+				Severity: SeverityCritical,
+				Err:      fmt.Errorf("could not refund unrecorded charge %s: %w", charge.ID, refundErr),
+				Payload:  map[string]any{"invoice_id": payment.InvoiceID, "amount": charge.Amount},
+			})
+		}
+	case chargePending:
+		app.reportError(ctx, ErrorEvent{
+			Source:   "payments",
+			Severity: SeverityCritical,
+			Err:      fmt.Errorf("could not record pending charge %s: %w", charge.ID, err),
+			Payload:  map[string]any{"invoice_id": payment.InvoiceID, "amount": charge.Amount},
+		})
+	}
+
+	return nil, nil, err
+}
+
+// openPayment returns the invoice's payment that is pending or paid.
+func (app *Config) openPayment(invoiceID int) (*data.Payment, error) {
+	payments, err := app.Models.Payment.GetForInvoice(invoiceID)
+	if err != nil {
+		return nil, fmt.Errorf("loading payments for invoice %d: %w", invoiceID, err)
+	}
+	for _, payment := range payments {
+		if payment.Open() {
+			return payment, nil
+		}
+	}
+	return nil, fmt.Errorf("no open payment for invoice %d", invoiceID)
+}
+
+// activate gives the user the subscription in job once its invoice is
+// paid: it subscribes them, marks the invoice paid, and queues the mail.
+// payment is nil if there was nothing to charge. If the subscription
+// can't be made, the payment is refunded.
+func (app *Config) activate(ctx context.Context, job SubscriptionJob, invoiceID int, payment *data.Payment) error {
+	user, plan, err := app.loadSubscription(job)
+	if err == nil {
+		// if the same change was sent twice, the other one has made it, and
+		// this one is refunded
+		err = app.Models.Plan.SubscribeUserToPlan(*user, *plan, job.FromPlanID, job.SubscribedAt)
+	}
+	if err != nil {
+		app.voidInvoice(ctx, invoiceID, payment, err.Error())
+		return err
+	}
+
+	if err := app.Models.Invoice.UpdateStatus(invoiceID, data.InvoicePaid); err != nil {
+		app.logger(ctx).Error("could not mark invoice paid", "invoice_id", invoiceID, "error", err)
+	}
+
+	app.enqueueSubscriptionJobs(ctx, job, jobInvoice, jobManual)
+	return nil
+}
+
+// voidInvoice voids an invoice that won't be paid, and refunds payment in
+// full if there is one. An invoice that has been paid meanwhile, by
+// another try at the same checkout, stands, and so does its payment.
+func (app *Config) voidInvoice(ctx context.Context, invoiceID int, payment *data.Payment, reason string) {
+	voided, err := app.Models.Invoice.Void(invoiceID)
+	if err != nil && payment != nil {
+		// whether it may be refunded is for someone to look into
+		app.reportError(ctx, ErrorEvent{
+			Source:   "payments",
+			Severity: SeverityCritical,
+			Err:      fmt.Errorf("could not void invoice, charge %s not refunded: %w", payment.ChargeID, err),
+			Payload:  map[string]any{"invoice_id": invoiceID, "amount": payment.Amount},
+		})
+		return
+	}
+	if err != nil {
+		app.logger(ctx).Error("could not void invoice", "invoice_id", invoiceID, "error", err)
+		return
+	}
+	if !voided {
+		app.logger(ctx).Warn("invoice not voided, it is no longer waiting to be paid", "invoice_id", invoiceID)
+		return
+	}
+
+	if payment != nil {
+		_, err := app.Payments.Refund(payment.ChargeID, payment.Amount)
+		if err == nil {
+			_, err = app.Models.Payment.SetStatus(payment.ID, data.PaymentSucceeded, data.PaymentRefunded, reason)
+		}
+		if err != nil {
+			app.reportError(ctx, ErrorEvent{
+				Source:   "payments",
+				Severity: SeverityCritical,
+				Err:      fmt.Errorf("could not refund charge %s: %w", payment.ChargeID, err),
+				Payload:  map[string]any{"invoice_id": invoiceID, "amount": payment.Amount},
+			})
+		}
+	}
+}
+
+// enqueueSubscriptionJobs queues a job of each kind. They still happen if
+// we restart part way through.
+func (app *Config) enqueueSubscriptionJobs(ctx context.Context, job SubscriptionJob, kinds ...string) {
+	for _, kind := range kinds {
+		if _, err := app.Jobs.Enqueue(kind, job, time.Time{}); err != nil {
+			app.reportError(ctx, ErrorEvent{
+				Source:   kind,
+				Severity: SeverityCritical,
+				Err:      fmt.Errorf("could not queue %s job: %w", kind, err),
+				Payload:  map[string]any{"plan_id": job.PlanID},
+			})
+		}
+	}
+}
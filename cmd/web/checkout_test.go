@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"final-project/data"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// unrecordedPayments is a payments table that can't record charges.
+type unrecordedPayments struct {
+	memoryPayments
+}
+
+func (s *unrecordedPayments) SetCharge(id int, chargeID, status, failureMessage string) error {
+	return errors.New("connection reset")
+}
+
+func TestConfig_payInvoice_twiceAtOnce(t *testing.T) {
+	payments := &memoryPayments{}
+	saved := testApp.Models.Payment
+	testApp.Models.Payment = payments
+	defer func() {
+		testApp.Models.Payment = saved
+	}()
+	testGateway.forgetCharges()
+	testGateway.setCard("cus_test", "pm_card_visa")
+	defer testGateway.setCard("cus_test", "")
+
+	invoice := &data.Invoice{ID: 1, Number: 1, UserID: 1, Total: 1800, Currency: "USD"}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = testApp.payInvoice(context.Background(), invoice, "", SubscriptionJob{UserID: 1, PlanID: 1})
+		}(i)
+	}
+	wg.Wait()
+
+	// one of them charges, and the other finds it paying
+	paid, open := 0, 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			paid++
+		case errors.Is(err, errPaymentOpen):
+			open++
+		default:
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	if paid != 1 || open != 1 {
+		t.Errorf("expected one charge and one open payment, got %d and %d", paid, open)
+	}
+
+	if n := len(testGateway.charges); n != 1 {
+		t.Errorf("expected 1 charge at the gateway, got %d", n)
+	}
+}
+
+func TestConfig_payInvoice_unrecorded(t *testing.T) {
+	// a gateway of our own, whose webhooks we only count
+	webhooks := make(chan *http.Request, 1)
+	gateway := &FakeGateway{
+		WebhookDelay: time.Hour,
+		Secret:       "secret",
+		Send: func(req *http.Request) error {
+			webhooks <- req
+			return nil
+		},
+		customers: map[string]string{"cus_test": "pm_card_visa"},
+	}
+
+	savedPayments, savedGateway := testApp.Models.Payment, testApp.Payments
+	testApp.Models.Payment = &unrecordedPayments{}
+	testApp.Payments = gateway
+	defer func() {
+		testApp.Models.Payment, testApp.Payments = savedPayments, savedGateway
+	}()
+
+	invoice := &data.Invoice{ID: 1, Number: 1, UserID: 1, Total: 1800, Currency: "USD"}
+	_, _, err := testApp.payInvoice(context.Background(), invoice, "", SubscriptionJob{UserID: 1, PlanID: 1})
+	if err == nil {
+		t.Fatal("expected an error when the charge can't be recorded")
+	}
+
+	// the money taken is given back
+	select {
+	case <-webhooks:
+	case <-time.After(time.Second):
+		t.Fatal("expected a refund")
+	}
+	for id, charge := range gateway.charges {
+		if charge.refunded != charge.Amount {
+			t.Errorf("expected charge %s refunded in full, got %d of %d", id, charge.refunded, charge.Amount)
+		}
+	}
+}
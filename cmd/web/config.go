@@ -3,20 +3,34 @@ package main
 import (
 	"database/sql"
 	"final-project/data"
-	"log"
+	"html/template"
+	"log/slog"
 	"sync"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/gomodule/redigo/redis"
 )
 
 type Config struct {
 	Session       *scs.SessionManager
 	DB            *sql.DB
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
+	Redis         *redis.Pool
+	Log           *slog.Logger
 	Wait          *sync.WaitGroup
 	Models        data.Models
-	Mailer        Mail
-	ErrorChan     chan error
+	Mailer        *Mail
+	Jobs          *JobQueue
+	Billing       *BillingScheduler
+	Tax           *TaxCalculator
+	Payments      PaymentGateway
+	Tokens        *TokenService
+	ErrorChan     chan ErrorEvent
+	Errors        *ErrorRouter
 	ErrorChanDone chan bool
+	// closed once the error listener has sent its last digest and stopped
+	ErrorsStopped chan struct{}
+	TemplateCache map[string]*template.Template
+	Settings      Settings
+	// set once the web server starts draining; see serve
+	draining int32
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"final-project/data"
+	"fmt"
+	"time"
+)
+
+// couponError is why a coupon can't be used, in words for the user.
+type couponError string
+
+func (e couponError) Error() string {
+	return string(e)
+}
+
+const (
+	errCouponUnknown     couponError = "We don't recognize that coupon code."
+	errCouponExpired     couponError = "That coupon has expired."
+	errCouponUsedUp      couponError = "That coupon is no longer available."
+	errCouponUsed        couponError = "You have already used that coupon."
+	errCouponWrongPlan   couponError = "That coupon is not for this plan."
+	errCouponCurrency    couponError = "That coupon can't be used in your currency."
+	errCouponTrial       couponError = "Coupons can't be used with a free trial."
+	errCouponNothingOwed couponError = "There is nothing to pay, so that coupon can't be used."
+)
+
+// checkCoupon says why coupon can't be used at now on plan, billed in
+// currency, or returns nil if it can. It doesn't know who is using it.
+func checkCoupon(coupon data.Coupon, plan data.Plan, currency string, now time.Time) error {
+	switch {
+	case coupon.Expired(now):
+		return errCouponExpired
+	case coupon.UsedUp():
+		return errCouponUsedUp
+	case coupon.PlanID != 0 && coupon.PlanID != plan.ID:
+		return errCouponWrongPlan
+	case coupon.AmountOff > 0 && coupon.Currency != currency:
+		return errCouponCurrency
+	}
+	return nil
+}
+
+// couponFor looks up the coupon a user entered to subscribe to plan, and
+// checks that it can go on the invoice for the subscription. sub is their
+// live subscription, if they have one, and trial says the subscription
+// starts with a free trial. Reasons not to take the coupon are
+// couponErrors.
+func (app *Config) couponFor(code string, user data.User, plan data.Plan, sub *data.Subscription, trial bool) (*data.Coupon, error) {
+	coupon, err := app.Models.Coupon.GetByCode(code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errCouponUnknown
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the coupon comes off the first invoice, so there has to be one with
+	// something on it to take off
+	now := time.Now()
+	locale := userLocale(user)
+	_, currency := plan.Price(locale.Currency)
+	switch {
+	case trial:
+		return nil, errCouponTrial
+	case sub != nil && (sub.PlanID == plan.ID || sub.Status == data.SubscriptionTrialing):
+		return nil, errCouponNothingOwed
+	case sub != nil:
+		paid, err := app.paidInvoice(user.ID, sub.PlanID, sub.CurrentPeriodEnd)
+		if err != nil {
+			return nil, err
+		}
+		p := prorate(*sub.Plan, plan, paid, locale, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, now)
+		if p.Net <= 0 {
+			return nil, errCouponNothingOwed
+		}
+		currency = p.Currency
+	}
+
+	if err := checkCoupon(*coupon, plan, currency, now); err != nil {
+		return nil, err
+	}
+
+	used, err := app.Models.Coupon.Redeemed(coupon.ID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if used {
+		return nil, errCouponUsed
+	}
+
+	return coupon, nil
+}
+
+// addCouponLine takes the coupon's discount off an invoice whose other
+// lines are all added, and puts the coupon on it, to be redeemed with it.
+// A fixed amount in another currency is left off.
+func addCouponLine(invoice *data.Invoice, coupon data.Coupon) {
+	if coupon.AmountOff > 0 && coupon.Currency != invoice.Currency {
+		return
+	}
+
+	discount := coupon.Discount(invoice.Subtotal)
+	if discount == 0 {
+		return
+	}
+
+	description := fmt.Sprintf("Coupon %s, %s", coupon.Code, coupon.DiscountForDisplay(invoice.Locale))
+	invoice.AddLine(description, 1, -discount)
+	invoice.CouponID = coupon.ID
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"final-project/data"
+	"testing"
+	"time"
+)
+
+func Test_checkCoupon(t *testing.T) {
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		coupon   data.Coupon
+		currency string
+		expected error
+	}{
+		{"percent off", data.Coupon{PercentOff: 10, Currency: "USD"}, "EUR", nil},
+		{"amount off", data.Coupon{AmountOff: 500, Currency: "USD"}, "USD", nil},
+		{"amount off in another currency", data.Coupon{AmountOff: 500, Currency: "USD"}, "EUR", errCouponCurrency},
+		{"expired", data.Coupon{PercentOff: 10, ExpiresAt: sql.NullTime{Time: now, Valid: true}}, "USD", errCouponExpired},
+		{"not expired yet", data.Coupon{PercentOff: 10, ExpiresAt: sql.NullTime{Time: now.Add(time.Hour), Valid: true}}, "USD", nil},
+		{"used up", data.Coupon{PercentOff: 10, MaxRedemptions: 5, Redemptions: 5}, "USD", errCouponUsedUp},
+		{"unlimited", data.Coupon{PercentOff: 10, Redemptions: 500}, "USD", nil},
+		{"for another plan", data.Coupon{PercentOff: 10, PlanID: 3}, "USD", errCouponWrongPlan},
+		{"for this plan", data.Coupon{PercentOff: 10, PlanID: 1}, "USD", nil},
+	}
+
+	for _, tt := range tests {
+		err := checkCoupon(tt.coupon, bronze, tt.currency, now)
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func Test_addCouponLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		coupon   data.Coupon
+		subtotal int
+		discount int
+	}{
+		{"percent off", data.Coupon{ID: 1, Code: "WELCOME10", PercentOff: 10}, 1999, -200},
+		{"amount off", data.Coupon{ID: 2, Code: "FIVEOFF", AmountOff: 500, Currency: "USD"}, 1500, -500},
+		{"more than the invoice", data.Coupon{ID: 2, Code: "FIVEOFF", AmountOff: 500, Currency: "USD"}, 300, -300},
+		{"in another currency", data.Coupon{ID: 7, Code: "FIVEEURO", AmountOff: 500, Currency: "EUR"}, 1500, 0},
+	}
+
+	for _, tt := range tests {
+		invoice := &data.Invoice{Currency: "USD", Locale: "en-US"}
+		invoice.AddLine("Bronze Plan subscription", 1, tt.subtotal)
+		addCouponLine(invoice, tt.coupon)
+
+		if tt.discount == 0 {
+			if len(invoice.Lines) != 1 || invoice.CouponID != 0 {
+				t.Errorf("%s: expected no discount, got %v and coupon %d", tt.name, invoice.Lines[1:], invoice.CouponID)
+			}
+			continue
+		}
+
+		if len(invoice.Lines) != 2 {
+			t.Fatalf("%s: expected 2 lines, got %d", tt.name, len(invoice.Lines))
+		}
+		if invoice.Lines[1].Amount != tt.discount {
+			t.Errorf("%s: expected a discount of %d, got %d", tt.name, tt.discount, invoice.Lines[1].Amount)
+		}
+		if invoice.Subtotal != tt.subtotal+tt.discount {
+			t.Errorf("%s: expected subtotal %d, got %d", tt.name, tt.subtotal+tt.discount, invoice.Subtotal)
+		}
+		if invoice.CouponID != tt.coupon.ID {
+			t.Errorf("%s: expected coupon %d on the invoice, got %d", tt.name, tt.coupon.ID, invoice.CouponID)
+		}
+	}
+}
+
+func TestConfig_couponFor(t *testing.T) {
+	user := data.User{ID: 1, Locale: "en-US"}
+
+	tests := []struct {
+		name     string
+		code     string
+		plan     data.Plan
+		sub      *data.Subscription
+		trial    bool
+		expected error
+	}{
+		{"new subscription", "welcome10", bronze, nil, false, nil},
+		{"unknown code", "BOGUS", bronze, nil, false, errCouponUnknown},
+		{"expired", "EXPIRED", bronze, nil, false, errCouponExpired},
+		{"used up", "GONE", bronze, nil, false, errCouponUsedUp},
+		{"another plan's coupon", "GOLDONLY", bronze, nil, false, errCouponWrongPlan},
+		{"already used", "ONCE", bronze, nil, false, errCouponUsed},
+		{"with a trial", "WELCOME10", bronze, nil, true, errCouponTrial},
+		{"same plan", "WELCOME10", bronze, &data.Subscription{PlanID: 1, Plan: &bronze}, false, errCouponNothingOwed},
+	}
+
+	for _, tt := range tests {
+		coupon, err := testApp.couponFor(tt.code, user, tt.plan, tt.sub, tt.trial)
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, err)
+		}
+		if err == nil && coupon == nil {
+			t.Errorf("%s: expected a coupon", tt.name)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"final-project/data"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// dunningDays are the days after a renewal is declined that we remind the
+// user to pay, if they fall inside the grace period.
+var dunningDays = []int{1, 3, 7}
+
+// DunningJob is the payload for one step in chasing a renewal that wasn't
+// paid: a reminder, or, once the grace period is over, the end of the
+// subscription.
+type DunningJob struct {
+	UserID    int
+	PlanID    int
+	InvoiceID int
+	// days since the renewal was declined
+	Day   int
+	Final bool
+}
+
+// context tags ctx with the job's user.
+func (j DunningJob) context(ctx context.Context) context.Context {
+	return withRequestTag(ctx, requestTag{UserID: j.UserID})
+}
+
+// DunningNotice is what a reminder to pay says.
+type DunningNotice struct {
+	PlanName string
+	Invoice  InvoiceNotice
+	// when the grace period ends
+	Deadline string
+	// where to pay
+	Link string
+}
+
+// startDunning marks the user's subscription past due, since the renewal
+// invoice wasn't paid, and queues the reminders and the end of the grace
+// period. A subscription already past due is already being chased.
+func (app *Config) startDunning(ctx context.Context, job SubscriptionJob, invoiceID int, reason string) error {
+	started, err := app.Models.Plan.MarkPastDue(job.UserID)
+	if err != nil {
+		return fmt.Errorf("marking subscription past due: %w", err)
+	}
+	if !started {
+		return nil
+	}
+
+	app.logger(ctx).Info("renewal declined; subscription past due",
+		"plan_id", job.PlanID, "invoice_id", invoiceID, "reason", reason)
+
+	grace := app.Settings.Dunning.GraceDays
+	steps := make([]DunningJob, 0, len(dunningDays)+1)
+	for _, day := range dunningDays {
+		if day < grace {
+			steps = append(steps, DunningJob{UserID: job.UserID, PlanID: job.PlanID, InvoiceID: invoiceID, Day: day})
+		}
+	}
+	steps = append(steps, DunningJob{UserID: job.UserID, PlanID: job.PlanID, InvoiceID: invoiceID, Day: grace, Final: true})
+
+	now := time.Now()
+	for _, step := range steps {
+		if _, err := app.Jobs.Enqueue(jobDunning, step, now.AddDate(0, 0, step.Day)); err != nil {
+			app.reportError(ctx, ErrorEvent{
+				Source:   jobDunning,
+				Severity: SeverityCritical,
+				Err:      fmt.Errorf("could not queue dunning for day %d: %w", step.Day, err),
+				Payload:  map[string]any{"invoice_id": invoiceID},
+			})
+		}
+	}
+
+	return nil
+}
+
+// dun takes one step in chasing an unpaid renewal, unless it has been paid
+// or the subscription has ended since the step was queued.
+func (app *Config) dun(ctx context.Context, job DunningJob) error {
+	ctx = job.context(ctx)
+
+	sub, err := app.Models.Plan.GetSubscription(job.UserID)
+	if err != nil {
+		return fmt.Errorf("loading subscription: %w", err)
+	}
+
+	invoice, err := app.Models.Invoice.GetOne(job.InvoiceID)
+	if err != nil {
+		return fmt.Errorf("loading invoice %d: %w", job.InvoiceID, err)
+	}
+
+	if sub.Status != data.SubscriptionPastDue || invoice.Status != data.InvoiceIssued {
+		return nil
+	}
+
+	user, err := app.Models.User.GetOne(job.UserID)
+	if err != nil {
+		return fmt.Errorf("loading user %d: %w", job.UserID, err)
+	}
+
+	if job.Final {
+		return app.endDunning(ctx, *user, sub, invoice)
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: fmt.Sprintf("Payment Needed for Your %s", sub.Plan.PlanName),
+		Data: DunningNotice{
+			PlanName: sub.Plan.PlanName,
+			Invoice:  newInvoiceNotice(invoice),
+			Deadline: app.dunningDeadline(sub).Format("Jan 2, 2006"),
+			Link:     app.Settings.BaseURL + "/members/subscription",
+		},
+		Template: "dunning",
+	}
+	app.sendMail(ctx, msg)
+
+	return nil
+}
+
+// endDunning gives up on a renewal the grace period has run out for: the
+// subscription is moved to the downgrade plan if there is one, or else
+// canceled, and the invoice is voided.
+func (app *Config) endDunning(ctx context.Context, user data.User, sub *data.Subscription, invoice *data.Invoice) error {
+	var subject, text string
+
+	if planID := app.Settings.Dunning.DowngradePlan; planID != 0 && planID != sub.PlanID {
+		plan, err := app.Models.Plan.GetOne(planID)
+		if err != nil {
+			return fmt.Errorf("loading plan %d: %w", planID, err)
+		}
+
+		if err := app.Models.Plan.DowngradeSubscription(user.ID, plan.ID); err != nil {
+			return fmt.Errorf("downgrading subscription: %w", err)
+		}
+
+		subject = fmt.Sprintf("You've Moved to Our %s", plan.PlanName)
+		text = fmt.Sprintf("We didn't receive payment for your %s, so we have moved you to our %s.",
+			sub.Plan.PlanName, plan.PlanName)
+	} else {
+		err := app.Models.Plan.CancelSubscription(user.ID, false)
+		if err != nil && !errors.Is(err, data.ErrNoSubscription) {
+			return fmt.Errorf("canceling subscription: %w", err)
+		}
+
+		subject = fmt.Sprintf("Your %s Has Ended", sub.Plan.PlanName)
+		text = fmt.Sprintf("We didn't receive payment for your %s, so your subscription has ended. "+
+			"You can subscribe again at any time.", sub.Plan.PlanName)
+	}
+
+	app.voidInvoice(ctx, invoice.ID, nil, "unpaid at the end of the grace period")
+	app.logger(ctx).Info("dunning over", "plan_id", sub.PlanID, "invoice_id", invoice.ID)
+
+	app.sendMail(ctx, Message{To: user.Email, Subject: subject, Data: text})
+
+	return nil
+}
+
+// dunningDeadline is when a past due subscription's grace period ends.
+func (app *Config) dunningDeadline(sub *data.Subscription) time.Time {
+	return sub.PastDueSince.Time.AddDate(0, 0, app.Settings.Dunning.GraceDays)
+}
+
+// pastDueWarning is the banner for members whose subscription is past due,
+// or "" if it isn't.
+func (app *Config) pastDueWarning(r *http.Request) string {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	sub, err := app.Models.Plan.GetSubscription(userID)
+	if err != nil || sub.Status != data.SubscriptionPastDue {
+		return ""
+	}
+
+	return fmt.Sprintf("We couldn't take payment for your %s. Please pay on your subscription page by %s to keep it.",
+		sub.Plan.PlanName, app.dunningDeadline(sub).Format("Jan 2, 2006"))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"final-project/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_dun(t *testing.T) {
+	downgrade := testApp.Settings.Dunning.DowngradePlan
+	defer func() {
+		testApp.Settings.Dunning.DowngradePlan = downgrade
+	}()
+
+	// the mock user 2 is past due; user 1 has paid
+	tests := []struct {
+		name      string
+		job       DunningJob
+		downgrade int
+		subject   string
+	}{
+		{"reminder", DunningJob{UserID: 2, PlanID: 1, InvoiceID: 2, Day: 3}, 0, "Payment Needed for Your Fake Plan"},
+		{"paid since", DunningJob{UserID: 1, PlanID: 1, InvoiceID: 2, Day: 3}, 0, ""},
+		{"canceled", DunningJob{UserID: 2, PlanID: 1, InvoiceID: 2, Day: 14, Final: true}, 0, "Your Fake Plan Has Ended"},
+		{"downgraded", DunningJob{UserID: 2, PlanID: 1, InvoiceID: 2, Day: 14, Final: true}, 3, "You've Moved to Our Fake Gold Plan"},
+	}
+
+	for _, tt := range tests {
+		testTransport.Reset()
+		testApp.Settings.Dunning.DowngradePlan = tt.downgrade
+
+		if err := testApp.dun(context.Background(), tt.job); err != nil {
+			t.Errorf("%s: expected no error, got %v", tt.name, err)
+			continue
+		}
+
+		want := 1
+		if tt.subject == "" {
+			want = 0
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for len(testTransport.Messages()) < want && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+
+		messages := testTransport.Messages()
+		if len(messages) != want {
+			t.Errorf("%s: expected %d mail messages, got %d", tt.name, want, len(messages))
+			continue
+		}
+		if want == 0 {
+			continue
+		}
+		if messages[0].Subject != tt.subject {
+			t.Errorf("%s: expected subject %q, got %q", tt.name, tt.subject, messages[0].Subject)
+		}
+
+		// reminders say when to pay by, and where
+		if !tt.job.Final {
+			deadline := time.Now().AddDate(0, 0, 11).Format("Jan 2, 2006")
+			for _, body := range []string{messages[0].PlainBody, messages[0].HTMLBody} {
+				if !strings.Contains(body, deadline) || !strings.Contains(body, "/members/subscription") {
+					t.Errorf("%s: expected the deadline %s and a link to pay in %q", tt.name, deadline, body)
+				}
+			}
+		}
+	}
+}
+
+func TestHandlers_PaySubscription(t *testing.T) {
+	tests := []struct {
+		userID int
+		method string
+		flash  string
+		error  string
+	}{
+		{1, "pm_card_visa", "", "There is nothing to pay."},
+		{2, "pm_card_declined", "", "Your card was declined."},
+		{2, "pm_card_delayed", "Your payment is being processed.", ""},
+		{2, "pm_card_visa", "Thank you! Your payment went through.", ""},
+	}
+
+	for _, tt := range tests {
+		testGateway.forgetCharges()
+
+		req, _ := http.NewRequest("POST", "/members/subscription/pay",
+			strings.NewReader("payment_method="+tt.method))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		ctx := createMockContext(req)
+		req = req.WithContext(ctx)
+		testApp.Session.Put(ctx, "userID", tt.userID)
+		testApp.Session.Put(ctx, "user", data.User{ID: tt.userID})
+
+		rr := httptest.NewRecorder()
+		testApp.PaySubscription(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("pay %d %s: expected status %d, got %d", tt.userID, tt.method, http.StatusSeeOther, rr.Code)
+		}
+		if msg := testApp.Session.GetString(ctx, "flash"); msg != tt.flash {
+			t.Errorf("pay %d %s: expected flash %q, got %q", tt.userID, tt.method, tt.flash, msg)
+		}
+		if msg := testApp.Session.GetString(ctx, "error"); msg != tt.error {
+			t.Errorf("pay %d %s: expected error %q, got %q", tt.userID, tt.method, tt.error, msg)
+		}
+	}
+}
+
+func TestHandlers_PaySubscription_twice(t *testing.T) {
+	payments := &memoryPayments{}
+	saved := testApp.Models.Payment
+	testApp.Models.Payment = payments
+	defer func() {
+		testApp.Models.Payment = saved
+	}()
+	testGateway.forgetCharges()
+
+	// declined, then pending, then pressed again while it is pending
+	tests := []struct {
+		method string
+		flash  string
+		error  string
+	}{
+		{"pm_card_declined", "", "Your card was declined."},
+		{"pm_card_delayed", "Your payment is being processed.", ""},
+		{"pm_card_visa", "Your payment is already being processed.", ""},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/members/subscription/pay",
+			strings.NewReader("payment_method="+tt.method))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		ctx := createMockContext(req)
+		req = req.WithContext(ctx)
+		testApp.Session.Put(ctx, "userID", 2)
+		testApp.Session.Put(ctx, "user", data.User{ID: 2})
+
+		rr := httptest.NewRecorder()
+		testApp.PaySubscription(rr, req)
+
+		if msg := testApp.Session.GetString(ctx, "flash"); msg != tt.flash {
+			t.Errorf("pay %s: expected flash %q, got %q", tt.method, tt.flash, msg)
+		}
+		if msg := testApp.Session.GetString(ctx, "error"); msg != tt.error {
+			t.Errorf("pay %s: expected error %q, got %q", tt.method, tt.error, msg)
+		}
+	}
+
+	// the declined attempt and the pending one; nothing more was charged
+	if n := len(payments.payments); n != 2 {
+		t.Fatalf("expected 2 payments, got %d", n)
+	}
+	if payments.payments[0].ChargeID == payments.payments[1].ChargeID {
+		t.Error("expected the second attempt to be a new charge")
+	}
+}
+
+func TestHandlers_SubscribePlanPastDue(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/members/subscribe", strings.NewReader("plan=3&payment_method=pm_card_visa"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	ctx := createMockContext(req)
+	req = req.WithContext(ctx)
+	testApp.Session.Put(ctx, "userID", 2)
+	testApp.Session.Put(ctx, "user", data.User{ID: 2})
+
+	rr := httptest.NewRecorder()
+	testApp.SubscribePlan(rr, req)
+
+	if msg := testApp.Session.GetString(ctx, "error"); msg != "Please pay for your current plan before changing it." {
+		t.Errorf("expected to be asked to pay first, got %q", msg)
+	}
+}
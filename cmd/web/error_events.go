@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"final-project/data"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Severity says how much attention an error event needs.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	case SeverityCritical:
+		return "critical"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// level maps the severity onto a log level.
+func (s Severity) level() slog.Level {
+	switch {
+	case s >= SeverityError:
+		return slog.LevelError
+	case s == SeverityWarning:
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
+
+// ErrorEvent is an error from somewhere in the app, with enough context to
+// tell one failure from another.
+type ErrorEvent struct {
+	// the subsystem that failed, such as "invoice" or "mail"
+	Source   string
+	Severity Severity
+	// who and what it happened for, if anyone
+	UserID    int
+	RequestID string
+	Err       error
+	// anything else worth knowing, such as the plan or message ID
+	Payload map[string]any
+	Time    time.Time
+}
+
+// logAttrs returns the event as log attributes.
+func (ev ErrorEvent) logAttrs() []any {
+	attrs := []any{"source", ev.Source, "severity", ev.Severity.String()}
+	attrs = append(attrs, requestTag{RequestID: ev.RequestID, UserID: ev.UserID}.attrs()...)
+	for k, v := range ev.Payload {
+		attrs = append(attrs, k, v)
+	}
+	return append(attrs, "error", ev.Err.Error())
+}
+
+// ErrorSink does something with error events: logs them, stores them,
+// tells someone about them.
+type ErrorSink interface {
+	Handle(ev ErrorEvent) error
+}
+
+// flusher is a sink that batches events, and needs telling when to send
+// what it has.
+type flusher interface {
+	Flush() error
+}
+
+type errorSubscription struct {
+	min  Severity
+	sink ErrorSink
+}
+
+// ErrorRouter hands each event to the sinks subscribed to its severity.
+// Subscribe everything before routing the first event.
+type ErrorRouter struct {
+	// where to complain when a sink fails
+	Log  *slog.Logger
+	subs []errorSubscription
+}
+
+// Subscribe sends sink every event of severity min or worse.
+func (r *ErrorRouter) Subscribe(min Severity, sink ErrorSink) {
+	r.subs = append(r.subs, errorSubscription{min: min, sink: sink})
+}
+
+// Route hands ev to every subscribed sink. A sink failing doesn't stop
+// the others.
+func (r *ErrorRouter) Route(ev ErrorEvent) {
+	for _, sub := range r.subs {
+		if ev.Severity < sub.min {
+			continue
+		}
+		if err := sub.sink.Handle(ev); err != nil {
+			r.Log.Error("error sink failed", append(ev.logAttrs(), "sink_error", err)...)
+		}
+	}
+}
+
+// Flush tells every batching sink to send what it has.
+func (r *ErrorRouter) Flush() {
+	for _, sub := range r.subs {
+		if f, ok := sub.sink.(flusher); ok {
+			if err := f.Flush(); err != nil {
+				r.Log.Error("could not flush error sink", "error", err)
+			}
+		}
+	}
+}
+
+// reportError hands ev to the error listener, tagged with the request and
+// user in ctx unless it says otherwise. If ctx is done, or the listener has
+// stopped, ev is only logged rather than waiting for it.
+func (app *Config) reportError(ctx context.Context, ev ErrorEvent) {
+	tag := tagFromContext(ctx)
+	if ev.RequestID == "" {
+		ev.RequestID = tag.RequestID
+	}
+	if ev.UserID == 0 {
+		ev.UserID = tag.UserID
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	select {
+	case app.ErrorChan <- ev:
+	case <-ctx.Done():
+		app.Log.Log(context.Background(), ev.Severity.level(), "error event", ev.logAttrs()...)
+	case <-app.ErrorsStopped:
+		app.Log.Log(context.Background(), ev.Severity.level(), "error event", ev.logAttrs()...)
+	}
+}
+
+// LogSink writes events to the log, at a level to match their severity.
+type LogSink struct {
+	Log *slog.Logger
+}
+
+func (s *LogSink) Handle(ev ErrorEvent) error {
+	s.Log.Log(context.Background(), ev.Severity.level(), "error event", ev.logAttrs()...)
+	return nil
+}
+
+// StoreSink keeps events in the app_errors table.
+type StoreSink struct {
+	Errors data.AppErrorType
+}
+
+func (s *StoreSink) Handle(ev ErrorEvent) error {
+	payload, err := json.Marshal(ev.Payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Errors.Insert(data.AppError{
+		Source:    ev.Source,
+		Severity:  ev.Severity.String(),
+		UserID:    ev.UserID,
+		RequestID: ev.RequestID,
+		Message:   ev.Err.Error(),
+		Payload:   payload,
+	})
+	return err
+}
+
+// DigestSink collects events and mails them to an admin as one message
+// each time it is flushed, rather than one mail per error.
+type DigestSink struct {
+	To string
+	// at most this many events go in one digest; the rest are counted
+	Max  int
+	Send func(msg Message)
+
+	mu      sync.Mutex
+	events  []ErrorEvent
+	dropped int
+}
+
+func (s *DigestSink) Handle(ev ErrorEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.events) >= s.Max {
+		s.dropped++
+		return nil
+	}
+	s.events = append(s.events, ev)
+	return nil
+}
+
+// Flush mails what has been collected since the last flush, if anything.
+func (s *DigestSink) Flush() error {
+	s.mu.Lock()
+	events, dropped := s.events, s.dropped
+	s.events, s.dropped = nil, 0
+	s.mu.Unlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	lines := make([]DigestLine, 0, len(events))
+	for _, ev := range events {
+		lines = append(lines, newDigestLine(ev))
+	}
+
+	s.Send(Message{
+		To:       s.To,
+		Subject:  fmt.Sprintf("%d error(s) since %s", len(events)+dropped, events[0].Time.Format(time.RFC822)),
+		Template: "error-digest",
+		DataMap: map[string]any{
+			"Events":  lines,
+			"Dropped": dropped,
+		},
+	})
+	return nil
+}
+
+// DigestLine is an error event as the digest shows it. The digest waits in
+// the mail outbox as JSON, where an error would be lost, so it is all
+// text.
+type DigestLine struct {
+	Time     string
+	Severity string
+	Source   string
+	User     string
+	Error    string
+}
+
+func newDigestLine(ev ErrorEvent) DigestLine {
+	line := DigestLine{
+		Time:     ev.Time.Format("2006-01-02 15:04:05 MST"),
+		Severity: ev.Severity.String(),
+		Source:   ev.Source,
+		Error:    ev.Err.Error(),
+	}
+	if ev.UserID != 0 {
+		line.User = strconv.Itoa(ev.UserID)
+	}
+	return line
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps what it is handed, and fails if told to.
+type recordingSink struct {
+	events []ErrorEvent
+	fail   bool
+}
+
+func (s *recordingSink) Handle(ev ErrorEvent) error {
+	s.events = append(s.events, ev)
+	if s.fail {
+		return errors.New("sink oops")
+	}
+	return nil
+}
+
+func TestErrorRouter_Route(t *testing.T) {
+	all := &recordingSink{fail: true}
+	serious := &recordingSink{}
+
+	router := &ErrorRouter{Log: testApp.Log}
+	router.Subscribe(SeverityInfo, all)
+	router.Subscribe(SeverityError, serious)
+
+	router.Route(ErrorEvent{Source: "test", Severity: SeverityWarning, Err: errors.New("meh")})
+	router.Route(ErrorEvent{Source: "test", Severity: SeverityCritical, Err: errors.New("boom")})
+
+	if len(all.events) != 2 {
+		t.Errorf("expected every event in the info sink, got %d", len(all.events))
+	}
+
+	// the first sink failing doesn't keep the event from the second
+	if len(serious.events) != 1 || serious.events[0].Severity != SeverityCritical {
+		t.Errorf("expected only the critical event in the error sink, got %v", serious.events)
+	}
+}
+
+func TestDigestSink(t *testing.T) {
+	var sent []Message
+	digest := &DigestSink{
+		To:   "admin@example.com",
+		Max:  2,
+		Send: func(msg Message) { sent = append(sent, msg) },
+	}
+
+	for _, source := range []string{"invoice", "manual", "mail"} {
+		_ = digest.Handle(ErrorEvent{
+			Source:   source,
+			Severity: SeverityError,
+			UserID:   1,
+			Err:      errors.New(source + " broke"),
+			Time:     time.Now(),
+		})
+	}
+
+	_ = digest.Flush()
+	_ = digest.Flush()
+
+	if len(sent) != 1 {
+		t.Fatalf("expected one digest, got %d", len(sent))
+	}
+
+	// the digest goes through the outbox, so it must read the same after
+	msg := outboxRoundTrip(t, sent[0])
+	if msg.To != "admin@example.com" || !strings.HasPrefix(msg.Subject, "3 error(s)") {
+		t.Errorf("unexpected digest %q to %s", msg.Subject, msg.To)
+	}
+
+	// the digest renders, and holds what fit plus a count of the rest
+	body, err := testApp.Mailer.buildTextMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"invoice broke", "manual broke", "1 more"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the digest, got %s", want, body)
+		}
+	}
+
+	if strings.Contains(body, "mail broke") {
+		t.Error("expected events past Max to be left out")
+	}
+
+	html, err := testApp.Mailer.buildHTMLMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(html, "invoice broke") {
+		t.Error("expected the events in the HTML digest")
+	}
+}
+
+// stuckDigest is a batching sink whose flush doesn't return until it is
+// released, like a digest waiting for room in the mail queue.
+type stuckDigest struct {
+	handled  chan ErrorEvent
+	flushing chan struct{}
+	release  chan struct{}
+}
+
+func (s *stuckDigest) Handle(ev ErrorEvent) error {
+	s.handled <- ev
+	return nil
+}
+
+func (s *stuckDigest) Flush() error {
+	select {
+	case s.flushing <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return nil
+}
+
+func TestConfig_listenForError_slowDigest(t *testing.T) {
+	digest := &stuckDigest{
+		handled:  make(chan ErrorEvent, 1),
+		flushing: make(chan struct{}, 1),
+		release:  make(chan struct{}),
+	}
+
+	app := &Config{
+		ErrorChan:     make(chan ErrorEvent),
+		ErrorChanDone: make(chan bool),
+		ErrorsStopped: make(chan struct{}),
+		Errors:        &ErrorRouter{Log: testApp.Log},
+	}
+	app.Settings.Errors.DigestEvery = 10 * time.Millisecond
+	app.Errors.Subscribe(SeverityInfo, digest)
+
+	go app.listenForError()
+
+	select {
+	case <-digest.flushing:
+	case <-time.After(time.Second):
+		t.Fatal("expected the digest to be flushed")
+	}
+
+	// events keep being routed while the digest is stuck
+	select {
+	case app.ErrorChan <- ErrorEvent{Source: "test", Severity: SeverityError, Err: errors.New("boom")}:
+	case <-time.After(time.Second):
+		t.Fatal("error listener stalled behind the digest")
+	}
+	select {
+	case <-digest.handled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the event to be routed")
+	}
+
+	// stopping waits for the flush, and flushes once more
+	close(digest.release)
+	app.ErrorChanDone <- true
+	select {
+	case <-app.ErrorsStopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected the error listener to stop")
+	}
+}
+
+func TestConfig_reportError_nobodyListening(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	stopped := make(chan struct{})
+	close(stopped)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		stopped chan struct{}
+	}{
+		{"request gone", canceled, nil},
+		{"listener stopped", context.Background(), stopped},
+	}
+
+	for _, tt := range tests {
+		app := &Config{
+			Log:           testApp.Log,
+			ErrorChan:     make(chan ErrorEvent),
+			ErrorsStopped: tt.stopped,
+		}
+
+		reported := make(chan struct{})
+		go func(ctx context.Context) {
+			app.reportError(ctx, ErrorEvent{Source: "test", Severity: SeverityError, Err: errors.New("boom")})
+			close(reported)
+		}(tt.ctx)
+
+		select {
+		case <-reported:
+		case <-time.After(time.Second):
+			t.Errorf("%s: expected the event to be logged rather than wait", tt.name)
+		}
+	}
+}
@@ -1,21 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
 	"errors"
 	"final-project/data"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/phpdave11/gofpdf"
 	"github.com/phpdave11/gofpdf/contrib/gofpdi"
 )
 
-// Directories changable for testing:
-var tempDirectory = "./tmp"
-var pdfDirectory = "./pdfs"
-
 func (app *Config) HomePage(w http.ResponseWriter, r *http.Request) {
 	app.render(w, r, "home.page.gohtml", nil)
 }
@@ -30,7 +34,7 @@ func (app *Config) PostLogin(w http.ResponseWriter, r *http.Request) {
 
 	err := r.ParseForm()
 	if err != nil {
-		app.ErrorLog.Println("problem parsing form:", err)
+		app.logger(r.Context()).Error("problem parsing form", "error", err)
 	}
 
 	email := r.Form.Get("email")
@@ -61,7 +65,7 @@ func (app *Config) PostLogin(w http.ResponseWriter, r *http.Request) {
 			To:      "faults@server-sec.com",
 			Data:    fmt.Sprintf("Failed login by %s. Send the dogs.", user.Email),
 		}
-		app.sendMail(msg)
+		app.sendMail(r.Context(), msg)
 
 		app.Session.Put(r.Context(), "error", "Invalid credentials")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -69,9 +73,21 @@ func (app *Config) PostLogin(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	// members from before we kept their locale get the one their browser
+	// asks for, so they are billed in the currency they are shown
+	if user.Locale == "" {
+		user.Locale = localeFromRequest(r).Tag
+		if err := app.Models.User.SetLocale(user.ID, user.Locale); err != nil {
+			app.logger(r.Context()).Error("could not save locale", "user_id", user.ID, "error", err)
+			user.Locale = ""
+		}
+	}
+
 	app.Session.Put(r.Context(), "userID", user.ID)
 	// user must be registered so the gob works. See main().
 	app.Session.Put(r.Context(), "user", *user)
+	// the session ends if the password is reset; see Auth
+	app.Session.Put(r.Context(), "passwordStamp", passwordStamp(*user))
 	app.Session.Put(r.Context(), "flash", "Welcome User!")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -84,13 +100,17 @@ func (app *Config) Logout(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *Config) Register(w http.ResponseWriter, r *http.Request) {
-	app.render(w, r, "register.page.gohtml", nil)
+	app.render(w, r, "register.page.gohtml", &TemplateData{
+		Data: map[string]any{
+			"Regions": app.Tax.Regions(),
+		},
+	})
 }
 
 func (app *Config) PostRegister(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		app.ErrorLog.Println("problem parsing form:", err)
+		app.logger(r.Context()).Error("problem parsing form", "error", err)
 	}
 
 	email := r.Form.Get("email")
@@ -98,6 +118,7 @@ func (app *Config) PostRegister(w http.ResponseWriter, r *http.Request) {
 	verify_pw := r.Form.Get("verify-password")
 	first := r.Form.Get("first-name")
 	last := r.Form.Get("last-name")
+	region := r.Form.Get("region")
 
 	_, err = app.Models.User.GetByEmail(email)
 	if err != nil {
@@ -110,36 +131,57 @@ func (app *Config) PostRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// tax depends on it, so only take regions we have rates for
+	if region != "" && !app.Tax.HasRegion(region) {
+		app.errorFlash(w, r, "Please choose a country or region from the list", "/register")
+		return
+	}
+
 	user := data.User{
 		Email:     email,
 		Password:  password,
 		FirstName: first,
 		LastName:  last,
+		Region:    region,
+		Locale:    localeFromRequest(r).Tag,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
 
-	uid, err := app.Models.User.Insert(user)
+	// the user, their activation link and the mail with it in are saved
+	// together, so nobody is left registered without a way to activate.
+	var uid int
+	var msg Message
+	err = app.Models.Tx.InTx(func(tx *sql.Tx) error {
+		var err error
+		uid, err = app.Models.User.InsertTx(tx, user)
+		if err != nil {
+			return fmt.Errorf("creating user: %w", err)
+		}
+
+		token, err := app.Tokens.IssueTx(tx, purposeActivate, uid)
+		if err != nil {
+			return fmt.Errorf("making activation link: %w", err)
+		}
+		signedURL := fmt.Sprintf("%s/activate?token=%s", app.Settings.BaseURL, url.QueryEscape(token))
+
+		msg = Message{
+			To:       email,
+			Subject:  "Please verify your email",
+			Template: "confirmation-email",
+			Data:     signedURL,
+		}
+		return app.persistMail(r.Context(), tx, &msg)
+	})
 	if err != nil {
-		app.ErrorLog.Println("problem creating user:", err)
+		app.logger(r.Context()).Error("problem registering user", "error", err)
 		app.errorFlash(w, r, "Sorry! Problem processing your registration", "/register")
 		return
 	}
 
-	app.InfoLog.Printf("Mail would be sent for user %d", uid)
-
-	url := fmt.Sprintf("http://localhost:8080/activate?email=%s", email)
-	NewURLSigner()
-	signedURL := GenerateTokenFromString(url)
-
-	msg := Message{
-		To:       email,
-		Subject:  "Please verify your email",
-		Template: "confirmation-email",
-		Data:     signedURL,
-	}
+	app.logger(r.Context()).Info("user registered", "new_user_id", uid)
 
-	app.sendMail(msg)
+	app.Mailer.queue(r.Context(), msg)
 	app.Session.Put(r.Context(), "flash", "You would get a reg mail")
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -147,26 +189,34 @@ func (app *Config) PostRegister(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *Config) ActivateUser(w http.ResponseWriter, r *http.Request) {
-	url := r.RequestURI
-	rebuiltURL := fmt.Sprintf("http://localhost:8080%s", url)
-	NewURLSigner()
-	okay := VerifyToken(rebuiltURL)
-
-	if !okay {
-		app.errorFlash(w, r, "Your confirmation link has expired or is invalid", "/")
-		return
+	var userID int
+	var err error
+	if q := r.URL.Query(); q.Get("token") == "" && q.Get("hash") != "" {
+		userID, err = app.legacyActivation(r)
+	} else {
+		userID, err = app.Tokens.Redeem(q.Get("token"), purposeActivate)
 	}
-
-	if Expired(rebuiltURL, 60) {
+	switch {
+	case errors.Is(err, errTokenUsed):
+		app.Session.Put(r.Context(), "flash", "You are already registered!")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	case errors.Is(err, errTokenExpired):
 		app.errorFlash(w, r, "Your confirmation link has expired!", "/")
 		return
+	case errors.Is(err, errTokenInvalid):
+		app.errorFlash(w, r, "Your confirmation link has expired or is invalid", "/")
+		return
+	case err != nil:
+		app.logger(r.Context()).Error("problem checking confirmation link", "error", err)
+		app.errorFlash(w, r, "Sorry! Problem handling your registration!", "/")
+		return
 	}
 
 	// Mark the user as activated and valid.
-	email := r.URL.Query().Get("email")
-	user, err := app.Models.User.GetByEmail(email)
+	user, err := app.Models.User.GetOne(userID)
 	if err != nil {
-		app.ErrorLog.Println("problem processing user", err)
+		app.logger(r.Context()).Error("problem processing user", "activated_user_id", userID, "error", err)
 		app.errorFlash(w, r, "Sorry! Problem handling your registration!", "/")
 		return
 	}
@@ -182,7 +232,7 @@ func (app *Config) ActivateUser(w http.ResponseWriter, r *http.Request) {
 
 	err = app.Models.User.Update(*user)
 	if err != nil {
-		app.ErrorLog.Println("problem updating user", err)
+		app.logger(r.Context()).Error("problem updating user", "activated_user_id", userID, "error", err)
 		app.errorFlash(w, r, "Sorry! Problem handling your registration!", "/")
 		return
 	}
@@ -191,6 +241,170 @@ func (app *Config) ActivateUser(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// legacyActivation checks an activation link mailed before link tokens,
+// /activate?email=...&hash=..., signed whole with the legacy origin, and
+// returns the user it is for. It works for as long as an activation token does; it can't be used
+// up, but activating twice does nothing.
+func (app *Config) legacyActivation(r *http.Request) (int, error) {
+	err := app.Tokens.VerifyLegacy(app.Settings.Links.LegacyOrigin+r.RequestURI, tokenLifetimes[purposeActivate])
+	if err != nil {
+		return 0, err
+	}
+
+	user, err := app.Models.User.GetByEmail(r.URL.Query().Get("email"))
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errTokenInvalid
+	}
+	if err != nil {
+		return 0, err
+	}
+	return user.ID, nil
+}
+
+func (app *Config) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "forgot-password.page.gohtml", nil)
+}
+
+// PostForgotPassword mails a password reset link to the address, if it
+// has an account. The answer is the same either way, so it can't be used
+// to find out who has one.
+func (app *Config) PostForgotPassword(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logger(r.Context()).Error("problem parsing form", "error", err)
+	}
+
+	email := r.Form.Get("email")
+
+	user, err := app.Models.User.GetByEmail(email)
+	switch {
+	case err == nil:
+		app.sendResetLink(r.Context(), *user)
+	case !errors.Is(err, sql.ErrNoRows):
+		app.logger(r.Context()).Error("problem finding user for password reset", "error", err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "If there is an account for that email, we've sent it a link to reset the password.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// sendResetLink mails the user a link to reset their password.
+func (app *Config) sendResetLink(ctx context.Context, user data.User) {
+	token, err := app.Tokens.Issue(purposeReset, user.ID)
+	if err != nil {
+		app.logger(ctx).Error("problem making password reset link", "error", err)
+		return
+	}
+
+	msg := Message{
+		To:       user.Email,
+		Subject:  "Reset Your Password",
+		Template: "password-reset",
+		Data:     fmt.Sprintf("%s/reset-password?token=%s", app.Settings.BaseURL, url.QueryEscape(token)),
+		DataMap: map[string]any{
+			"minutes": int(tokenLifetimes[purposeReset].Minutes()),
+		},
+		UserID: user.ID,
+	}
+	app.sendMail(ctx, msg)
+}
+
+// resetLinkError tells the user what is wrong with their reset link, and
+// reports whether anything is.
+func (app *Config) resetLinkError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, errTokenUsed):
+		app.errorFlash(w, r, "Your reset link has already been used. Please ask for a new one.", "/forgot-password")
+	case errors.Is(err, errTokenExpired):
+		app.errorFlash(w, r, "Your reset link has expired. Please ask for a new one.", "/forgot-password")
+	case errors.Is(err, errTokenInvalid):
+		app.errorFlash(w, r, "Your reset link is invalid. Please ask for a new one.", "/forgot-password")
+	default:
+		app.logger(r.Context()).Error("problem resetting password", "error", err)
+		app.errorFlash(w, r, "Sorry! Problem changing your password", "/forgot-password")
+	}
+	return true
+}
+
+func (app *Config) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	_, err := app.Tokens.Verify(r.URL.Query().Get("token"), purposeReset)
+	if app.resetLinkError(w, r, err) {
+		return
+	}
+
+	app.render(w, r, "reset-password.page.gohtml", &TemplateData{
+		StringMap: map[string]string{
+			"action": r.RequestURI,
+		},
+	})
+}
+
+// PostResetPassword sets the new password from a reset link. That uses
+// up the link, and any others the user asked for, and ends their
+// sessions; we let them know by mail, in case it wasn't them.
+func (app *Config) PostResetPassword(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	_, err := app.Tokens.Verify(token, purposeReset)
+	if app.resetLinkError(w, r, err) {
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		app.logger(r.Context()).Error("problem parsing form", "error", err)
+	}
+
+	password := r.Form.Get("password")
+	verify_pw := r.Form.Get("verify-password")
+
+	if password != verify_pw || password == "" {
+		app.errorFlash(w, r, "Passwords required and must match", r.RequestURI)
+		return
+	}
+
+	// only one request gets to use the link, and it is only used up if the
+	// password is changed
+	var user *data.User
+	err = app.Models.Tx.InTx(func(tx *sql.Tx) error {
+		userID, err := app.Tokens.RedeemTx(tx, token, purposeReset)
+		if err != nil {
+			return err
+		}
+
+		user, err = app.Models.User.GetOne(userID)
+		if err != nil {
+			return fmt.Errorf("loading user %d: %w", userID, err)
+		}
+		return app.Models.User.ResetPasswordTx(tx, *user, password)
+	})
+	if app.resetLinkError(w, r, err) {
+		return
+	}
+
+	app.logger(r.Context()).Info("password reset", "reset_user_id", user.ID)
+
+	if err := app.Tokens.Revoke(user.ID, purposeReset); err != nil {
+		app.logger(r.Context()).Error("problem revoking password reset links", "reset_user_id", user.ID, "error", err)
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Your Password Was Changed",
+		Data: fmt.Sprintf("The password for your account was changed on %s. If it wasn't you, please reset it now at %s/forgot-password.",
+			time.Now().Format("Jan 2, 2006 at 15:04 MST"), app.Settings.BaseURL),
+		UserID: user.ID,
+	}
+	app.sendMail(r.Context(), msg)
+
+	_ = app.Session.Destroy(r.Context())
+	_ = app.Session.RenewToken(r.Context())
+	app.Session.Put(r.Context(), "flash", "Your password has been changed. Please log in.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
 func (app *Config) ChoosePlans(w http.ResponseWriter, r *http.Request) {
 
 	plans, err := app.Models.Plan.GetAll()
@@ -199,8 +413,44 @@ func (app *Config) ChoosePlans(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// show prices in the user's own currency, where we sell in it
+	locale := app.locale(r)
+	for _, plan := range plans {
+		plan.PlanAmountFormatted = plan.PriceForDisplay(locale.Currency, locale.Tag)
+	}
+
+	// preview what switching to each other plan would cost, for a member
+	// part way through a paid period. Trials are for those who have never
+	// subscribed.
+	prorations := make(map[int]*Proration)
+	sub, err := app.Models.Plan.GetSubscription(app.Session.GetInt(r.Context(), "userID"))
+	trial := errors.Is(err, sql.ErrNoRows)
+	if err == nil && sub.Live() && sub.Status != data.SubscriptionTrialing {
+		now := time.Now()
+		paid, err := app.paidInvoice(sub.UserID, sub.PlanID, sub.CurrentPeriodEnd)
+		if err != nil {
+			// the preview falls back on the plan's price
+			app.logger(r.Context()).Error("could not load paid invoice", "error", err)
+		}
+		for _, plan := range plans {
+			if plan.ID != sub.PlanID {
+				p := prorate(*sub.Plan, *plan, paid, locale, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, now)
+				prorations[plan.ID] = &p
+			}
+		}
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.logger(r.Context()).Error("could not load subscription", "error", err)
+	}
+
 	data := map[string]any{
-		"Plans": plans,
+		"Plans":      plans,
+		"Prorations": prorations,
+		"Trial":      trial,
+	}
+
+	// the fake gateway's cards stand in for a real payment form
+	if fake, ok := app.Payments.(*FakeGateway); ok {
+		data["TestCards"] = fake.FakeCards()
 	}
 
 	app.render(w, r, "plans.page.gohtml", &TemplateData{
@@ -210,101 +460,536 @@ func (app *Config) ChoosePlans(w http.ResponseWriter, r *http.Request) {
 
 func (app *Config) SubscribePlan(w http.ResponseWriter, r *http.Request) {
 
-	planParam := r.URL.Query().Get("plan")
+	planParam := r.PostFormValue("plan")
 	planID, err := strconv.Atoi(planParam)
 	if err != nil {
-		app.ErrorLog.Println("subscribe passed wrong parameter")
+		app.logger(r.Context()).Warn("subscribe passed wrong parameter", "plan", planParam)
 		app.errorFlash(w, r, "Cannot subscribe to that plan.", "/members/plans")
 		return
 	}
 
 	plan, err := app.Models.Plan.GetOne(planID)
 	if err != nil {
-		app.ErrorLog.Printf("subscribe passed unavailable plan %d with error %v", planID, err)
+		app.logger(r.Context()).Warn("subscribe passed unavailable plan", "plan_id", planID, "error", err)
 		app.errorFlash(w, r, "Cannot subscribe to that plan.", "/members/plans")
 		return
 	}
 
 	user, ok := app.Session.Get(r.Context(), "user").(data.User)
 	if !ok {
-		app.ErrorLog.Println("user not in session?")
+		app.logger(r.Context()).Error("user not in session")
 		app.errorFlash(w, r, "Please log in.", "/login")
 		return
 	}
 
-	err = app.Models.Plan.SubscribeUserToPlan(user, *plan)
-	if err != nil {
-		app.ErrorLog.Printf("could not subscribe: %v", err)
+	// what the user is on now decides whether this is a new subscription,
+	// a switch to be prorated, or nothing to bill for. Someone who has
+	// never subscribed gets the plan's free trial, if it has one.
+	sub, err := app.Models.Plan.GetSubscription(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.logger(r.Context()).Error("could not load subscription", "error", err)
 		app.errorFlash(w, r, "Cannot subscribe to that plan.", "/members/plans")
 		return
 	}
+	trial := err != nil && plan.TrialDays > 0
+	if err != nil || !sub.Live() {
+		sub = nil
+	}
 
-	// Generate an invoice
-	app.Wait.Add(1)
-	go func() {
-		defer app.Wait.Done()
+	// what is owed on the plan they have comes first
+	if sub != nil && sub.Status == data.SubscriptionPastDue {
+		app.errorFlash(w, r, "Please pay for your current plan before changing it.", "/members/subscription")
+		return
+	}
 
-		invoice, err := app.GenerateInvoice(user, *plan)
+	var coupon *data.Coupon
+	if code := strings.TrimSpace(r.PostFormValue("coupon")); code != "" {
+		coupon, err = app.couponFor(code, user, *plan, sub, trial)
+		var reason couponError
+		if errors.As(err, &reason) {
+			app.errorFlash(w, r, reason.Error(), "/members/plans")
+			return
+		}
 		if err != nil {
-			app.ErrorChan <- err
+			app.logger(r.Context()).Error("could not check coupon", "coupon", code, "error", err)
+			app.errorFlash(w, r, "Cannot subscribe to that plan.", "/members/plans")
+			return
 		}
+	}
 
-		// send an email
-		msg := Message{
-			To:       user.Email,
-			Subject:  fmt.Sprintf("You've Subscribed to Our %s", plan.PlanName),
-			Data:     invoice,
-			Template: "invoice",
+	job := SubscriptionJob{
+		UserID:       user.ID,
+		PlanID:       plan.ID,
+		SubscribedAt: time.Now().UTC().Truncate(time.Second),
+		RequestID:    tagFromContext(r.Context()).RequestID,
+	}
+	if coupon != nil {
+		job.CouponID = coupon.ID
+	}
+	method := r.PostFormValue("payment_method")
+
+	// there is nothing to pay for a trial, for staying put or taking back
+	// a cancellation, or for switching plans during a trial
+	if trial || (sub != nil && (sub.PlanID == plan.ID || sub.Status == data.SubscriptionTrialing)) {
+		fromPlanID := 0
+		if sub != nil {
+			fromPlanID = sub.PlanID
+		}
+		app.subscribeWithoutPaying(w, r, user, *plan, fromPlanID, job, method, trial)
+		return
+	}
+
+	if sub != nil {
+		job.FromPlanID = sub.PlanID
+		job.PeriodStart = sub.CurrentPeriodStart
+		job.PeriodEnd = sub.CurrentPeriodEnd
+	}
+
+	// the coupon is redeemed with the invoice, and someone may have taken
+	// it since it was checked
+	invoice, err := app.subscriptionInvoice(user, *plan, job)
+	if errors.Is(err, data.ErrCouponUsed) {
+		app.errorFlash(w, r, errCouponUsed.Error(), "/members/plans")
+		return
+	}
+	if errors.Is(err, data.ErrCouponUnavailable) {
+		app.errorFlash(w, r, errCouponUsedUp.Error(), "/members/plans")
+		return
+	}
+	if err != nil {
+		app.logger(r.Context()).Error("could not issue invoice", "plan_id", planID, "error", err)
+		app.errorFlash(w, r, "Cannot subscribe to that plan.", "/members/plans")
+		return
+	}
+
+	// a switch to a cheaper plan, or a coupon for all of it, leaves
+	// nothing to charge
+	var payment *data.Payment
+	if invoice.Total > 0 {
+		var charge *Charge
+		payment, charge, err = app.payInvoice(r.Context(), invoice, method, job)
+		if errors.Is(err, errPaymentOpen) {
+			// the same subscribe, sent twice; the first one is paying
+			app.Session.Put(r.Context(), "flash", "Your payment is already being processed.")
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
 		}
-		// kick the invoice off to its own routine.
-		app.sendMail(msg)
-	}()
-
-	// generate a customized manual PDF
-	app.Wait.Add(1)
-	go func() {
-		defer app.Wait.Done()
-
-		pdf := app.GenerateManual(user, plan)
-		tmpFile := fmt.Sprintf("%s/%d_user-manual.pdf", tempDirectory, user.ID)
-		err := pdf.OutputFileAndClose(tmpFile)
 		if err != nil {
-			app.ErrorChan <- err
+			app.logger(r.Context()).Error("could not take payment", "invoice_id", invoice.ID, "error", err)
+			app.voidInvoice(r.Context(), invoice.ID, nil, err.Error())
+			msg := "We couldn't take your payment. Please try again."
+			if errors.Is(err, errNoPaymentMethod) {
+				msg = "Please choose how you would like to pay."
+			}
+			app.errorFlash(w, r, msg, "/members/plans")
 			return
 		}
 
-		msg := Message{
-			To:      user.Email,
-			Subject: fmt.Sprintf("Your %s User Manual", plan.PlanName),
-			Data:    "Your personalized manual is attached:",
-			AttachmentMap: map[string]string{
-				"Manual.pdf": tmpFile,
-			},
+		switch charge.Status {
+		case chargeFailed:
+			app.logger(r.Context()).Info("payment declined", "invoice_id", invoice.ID, "code", charge.FailureCode)
+			app.voidInvoice(r.Context(), invoice.ID, nil, charge.FailureMessage)
+			app.errorFlash(w, r, charge.FailureMessage, "/members/plans")
+			return
+		case chargePending:
+			// the webhook finishes the subscription once the charge goes through
+			msg := fmt.Sprintf("Your payment is being processed. Your subscription to %s starts as soon as it goes through.", plan.PlanName)
+			app.Session.Put(r.Context(), "flash", msg)
+			http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+			return
 		}
+	}
 
-		app.sendMail(msg)
-
-		// temp: an error test
-		app.ErrorChan <- errors.New("a custom error test")
-	}()
+	err = app.activate(r.Context(), job, invoice.ID, payment)
+	if errors.Is(err, data.ErrSubscriptionChanged) {
+		app.errorFlash(w, r, "Your plan has just been changed. Please check it before changing it again. You have not been charged.", "/members/plans")
+		return
+	}
+	if err != nil {
+		app.logger(r.Context()).Error("could not subscribe", "plan_id", planID, "error", err)
+		app.errorFlash(w, r, "Cannot subscribe to that plan. You have not been charged.", "/members/plans")
+		return
+	}
 
 	// update the user in session, since it has updated.
-	userPtr, err := app.Models.User.GetOne(user.ID)
+	app.refreshSessionUser(r)
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("You are subscribed to %s", plan.PlanName))
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
+
+// subscribeWithoutPaying subscribes the user to a plan when there is
+// nothing to pay yet. A payment method they give is kept for when there
+// is.
+func (app *Config) subscribeWithoutPaying(w http.ResponseWriter, r *http.Request, user data.User, plan data.Plan, fromPlanID int, job SubscriptionJob, method string, trial bool) {
+	if method != "" {
+		if _, err := app.paymentCustomer(user.ID, method); err != nil {
+			app.logger(r.Context()).Error("could not save payment method", "error", err)
+			app.errorFlash(w, r, "We couldn't save that payment method. Please try again.", "/members/plans")
+			return
+		}
+	}
+
+	err := app.Models.Plan.SubscribeUserToPlan(user, plan, fromPlanID, job.SubscribedAt)
+	if errors.Is(err, data.ErrSubscriptionChanged) {
+		app.errorFlash(w, r, "Your plan has just been changed. Please check it before changing it again.", "/members/plans")
+		return
+	}
 	if err != nil {
-		// this is a convenience, so if there's an error,
-		// log it and ignore.
-		app.ErrorLog.Printf("error retrieving updated user: %v", err)
-	} else {
-		app.Session.Put(r.Context(), "user", *userPtr)
+		app.logger(r.Context()).Error("could not subscribe", "plan_id", plan.ID, "error", err)
+		app.errorFlash(w, r, "Cannot subscribe to that plan.", "/members/plans")
+		return
 	}
 
-	app.Session.Put(r.Context(), "flash", fmt.Sprintf("You are subscribed to %s", plan.PlanName))
+	flash := fmt.Sprintf("You are subscribed to %s", plan.PlanName)
+	if trial {
+		// nothing to invoice until the trial is over
+		app.enqueueSubscriptionJobs(r.Context(), job, jobManual)
+		flash = fmt.Sprintf("Your %d-day free trial of %s has started", plan.TrialDays, plan.PlanName)
+	}
+
+	app.refreshSessionUser(r)
+
+	app.Session.Put(r.Context(), "flash", flash)
 	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
 }
 
-func (app *Config) GenerateInvoice(user data.User, plan data.Plan) (string, error) {
-	// We punt!
-	return plan.PlanAmountFormatted, nil
+// PaymentWebhook takes events from the payment gateway. A pending charge
+// that goes through finishes the subscription or renewal it was for; one
+// that fails voids its invoice, or for a renewal, starts dunning. Only the
+// event that moves the payment on from pending does this, so a repeat of
+// it does nothing.
+func (app *Config) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	event, err := app.Payments.HandleWebhook(r)
+	if err != nil {
+		app.logger(r.Context()).Warn("rejected payment webhook", "error", err)
+		http.Error(w, "bad webhook", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := app.Models.Payment.GetByChargeID(event.Charge.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// not ours, or its charge isn't recorded yet; the gateway tries again
+		http.Error(w, "unknown charge", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.logger(r.Context()).Error("could not load payment", "charge_id", event.Charge.ID, "error", err)
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+
+	log := app.logger(r.Context()).With("charge_id", payment.ChargeID, "event", event.Type)
+
+	switch event.Type {
+	case eventChargeSucceeded:
+		moved, err := app.Models.Payment.SetStatus(payment.ID, data.PaymentPending, data.PaymentSucceeded, "")
+		if err != nil {
+			log.Error("could not update payment", "error", err)
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		if !moved {
+			break
+		}
+		payment.Status = data.PaymentSucceeded
+
+		var job SubscriptionJob
+		err = json.Unmarshal(payment.Checkout, &job)
+		if err == nil && job.Renewal {
+			err = app.renewalPaid(r.Context(), job, payment.InvoiceID)
+		} else if err == nil {
+			err = app.activate(r.Context(), job, payment.InvoiceID, payment)
+		}
+		if err != nil {
+			log.Error("could not finish subscription", "error", err)
+		}
+
+	case eventChargeFailed:
+		moved, err := app.Models.Payment.SetStatus(payment.ID, data.PaymentPending, data.PaymentFailed,
+			event.Charge.FailureMessage)
+		if err != nil {
+			log.Error("could not update payment", "error", err)
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		if !moved {
+			break
+		}
+		log.Info("payment declined", "code", event.Charge.FailureCode)
+
+		// a declined renewal leaves the subscription, which the user kept
+		// while it was pending, past due
+		var job SubscriptionJob
+		if err := json.Unmarshal(payment.Checkout, &job); err != nil || !job.Renewal {
+			app.voidInvoice(r.Context(), payment.InvoiceID, nil, event.Charge.FailureMessage)
+			break
+		}
+		if err := app.startDunning(r.Context(), job, payment.InvoiceID, event.Charge.FailureMessage); err != nil {
+			log.Error("could not start dunning", "error", err)
+		}
+
+	case eventChargeRefunded:
+		_, err := app.Models.Payment.SetStatus(payment.ID, data.PaymentSucceeded, data.PaymentRefunded, "")
+		if err != nil {
+			log.Error("could not update payment", "error", err)
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// MySubscription shows the user's subscription, and what has happened to
+// it.
+func (app *Config) MySubscription(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	sub, err := app.Models.Plan.GetSubscription(userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.logger(r.Context()).Error("could not load subscription", "error", err)
+		app.errorFlash(w, r, "Sorry! Could not display this page", "/")
+		return
+	}
+
+	history, err := app.Models.Plan.SubscriptionHistory(userID)
+	if err != nil {
+		app.logger(r.Context()).Error("could not load subscription history", "error", err)
+		app.errorFlash(w, r, "Sorry! Could not display this page", "/")
+		return
+	}
+
+	plans, err := app.Models.Plan.GetAll()
+	if err != nil {
+		app.logger(r.Context()).Error("could not load plans", "error", err)
+		app.errorFlash(w, r, "Sorry! Could not display this page", "/")
+		return
+	}
+
+	// the history only has plan IDs
+	planNames := make(map[int]string, len(plans))
+	for _, plan := range plans {
+		planNames[plan.ID] = plan.PlanName
+	}
+
+	data := map[string]any{
+		"Subscription": sub,
+		"History":      history,
+		"PlanNames":    planNames,
+	}
+
+	// the fake gateway's cards stand in for a real payment form
+	if fake, ok := app.Payments.(*FakeGateway); ok {
+		data["TestCards"] = fake.FakeCards()
+	}
+
+	app.render(w, r, "subscription.page.gohtml", &TemplateData{
+		Data: data,
+	})
+}
+
+// CancelSubscription cancels the user's subscription: at the end of the
+// period they have paid for, unless the form says now.
+func (app *Config) CancelSubscription(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+	now := r.PostFormValue("when") == "now"
+
+	err := app.Models.Plan.CancelSubscription(userID, !now)
+	if err != nil {
+		app.logger(r.Context()).Error("could not cancel subscription", "error", err)
+		app.errorFlash(w, r, "Sorry! Could not cancel your subscription", "/members/subscription")
+		return
+	}
+
+	app.refreshSessionUser(r)
+
+	msg := "Your subscription will end at the end of this period"
+	if now {
+		msg = "Your subscription is canceled"
+	}
+	app.Session.Put(r.Context(), "flash", msg)
+	http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+}
+
+// ResumeSubscription takes back a cancellation due at the end of the
+// period.
+func (app *Config) ResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	err := app.Models.Plan.ResumeSubscription(userID)
+	if err != nil {
+		app.logger(r.Context()).Error("could not resume subscription", "error", err)
+		app.errorFlash(w, r, "Sorry! Could not resume your subscription", "/members/subscription")
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your subscription will renew as usual")
+	http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+}
+
+// PaySubscription pays the renewal of a past due subscription, with the
+// payment method on the form if there is one, and makes it active again.
+func (app *Config) PaySubscription(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	sub, err := app.Models.Plan.GetSubscription(userID)
+	if err != nil || sub.Status != data.SubscriptionPastDue {
+		app.errorFlash(w, r, "There is nothing to pay.", "/members/subscription")
+		return
+	}
+
+	// the renewal that wasn't paid is for the current period
+	invoice, err := app.Models.Invoice.GetForPeriod(userID, sub.PlanID, sub.CurrentPeriodStart)
+	if err != nil {
+		app.logger(r.Context()).Error("could not load unpaid invoice", "error", err)
+		app.errorFlash(w, r, "Sorry! Could not take your payment", "/members/subscription")
+		return
+	}
+
+	job := SubscriptionJob{
+		UserID:       userID,
+		PlanID:       sub.PlanID,
+		SubscribedAt: sub.CurrentPeriodStart,
+		RequestID:    tagFromContext(r.Context()).RequestID,
+		Renewal:      true,
+	}
+
+	// pressing the button again while the charge is pending charges nothing
+	_, charge, err := app.payInvoice(r.Context(), invoice, r.PostFormValue("payment_method"), job)
+	switch {
+	case errors.Is(err, errPaymentOpen):
+		app.Session.Put(r.Context(), "flash", "Your payment is already being processed.")
+		http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+		return
+	case errors.Is(err, errNoPaymentMethod):
+		app.errorFlash(w, r, "Please choose how you would like to pay.", "/members/subscription")
+		return
+	case err != nil:
+		app.logger(r.Context()).Error("could not charge for renewal", "invoice_id", invoice.ID, "error", err)
+		app.errorFlash(w, r, "We couldn't take your payment. Please try again.", "/members/subscription")
+		return
+	case charge.Status == chargeFailed:
+		app.errorFlash(w, r, charge.FailureMessage, "/members/subscription")
+		return
+	case charge.Status == chargePending:
+		app.Session.Put(r.Context(), "flash", "Your payment is being processed.")
+		http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.renewalPaid(r.Context(), job, invoice.ID); err != nil {
+		app.logger(r.Context()).Error("could not finish renewal", "invoice_id", invoice.ID, "error", err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Thank you! Your payment went through.")
+	http.Redirect(w, r, "/members/subscription", http.StatusSeeOther)
+}
+
+func (app *Config) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters, err := app.Models.DeadLetter.GetAll()
+	if err != nil {
+		app.logger(r.Context()).Error("could not load dead letters", "error", err)
+		app.errorFlash(w, r, "Sorry! Could not display this page", "/")
+		return
+	}
+
+	app.render(w, r, "dead-letters.page.gohtml", &TemplateData{
+		Data: map[string]any{
+			"DeadLetters": letters,
+		},
+	})
+}
+
+// TaxReport totals the tax charged, by region and rate, on invoices issued
+// from the from date through the to date; the current quarter to date if
+// they are not given. With format=csv it is downloaded for the accountants.
+func (app *Config) TaxReport(w http.ResponseWriter, r *http.Request) {
+	from, to, err := taxReportPeriod(r.URL.Query().Get("from"), r.URL.Query().Get("to"), time.Now())
+	if err != nil {
+		app.errorFlash(w, r, "Dates must look like 2022-03-31", "/admin/tax")
+		return
+	}
+
+	// to is the last day of the report, so take everything before the next
+	summary, err := app.Models.Invoice.TaxSummary(from, to.AddDate(0, 0, 1))
+	if err != nil {
+		app.logger(r.Context()).Error("could not total tax", "error", err)
+		app.errorFlash(w, r, "Sorry! Could not display this page", "/")
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="tax-%s-%s.csv"`, from.Format("2006-01-02"), to.Format("2006-01-02")))
+		if err := writeTaxReportCSV(w, summary); err != nil {
+			app.logger(r.Context()).Error("could not write tax report", "error", err)
+		}
+		return
+	}
+
+	// amounts in different currencies don't add up, so total each
+	var totals []*data.TaxSummary
+	for _, row := range summary {
+		if len(totals) == 0 || totals[len(totals)-1].Currency != row.Currency {
+			totals = append(totals, &data.TaxSummary{Currency: row.Currency})
+		}
+		totals[len(totals)-1].Taxable += row.Taxable
+		totals[len(totals)-1].Amount += row.Amount
+	}
+
+	app.render(w, r, "tax-report.page.gohtml", &TemplateData{
+		Data: map[string]any{
+			"From":    from,
+			"To":      to,
+			"Summary": summary,
+			"Totals":  totals,
+		},
+	})
+}
+
+// ReplayDeadLetter puts a failed message back on the mail queue. It goes
+// back to the outbox in the same statement that removes the dead letter,
+// so it is never lost, and can't be replayed twice.
+func (app *Config) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PostFormValue("id"))
+	if err != nil {
+		app.errorFlash(w, r, "Cannot replay that message.", "/admin/mail/dead-letters")
+		return
+	}
+
+	letter, err := app.Models.DeadLetter.GetOne(id)
+	if err != nil {
+		app.logger(r.Context()).Error("could not load dead letter", "dead_letter_id", id, "error", err)
+		app.errorFlash(w, r, "Cannot replay that message.", "/admin/mail/dead-letters")
+		return
+	}
+
+	var msg Message
+	err = json.Unmarshal(letter.Payload, &msg)
+	if err != nil {
+		app.logger(r.Context()).Error("could not decode dead letter", "dead_letter_id", id, "error", err)
+		app.errorFlash(w, r, "Cannot replay that message.", "/admin/mail/dead-letters")
+		return
+	}
+
+	// if it fails again it gets a fresh dead letter.
+	msg.OutboxID, err = app.Models.DeadLetter.Requeue(id, app.Mailer.OutboxLease)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorFlash(w, r, "That message has already been replayed.", "/admin/mail/dead-letters")
+		return
+	}
+	if err != nil {
+		app.logger(r.Context()).Error("could not requeue dead letter", "dead_letter_id", id, "error", err)
+		app.errorFlash(w, r, "Cannot replay that message.", "/admin/mail/dead-letters")
+		return
+	}
+
+	app.Mailer.queue(r.Context(), msg)
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Message to %s queued again", msg.To))
+	http.Redirect(w, r, "/admin/mail/dead-letters", http.StatusSeeOther)
 }
 
 func (app *Config) GenerateManual(user data.User, plan *data.Plan) *gofpdf.Fpdf {
@@ -316,7 +1001,14 @@ func (app *Config) GenerateManual(user data.User, plan *data.Plan) *gofpdf.Fpdf
 	// simulate a complex PDF...
 	time.Sleep(5 * time.Second)
 
-	t := importer.ImportPage(pdf, fmt.Sprintf("%s/manual.pdf", pdfDirectory), 1, "/MediaBox")
+	manual, err := fs.ReadFile(pdfFS, "manual.pdf")
+	if err != nil {
+		pdf.SetError(err)
+		return pdf
+	}
+
+	var rs io.ReadSeeker = bytes.NewReader(manual)
+	t := importer.ImportPageFromStream(pdf, &rs, 1, "/MediaBox")
 	pdf.AddPage()
 
 	// center where we are writing
@@ -9,6 +9,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	goalone "github.com/bwmarrin/go-alone"
 )
 
 // Get pages
@@ -42,6 +44,37 @@ var pages = []struct {
 		ExpectedCode: http.StatusOK,
 		ExpectedHTML: `>Register</h1>`,
 	},
+	{
+		Page:         "forgot-password",
+		URL:          "/forgot-password",
+		Handler:      testApp.ForgotPasswordPage,
+		ExpectedCode: http.StatusOK,
+		ExpectedHTML: `>Forgot Password</h1>`,
+	},
+	{
+		Page:         "dead-letters",
+		URL:          "/admin/mail/dead-letters",
+		Handler:      testApp.DeadLetters,
+		ExpectedCode: http.StatusOK,
+		ExpectedHTML: `connection refused`,
+	},
+	{
+		Page:         "subscription",
+		URL:          "/members/subscription",
+		Handler:      testApp.MySubscription,
+		ExpectedCode: http.StatusOK,
+		SessionBefore: map[string]any{
+			"userID": 1,
+		},
+		ExpectedHTML: `Changed plan`,
+	},
+	{
+		Page:         "tax-report",
+		URL:          "/admin/tax?from=2022-04-01&to=2022-06-30",
+		Handler:      testApp.TaxReport,
+		ExpectedCode: http.StatusOK,
+		ExpectedHTML: `<th class="text-end">£9.00</th>`,
+	},
 	{
 		Page:         "logout",
 		URL:          "/logout",
@@ -59,8 +92,6 @@ var pages = []struct {
 }
 
 func TestHandlers_GetPages(t *testing.T) {
-	pathToTemplates = "./templates"
-
 	for _, page := range pages {
 		// t.Log("Testing page =", page.Page)
 		req, _ := http.NewRequest("GET", page.URL, nil)
@@ -114,6 +145,7 @@ func TestHandlers_PostLogin(t *testing.T) {
 
 	req, _ := http.NewRequest("POST", "/login", strings.NewReader(formPost.Encode()))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept-Language", "de-DE")
 	ctx := createMockContext(req)
 	req = req.WithContext(ctx)
 
@@ -139,16 +171,19 @@ func TestHandlers_PostLogin(t *testing.T) {
 		t.Errorf("%s: session still lacks a user object now", "post-login")
 	}
 
-	_, ok := testApp.Session.Get(ctx, "user").(data.User)
+	user, ok := testApp.Session.Get(ctx, "user").(data.User)
 	if !ok {
 		t.Errorf("%s: user in session is not a user object", "post-login")
 	}
 
+	// the mock user has no locale yet, so is given the browser's
+	if user.Locale != "de-DE" {
+		t.Errorf("%s: expected locale de-DE, got %q", "post-login", user.Locale)
+	}
+
 }
 
 func TestHandlers_ChoosePlans(t *testing.T) {
-	pathToTemplates = "./templates"
-
 	req, _ := http.NewRequest("GET", "/members/plans", nil)
 	ctx := createMockContext(req)
 	req = req.WithContext(ctx)
@@ -176,12 +211,28 @@ func TestHandlers_ChoosePlans(t *testing.T) {
 		t.Errorf("choose-plans: expected to see this page, but got %d", rr.Code)
 	}
 
+	// and see prices in our own currency, the way we write them
+	rr = httptest.NewRecorder()
+	testApp.Session.Put(ctx, "user", data.User{Locale: "de-DE"})
+	wrapped.ServeHTTP(rr, req)
+
+	if !strings.Contains(rr.Body.String(), "14,00\u00a0€") {
+		t.Error("choose-plans: expected the plan priced in euros, for a German user")
+	}
+
+	// and preview what switching from our plan to the other would cost
+	if strings.Count(rr.Body.String(), "proration: {") != 1 {
+		t.Error("choose-plans: expected a proration preview for the one plan we are not on")
+	}
+
 }
 
 func TestHandlers_SubscribePlan(t *testing.T) {
-	mailMessages = []Message{}
+	testTransport.Reset()
+	testGateway.forgetCharges()
 
-	req, _ := http.NewRequest("GET", "/members/subscribe?plan=3", nil)
+	req, _ := http.NewRequest("POST", "/members/subscribe", strings.NewReader("plan=3&payment_method=pm_card_visa"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	ctx := createMockContext(req)
 	req = req.WithContext(ctx)
 
@@ -204,29 +255,217 @@ func TestHandlers_SubscribePlan(t *testing.T) {
 		t.Error("subscribe-plan: expected a flash message on success")
 	}
 
-	// Make sure the WG clears...
-	wgDone := make(chan bool)
+	// the invoice and the manual are sent by jobs; the manual takes a while
+	deadline := time.Now().Add(10 * time.Second)
+	for len(testTransport.Messages()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
 
-	go func() {
-		testApp.Wait.Wait()
-		wgDone <- true
+	messages := testTransport.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("subscribe-plan: expected 2 mail messages, got %d", len(messages))
+	}
+
+	// both the invoice and the manual come as PDFs
+	for _, msg := range messages {
+		if len(msg.Attachments)+len(msg.Files) != 1 {
+			t.Errorf("subscribe-plan: expected a PDF attached to %q, got %v %d", msg.Subject, msg.Attachments, len(msg.Files))
+		}
+	}
+
+}
+
+func TestHandlers_SubscribePlanCoupon(t *testing.T) {
+	tests := []struct {
+		coupon string
+		error  string
+	}{
+		{"BOGUS", "We don't recognize that coupon code."},
+		{"ONCE", "You have already used that coupon."},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/members/subscribe", strings.NewReader("plan=3&coupon="+tt.coupon))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		ctx := createMockContext(req)
+		req = req.WithContext(ctx)
+		testApp.Session.Put(ctx, "userID", 1)
+		testApp.Session.Put(ctx, "user", data.User{ID: 1, FirstName: "Frederick"})
+
+		rr := httptest.NewRecorder()
+		testApp.SubscribePlan(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("subscribe-plan %s: expected redirect, got %d", tt.coupon, rr.Code)
+		}
+		if msg := testApp.Session.GetString(ctx, "error"); msg != tt.error {
+			t.Errorf("subscribe-plan %s: expected error %q, got %q", tt.coupon, tt.error, msg)
+		}
+		if testApp.Session.Exists(ctx, "flash") {
+			t.Errorf("subscribe-plan %s: expected not to subscribe", tt.coupon)
+		}
+	}
+}
+
+// takenCoupons is an invoices table where every coupon has just been taken.
+type takenCoupons struct {
+	data.InvoiceType
+}
+
+func (s takenCoupons) Insert(invoice data.Invoice) (int, error) {
+	if invoice.CouponID != 0 {
+		return 0, data.ErrCouponUnavailable
+	}
+	return s.InvoiceType.Insert(invoice)
+}
+
+func TestHandlers_SubscribePlanCoupon_taken(t *testing.T) {
+	saved := testApp.Models.Invoice
+	testApp.Models.Invoice = takenCoupons{saved}
+	defer func() {
+		testApp.Models.Invoice = saved
 	}()
+	testGateway.forgetCharges()
 
-	select {
-	case <-wgDone:
-	case <-time.After(10 * time.Second):
-		t.Error("subscribe-plan: waitgroup did not release; timing out.")
+	req, _ := http.NewRequest("POST", "/members/subscribe",
+		strings.NewReader("plan=3&coupon=WELCOME10&payment_method=pm_card_visa"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	ctx := createMockContext(req)
+	req = req.WithContext(ctx)
+	testApp.Session.Put(ctx, "userID", 1)
+	testApp.Session.Put(ctx, "user", data.User{ID: 1, FirstName: "Frederick"})
+
+	rr := httptest.NewRecorder()
+	testApp.SubscribePlan(rr, req)
+
+	// taken between the check and the invoice, and nothing charged
+	if msg := testApp.Session.GetString(ctx, "error"); msg != errCouponUsedUp.Error() {
+		t.Errorf("expected error %q, got %q", errCouponUsedUp, msg)
+	}
+	if n := len(testGateway.charges); n != 0 {
+		t.Errorf("expected no charges, got %d", n)
+	}
+}
+
+func TestHandlers_SubscribePlanDeclined(t *testing.T) {
+	tests := []struct {
+		method string
+		error  string
+	}{
+		{"", "Please choose how you would like to pay."},
+		{"pm_card_declined", "Your card was declined."},
+		{"pm_card_insufficient_funds", "Your card has insufficient funds."},
+	}
+
+	for _, tt := range tests {
+		testTransport.Reset()
+		testGateway.forgetCharges()
+		testGateway.setCard("cus_test", "")
+
+		req, _ := http.NewRequest("POST", "/members/subscribe", strings.NewReader("plan=3&payment_method="+tt.method))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		ctx := createMockContext(req)
+		req = req.WithContext(ctx)
+		testApp.Session.Put(ctx, "userID", 1)
+		testApp.Session.Put(ctx, "user", data.User{ID: 1, FirstName: "Frederick"})
+
+		rr := httptest.NewRecorder()
+		testApp.SubscribePlan(rr, req)
+
+		if msg := testApp.Session.GetString(ctx, "error"); msg != tt.error {
+			t.Errorf("subscribe-plan %q: expected error %q, got %q", tt.method, tt.error, msg)
+		}
+		if testApp.Session.Exists(ctx, "flash") {
+			t.Errorf("subscribe-plan %q: expected not to subscribe", tt.method)
+		}
+	}
+
+	// nothing was subscribed to, so nothing is mailed
+	time.Sleep(200 * time.Millisecond)
+	if n := len(testTransport.Messages()); n != 0 {
+		t.Errorf("expected no mail, got %d messages", n)
 	}
-	testApp.InfoLog.Println("wait group released.")
+}
+
+func TestHandlers_SubscribePlanPending(t *testing.T) {
+	testTransport.Reset()
+	testGateway.forgetCharges()
+
+	req, _ := http.NewRequest("POST", "/members/subscribe", strings.NewReader("plan=3&payment_method=pm_card_delayed"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	ctx := createMockContext(req)
+	req = req.WithContext(ctx)
+	testApp.Session.Put(ctx, "userID", 1)
+	testApp.Session.Put(ctx, "user", data.User{ID: 1, FirstName: "Frederick"})
+
+	rr := httptest.NewRecorder()
+	testApp.SubscribePlan(rr, req)
 
-	if len(mailMessages) != 2 {
-		t.Errorf("subscribe-plan: expected 2 mail messages, got %d", len(mailMessages))
+	flash := testApp.Session.GetString(ctx, "flash")
+	if !strings.HasPrefix(flash, "Your payment is being processed.") {
+		t.Fatalf("expected to wait for the payment, got flash %q and error %q",
+			flash, testApp.Session.GetString(ctx, "error"))
 	}
 
+	// nothing happens until the charge goes through
+	time.Sleep(200 * time.Millisecond)
+	if n := len(testTransport.Messages()); n != 0 {
+		t.Fatalf("expected no mail before the charge settles, got %d messages", n)
+	}
+
+	charges := testGateway.pendingCharges()
+	if len(charges) != 1 {
+		t.Fatalf("expected one pending charge, got %v", charges)
+	}
+	if err := testGateway.Settle(charges[0]); err != nil {
+		t.Fatal("settling the charge:", err)
+	}
+
+	// the webhook finishes the subscription, which mails the invoice and
+	// the manual
+	deadline := time.Now().Add(10 * time.Second)
+	for len(testTransport.Messages()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := len(testTransport.Messages()); n != 2 {
+		t.Errorf("expected 2 mail messages once the charge settles, got %d", n)
+	}
+}
+
+func TestHandlers_CancelSubscription(t *testing.T) {
+	tests := []struct {
+		when  string
+		flash string
+	}{
+		{"period_end", "Your subscription will end at the end of this period"},
+		{"now", "Your subscription is canceled"},
+	}
+
+	for _, tt := range tests {
+		formPost := url.Values{}
+		formPost.Add("when", tt.when)
+
+		req, _ := http.NewRequest("POST", "/members/subscription/cancel", strings.NewReader(formPost.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		ctx := createMockContext(req)
+		req = req.WithContext(ctx)
+		testApp.Session.Put(ctx, "userID", 1)
+
+		rr := httptest.NewRecorder()
+		testApp.CancelSubscription(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("cancel-subscription %s: expected redirect, got %d", tt.when, rr.Code)
+		}
+
+		if flash := testApp.Session.GetString(ctx, "flash"); flash != tt.flash {
+			t.Errorf("cancel-subscription %s: expected flash %q, got %q", tt.when, tt.flash, flash)
+		}
+	}
 }
 
 func TestHandlers_PostRegister(t *testing.T) {
-	mailMessages = []Message{}
+	testTransport.Reset()
 
 	formPost := url.Values{}
 	formPost.Add("email", "who@first.com")
@@ -272,20 +511,369 @@ func TestHandlers_PostRegister(t *testing.T) {
 	case <-time.After(10 * time.Second):
 		t.Error("post-register: waitgroup did not release; timing out.")
 	}
-	testApp.InfoLog.Println("wait group released.")
+	testApp.Log.Info("wait group released")
 
-	if len(mailMessages) != 1 {
-		t.Errorf("post-register: expected 1 mail message, got %d", len(mailMessages))
+	messages := testTransport.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("post-register: expected 1 mail message, got %d", len(messages))
 	}
 
-	data, ok := mailMessages[0].Data.(string)
+	// the signed URL is the last thing in the plain text body
+	words := strings.Fields(messages[0].PlainBody)
+	if len(words) == 0 {
+		t.Fatal("post-register: mail message has no body")
+	}
 
-	if !ok {
-		t.Error("post-register: could not get data back from mail message")
+	link, err := url.Parse(words[len(words)-1])
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if !VerifyToken(data) {
-		t.Error("post-register: did not get signed URL from message")
+	// the mock inserts the user as user 2
+	userID, err := testApp.Tokens.Verify(link.Query().Get("token"), purposeActivate)
+	if err != nil || userID != 2 {
+		t.Errorf("post-register: expected an activation link for user 2, got %d, %v", userID, err)
 	}
 
 }
+
+// If the activation mail can't be saved, the registration isn't either.
+func TestHandlers_PostRegister_outboxFails(t *testing.T) {
+	testTransport.Reset()
+
+	saved := testApp.Mailer.Outbox
+	testApp.Mailer.Outbox = &data.OutboxTest{FailTest: true}
+	defer func() {
+		testApp.Mailer.Outbox = saved
+	}()
+
+	formPost := url.Values{}
+	formPost.Add("email", "who@first.com")
+	formPost.Add("password", "it-is-a-secret")
+	formPost.Add("verify-password", "it-is-a-secret")
+
+	req, _ := http.NewRequest("POST", "/register", strings.NewReader(formPost.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	ctx := createMockContext(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(testApp.PostRegister)
+	handler.ServeHTTP(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "/register" {
+		t.Errorf("expected redirect back to /register, got %s", location)
+	}
+
+	if !testApp.Session.Exists(ctx, "error") {
+		t.Error("expected an error message")
+	}
+
+	testApp.Wait.Wait()
+	if messages := testTransport.Messages(); len(messages) != 0 {
+		t.Errorf("expected no mail, got %d", len(messages))
+	}
+}
+
+// Activation links mailed before link tokens still work until they expire,
+// though they were signed for another origin than the one we serve now.
+func TestHandlers_ActivateUser_legacy(t *testing.T) {
+	saved, savedBase, savedOrigin := testApp.Tokens, testApp.Settings.BaseURL, testApp.Settings.Links.LegacyOrigin
+	testApp.Tokens = newTestTokens(2, "mail-secret")
+	testApp.Settings.BaseURL = "https://example.com"
+	testApp.Settings.Links.LegacyOrigin = "http://localhost:8080"
+	defer func() {
+		testApp.Tokens = saved
+		testApp.Settings.BaseURL, testApp.Settings.Links.LegacyOrigin = savedBase, savedOrigin
+	}()
+
+	sword := goalone.New([]byte("mail-secret"), goalone.Timestamp)
+	signed := string(sword.Sign([]byte("http://localhost:8080/activate?email=killroy@here.com&hash=")))
+
+	tests := []struct {
+		name string
+		link string
+		ok   bool
+	}{
+		{"signed", signed, true},
+		{"tampered", strings.Replace(signed, "killroy@", "kilroy@", 1), false},
+	}
+
+	for _, tt := range tests {
+		uri := strings.TrimPrefix(tt.link, "http://localhost:8080")
+		req, _ := http.NewRequest("GET", uri, nil)
+		req.RequestURI = uri
+		ctx := createMockContext(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(testApp.ActivateUser).ServeHTTP(rr, req)
+
+		if got := testApp.Session.Exists(ctx, "flash"); got != tt.ok {
+			t.Errorf("%s: expected success %v, got %v", tt.name, tt.ok, got)
+		}
+		if got := testApp.Session.Exists(ctx, "error"); got == tt.ok {
+			t.Errorf("%s: expected an error %v, got %v", tt.name, !tt.ok, got)
+		}
+	}
+}
+
+func TestHandlers_ReplayDeadLetter(t *testing.T) {
+	testTransport.Reset()
+
+	req, _ := http.NewRequest("POST", "/admin/mail/dead-letters/replay", strings.NewReader("id=1"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	ctx := createMockContext(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(testApp.ReplayDeadLetter)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("replay-dead-letter: expected redirect, got %d", rr.Code)
+	}
+
+	if !testApp.Session.Exists(ctx, "flash") {
+		t.Error("replay-dead-letter: did not get success message")
+	}
+
+	testApp.Wait.Wait()
+
+	messages := testTransport.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("replay-dead-letter: expected 1 mail message, got %d", len(messages))
+	}
+
+	if messages[0].To != "killroy@here.com" {
+		t.Errorf("replay-dead-letter: expected mail to killroy@here.com, got %s", messages[0].To)
+	}
+}
+
+// waitForMail waits for the mailer to send want messages, and returns them.
+func waitForMail(want int) []Envelope {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(testTransport.Messages()) < want && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	return testTransport.Messages()
+}
+
+func TestHandlers_PostForgotPassword(t *testing.T) {
+	testTransport.Reset()
+
+	req, _ := http.NewRequest("POST", "/forgot-password", strings.NewReader("email=killroy%40here.com"))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	ctx := createMockContext(req)
+	req = req.WithContext(ctx)
+
+	rr := httptest.NewRecorder()
+	testApp.PostForgotPassword(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/login" {
+		t.Errorf("forgot-password: expected redirect to /login, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if !testApp.Session.Exists(ctx, "flash") {
+		t.Error("forgot-password: did not get a message")
+	}
+
+	messages := waitForMail(1)
+	if len(messages) != 1 {
+		t.Fatalf("forgot-password: expected 1 mail message, got %d", len(messages))
+	}
+	if messages[0].Subject != "Reset Your Password" {
+		t.Errorf("forgot-password: expected subject %q, got %q", "Reset Your Password", messages[0].Subject)
+	}
+
+	var link string
+	for _, word := range strings.Fields(messages[0].PlainBody) {
+		if strings.Contains(word, "/reset-password?token=") {
+			link = word
+		}
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID, err := testApp.Tokens.Verify(parsed.Query().Get("token"), purposeReset); err != nil || userID != 1 {
+		t.Errorf("forgot-password: expected a reset link for user 1, got %q: %v", link, err)
+	}
+}
+
+// resetLink makes a password reset link for user 1.
+func resetLink(t *testing.T) string {
+	token, err := testApp.Tokens.Issue(purposeReset, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "/reset-password?token=" + url.QueryEscape(token)
+}
+
+func TestHandlers_ResetPasswordPage(t *testing.T) {
+	used := resetLink(t)
+	if err := testApp.Tokens.Revoke(1, purposeReset); err != nil {
+		t.Fatal(err)
+	}
+
+	link := resetLink(t)
+
+	activation, err := testApp.Tokens.Issue(purposeActivate, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		link  string
+		code  int
+		error string
+	}{
+		{"valid", link, http.StatusOK, ""},
+		{"tampered", link[:len(link)-2], http.StatusSeeOther, "Your reset link is invalid. Please ask for a new one."},
+		{"used", used, http.StatusSeeOther, "Your reset link has already been used. Please ask for a new one."},
+		{"activation", "/reset-password?token=" + url.QueryEscape(activation), http.StatusSeeOther, "Your reset link is invalid. Please ask for a new one."},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.link, nil)
+		req.RequestURI = tt.link
+		ctx := createMockContext(req)
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		testApp.ResetPasswordPage(rr, req)
+
+		if rr.Code != tt.code {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.code, rr.Code)
+		}
+		if msg := testApp.Session.GetString(ctx, "error"); msg != tt.error {
+			t.Errorf("%s: expected error %q, got %q", tt.name, tt.error, msg)
+		}
+	}
+}
+
+func TestHandlers_PostResetPassword(t *testing.T) {
+	link := resetLink(t)
+	other := resetLink(t)
+
+	// the link survives a typo, but works only once, and takes the
+	// user's other reset links with it
+	tests := []struct {
+		name    string
+		link    string
+		verify  string
+		error   string
+		subject string
+	}{
+		{"mismatched", link, "something-else", "Passwords required and must match", ""},
+		{"changed", link, "a-new-secret", "", "Your Password Was Changed"},
+		{"replayed", link, "a-new-secret", "Your reset link has already been used. Please ask for a new one.", ""},
+		{"other link", other, "a-new-secret", "Your reset link has already been used. Please ask for a new one.", ""},
+	}
+
+	for _, tt := range tests {
+		testTransport.Reset()
+
+		formPost := url.Values{}
+		formPost.Add("password", "a-new-secret")
+		formPost.Add("verify-password", tt.verify)
+
+		req, _ := http.NewRequest("POST", tt.link, strings.NewReader(formPost.Encode()))
+		req.RequestURI = tt.link
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		ctx := createMockContext(req)
+		req = req.WithContext(ctx)
+		testApp.Session.Put(ctx, "userID", 1)
+
+		rr := httptest.NewRecorder()
+		testApp.PostResetPassword(rr, req)
+
+		if msg := testApp.Session.GetString(ctx, "error"); msg != tt.error {
+			t.Errorf("%s: expected error %q, got %q", tt.name, tt.error, msg)
+		}
+
+		want := 1
+		if tt.subject == "" {
+			want = 0
+		}
+		messages := waitForMail(want)
+		if len(messages) != want {
+			t.Errorf("%s: expected %d mail messages, got %d", tt.name, want, len(messages))
+			continue
+		}
+		if want == 0 {
+			continue
+		}
+		if messages[0].Subject != tt.subject {
+			t.Errorf("%s: expected subject %q, got %q", tt.name, tt.subject, messages[0].Subject)
+		}
+
+		// whoever was signed in here is signed out
+		if rr.Header().Get("Location") != "/login" || testApp.Session.Exists(ctx, "userID") {
+			t.Errorf("%s: expected to be signed out and sent to log in", tt.name)
+		}
+	}
+}
+
+func TestConfig_Auth_passwordReset(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/members/plans", nil)
+	ctx := createMockContext(req)
+	req = req.WithContext(ctx)
+
+	// signed in before the password was last reset
+	testApp.Session.Put(ctx, "userID", 1)
+	testApp.Session.Put(ctx, "passwordStamp", "1650000000000000000")
+
+	rr := httptest.NewRecorder()
+	testApp.Auth(http.HandlerFunc(testApp.ChoosePlans)).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusTemporaryRedirect || rr.Header().Get("Location") != "/login" {
+		t.Errorf("expected to be sent to log in again, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if testApp.Session.Exists(ctx, "userID") {
+		t.Error("expected the old session to be ended")
+	}
+}
+
+func TestConfig_CheckCSRF(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/members/plans", nil)
+	ctx := createMockContext(req)
+	req = req.WithContext(ctx)
+
+	// rendering a page gives the session its token
+	td := testApp.AddDefaultData(&TemplateData{}, req)
+	if td.CSRFToken == "" {
+		t.Fatal("expected a CSRF token for the page")
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		status int
+	}{
+		{"get", "GET", "", http.StatusOK},
+		{"no token", "POST", "", http.StatusForbidden},
+		{"wrong token", "POST", "not-the-token", http.StatusForbidden},
+		{"token", "POST", td.CSRFToken, http.StatusOK},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		formPost := url.Values{}
+		formPost.Add("csrf_token", tt.token)
+		req, _ := http.NewRequest(tt.method, "/members/subscribe", strings.NewReader(formPost.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(ctx)
+
+		rr := httptest.NewRecorder()
+		testApp.CheckCSRF(ok).ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, rr.Code)
+		}
+	}
+}
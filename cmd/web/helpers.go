@@ -1,15 +1,137 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"database/sql"
+	"final-project/data"
+	"net/http"
+	"strconv"
+	"strings"
+)
 
 // wrap our mailer so that we don't forget to
-// add to the WaitGroup; mailer.sendMail() decrements.
-func (app *Config) sendMail(msg Message) {
-	app.Mailer.Wait.Add(1)
-	app.Mailer.MailerChan <- msg
+// add to the WaitGroup; the mailer's queue does that, and the
+// mail worker decrements. The message goes to the outbox first,
+// so it survives a restart. It is tagged with the request and user
+// in ctx, so its log lines can be traced back to them.
+func (app *Config) sendMail(ctx context.Context, msg Message) {
+	tagMail(ctx, &msg)
+
+	err := app.Mailer.persist(&msg)
+	if err != nil {
+		app.logger(ctx).Error("could not write mail to outbox, sending from memory",
+			append(msg.logAttrs(), "error", err)...)
+	}
+
+	app.Mailer.queue(ctx, msg)
+}
+
+// persistMail writes msg to the outbox as part of tx, alongside the write
+// it is mailed about, so there is never one without the other. Once tx
+// has committed, hand msg to app.Mailer.queue.
+func (app *Config) persistMail(ctx context.Context, tx *sql.Tx, msg *Message) error {
+	tagMail(ctx, msg)
+	return app.Mailer.persistTx(tx, msg)
+}
+
+// tagMail gives msg an ID, and tags it with the request and user in ctx.
+func tagMail(ctx context.Context, msg *Message) {
+	if msg.ID == "" {
+		msg.ID = newID()
+	}
+
+	tag := tagFromContext(ctx)
+	if msg.RequestID == "" {
+		msg.RequestID = tag.RequestID
+	}
+	if msg.UserID == 0 {
+		msg.UserID = tag.UserID
+	}
+}
+
+// refreshSessionUser reloads the user in session, after a change to them
+// or their plan.
+func (app *Config) refreshSessionUser(r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	user, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		// this is a convenience, so if there's an error,
+		// log it and ignore.
+		app.logger(r.Context()).Error("could not retrieve updated user", "error", err)
+		return
+	}
+	app.Session.Put(r.Context(), "user", *user)
+}
+
+// passwordStamp tells apart the user's passwords: it changes each time the
+// password is reset. Sessions carry the stamp from when the user logged
+// in, and end once it changes.
+func passwordStamp(user data.User) string {
+	if !user.PasswordChangedAt.Valid {
+		return ""
+	}
+	return strconv.FormatInt(user.PasswordChangedAt.Time.UnixNano(), 10)
+}
+
+// the form field, and the session key, that hold the CSRF token
+const (
+	csrfField      = "csrf_token"
+	csrfSessionKey = "csrfToken"
+)
+
+// csrfToken returns the session's CSRF token, making one the first time.
+// Forms that post to routes behind CheckCSRF send it in csrfField.
+func (app *Config) csrfToken(r *http.Request) string {
+	token := app.Session.GetString(r.Context(), csrfSessionKey)
+	if token != "" {
+		return token
+	}
+
+	token, err := newNonce()
+	if err != nil {
+		// the page can still be shown; its forms will be refused
+		app.logger(r.Context()).Error("could not make CSRF token", "error", err)
+		return ""
+	}
+	app.Session.Put(r.Context(), csrfSessionKey, token)
+	return token
 }
 
 func (app *Config) errorFlash(w http.ResponseWriter, r *http.Request, msg, url string) {
 	app.Session.Put(r.Context(), "error", msg)
 	http.Redirect(w, r, url, http.StatusSeeOther)
 }
+
+// locale returns the locale to show prices in: for a signed in user, the
+// one they are billed in, or else the best match for the browser's
+// Accept-Language.
+func (app *Config) locale(r *http.Request) data.Locale {
+	if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok {
+		return userLocale(user)
+	}
+	return localeFromRequest(r)
+}
+
+// userLocale returns the locale the user is billed in. Prices shown to
+// them, invoices and prorations all go through here, so they always
+// agree on the currency.
+func userLocale(user data.User) data.Locale {
+	return data.LocaleFor(user.Locale)
+}
+
+// localeFromRequest picks the first locale in Accept-Language that we
+// support, by tag or by language, or the default locale.
+func localeFromRequest(r *http.Request) data.Locale {
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		if locale, ok := data.MatchLocale(tag); ok {
+			return locale
+		}
+	}
+	return data.LocaleFor(data.DefaultLocale)
+}
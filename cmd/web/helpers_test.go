@@ -0,0 +1,29 @@
+package main
+
+import (
+	"final-project/data"
+	"net/http"
+	"testing"
+)
+
+func Test_localeFromRequest(t *testing.T) {
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"de-DE", "de-DE"},
+		{"de-AT,de;q=0.9,en;q=0.5", "de-DE"},
+		{"es-ES,fr;q=0.8", "fr-FR"},
+		{"es-ES", data.DefaultLocale},
+		{"", data.DefaultLocale},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", tt.acceptLanguage)
+
+		if got := localeFromRequest(req).Tag; got != tt.want {
+			t.Errorf("%q: expected %s, got %s", tt.acceptLanguage, tt.want, got)
+		}
+	}
+}
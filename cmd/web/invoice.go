@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"final-project/data"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phpdave11/gofpdf"
+)
+
+// billingPeriod returns the month-long billing period starting at start.
+func billingPeriod(start time.Time) (time.Time, time.Time) {
+	return start, start.AddDate(0, 1, 0)
+}
+
+// GenerateInvoice issues the invoice for a user's plan for the billing
+// period starting at periodStart, less the coupon if there is one. If it
+// was already issued, say by an earlier attempt at the same job, that
+// invoice is returned instead.
+func (app *Config) GenerateInvoice(user data.User, plan data.Plan, periodStart time.Time, coupon *data.Coupon) (*data.Invoice, error) {
+	// bill in the user's currency if the plan is sold in it
+	locale := userLocale(user)
+	amount, currency := plan.Price(locale.Currency)
+
+	start, end := billingPeriod(periodStart)
+	invoice := data.Invoice{
+		UserID:      user.ID,
+		PlanID:      plan.ID,
+		Status:      data.InvoiceIssued,
+		Currency:    currency,
+		Locale:      locale.Tag,
+		PeriodStart: start,
+		PeriodEnd:   end,
+	}
+	invoice.AddLine(fmt.Sprintf("%s subscription", plan.PlanName), 1, amount)
+
+	return app.issueInvoice(user, invoice, coupon)
+}
+
+// GenerateProrationInvoice issues the invoice for a switch between plans
+// part way through a period: the credit for the old plan, and the charge
+// for the new one, for the rest of the period, less the coupon if there is
+// one. Like GenerateInvoice, it returns the invoice already issued for the
+// switch, if there is one.
+func (app *Config) GenerateProrationInvoice(user data.User, p Proration, coupon *data.Coupon) (*data.Invoice, error) {
+	invoice := data.Invoice{
+		UserID:      user.ID,
+		PlanID:      p.To.ID,
+		Status:      data.InvoiceIssued,
+		Currency:    p.Currency,
+		Locale:      p.Locale,
+		PeriodStart: p.At,
+		PeriodEnd:   p.PeriodEnd,
+	}
+	p.addLines(&invoice)
+
+	return app.issueInvoice(user, invoice, coupon)
+}
+
+// issueInvoice takes the coupon, if any, off an invoice whose lines are
+// all added, adds the tax, and stores it, unless the user already has an
+// invoice for the same plan and period start.
+func (app *Config) issueInvoice(user data.User, invoice data.Invoice, coupon *data.Coupon) (*data.Invoice, error) {
+	existing, err := app.Models.Invoice.GetForPeriod(user.ID, invoice.PlanID, invoice.PeriodStart)
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if coupon != nil {
+		addCouponLine(&invoice, *coupon)
+	}
+	app.Tax.Apply(&invoice, user.Region)
+
+	id, err := app.Models.Invoice.Insert(invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	// read it back for the number the database gave it
+	return app.Models.Invoice.GetOne(id)
+}
+
+// InvoiceNotice is an invoice as a mail shows it. Mail waits in the outbox
+// as JSON, so it holds the invoice's amounts already formatted, rather
+// than the invoice and its methods, which don't survive the trip.
+type InvoiceNotice struct {
+	Number       string
+	Period       string
+	Lines        []InvoiceNoticeLine
+	Subtotal     string
+	TaxLines     []InvoiceNoticeLine
+	Tax          string
+	Total        string
+	TaxInclusive bool
+}
+
+// InvoiceNoticeLine is a line item, or a tax, on an InvoiceNotice. Taxes
+// have only a description and an amount.
+type InvoiceNoticeLine struct {
+	Description string
+	Quantity    string
+	UnitPrice   string
+	Amount      string
+}
+
+// newInvoiceNotice formats the invoice for a mail.
+func newInvoiceNotice(invoice *data.Invoice) InvoiceNotice {
+	notice := InvoiceNotice{
+		Number:       invoice.DisplayNumber(),
+		Period:       invoice.PeriodForDisplay(),
+		Subtotal:     invoice.SubtotalForDisplay(),
+		Tax:          invoice.TaxForDisplay(),
+		Total:        invoice.TotalForDisplay(),
+		TaxInclusive: invoice.TaxInclusive,
+	}
+
+	for _, line := range invoice.Lines {
+		notice.Lines = append(notice.Lines, InvoiceNoticeLine{
+			Description: line.Description,
+			Quantity:    strconv.Itoa(line.Quantity),
+			UnitPrice:   invoice.FormatAmount(line.UnitAmount),
+			Amount:      invoice.FormatAmount(line.Amount),
+		})
+	}
+
+	for _, line := range invoice.TaxLines {
+		notice.TaxLines = append(notice.TaxLines, InvoiceNoticeLine{
+			Description: line.Label(),
+			Amount:      invoice.FormatAmount(line.Amount),
+		})
+	}
+
+	return notice
+}
+
+// writeInvoicePDF renders the invoice as a PDF, and returns its bytes.
+func (app *Config) writeInvoicePDF(invoice *data.Invoice, user data.User) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := renderInvoicePDF(invoice, user).Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderInvoicePDF lays out an invoice on a single Letter page.
+func renderInvoicePDF(invoice *data.Invoice, user data.User) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(20, 20, 20)
+	pdf.AddPage()
+
+	// the core fonts only have the cp1252 characters, which include the
+	// currency symbols we use and the no-break space, but not the narrow one
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	money := func(amount int) string {
+		return tr(strings.ReplaceAll(invoice.FormatAmount(amount), "\u202f", "\u00a0"))
+	}
+
+	// heading
+	pdf.SetFont("Arial", "B", 20)
+	pdf.CellFormat(0, 10, "INVOICE", "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	pdf.SetFont("Arial", "", 11)
+	details := [][2]string{
+		{"Invoice number", invoice.DisplayNumber()},
+		{"Issued", invoice.IssuedAt.Format("Jan 2, 2006")},
+		{"Billing period", invoice.PeriodForDisplay()},
+		{"Status", invoice.Status},
+	}
+	for _, d := range details {
+		pdf.CellFormat(40, 6, d[0], "", 0, "L", false, 0, "")
+		pdf.CellFormat(0, 6, d[1], "", 1, "L", false, 0, "")
+	}
+	pdf.Ln(6)
+
+	pdf.SetFont("Arial", "B", 11)
+	pdf.CellFormat(0, 6, "Bill to", "", 1, "L", false, 0, "")
+	pdf.SetFont("Arial", "", 11)
+	pdf.CellFormat(0, 6, fmt.Sprintf("%s %s", user.FirstName, user.LastName), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, user.Email, "", 1, "L", false, 0, "")
+	pdf.Ln(8)
+
+	// line items
+	widths := []float64{95, 15, 30, 35}
+	pdf.SetFont("Arial", "B", 11)
+	pdf.SetFillColor(230, 230, 230)
+	for i, heading := range []string{"Description", "Qty", "Unit price", "Amount"} {
+		align := "R"
+		if i == 0 {
+			align = "L"
+		}
+		pdf.CellFormat(widths[i], 8, heading, "B", 0, align, true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Arial", "", 11)
+	for _, line := range invoice.Lines {
+		pdf.CellFormat(widths[0], 7, line.Description, "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 7, fmt.Sprintf("%d", line.Quantity), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[2], 7, money(line.UnitAmount), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 7, money(line.Amount), "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(2)
+
+	// totals, right aligned under the amounts
+	labelWidth := widths[0] + widths[1] + widths[2]
+	totals := [][2]string{{"Subtotal", money(invoice.Subtotal)}}
+	for _, line := range invoice.TaxLines {
+		totals = append(totals, [2]string{line.Label(), money(line.Amount)})
+	}
+	if len(invoice.TaxLines) == 0 {
+		totals = append(totals, [2]string{"Tax", money(invoice.Tax)})
+	}
+	totals = append(totals, [2]string{"Total", money(invoice.Total)})
+	for i, t := range totals {
+		border := ""
+		if i == len(totals)-1 {
+			pdf.SetFont("Arial", "B", 11)
+			border = "T"
+		}
+		pdf.CellFormat(labelWidth, 7, t[0], border, 0, "R", false, 0, "")
+		pdf.CellFormat(widths[3], 7, t[1], border, 1, "R", false, 0, "")
+	}
+
+	if invoice.TaxInclusive {
+		pdf.Ln(2)
+		pdf.SetFont("Arial", "I", 9)
+		pdf.CellFormat(0, 5, "Prices include tax.", "", 1, "R", false, 0, "")
+	}
+
+	return pdf
+}
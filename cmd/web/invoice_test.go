@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"final-project/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testInvoice() *data.Invoice {
+	start, end := billingPeriod(time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC))
+	invoice := &data.Invoice{
+		Number:      42,
+		Status:      data.InvoiceIssued,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		IssuedAt:    start,
+	}
+	invoice.AddLine("Gold Plan subscription", 1, 3000)
+	invoice.AddLine("Extra seats", 2, 500)
+	return invoice
+}
+
+func Test_billingPeriod(t *testing.T) {
+	start, end := billingPeriod(time.Date(2022, 1, 31, 0, 0, 0, 0, time.UTC))
+	if !end.Equal(start.AddDate(0, 1, 0)) {
+		t.Errorf("expected a month-long period, got %s to %s", start, end)
+	}
+}
+
+func TestInvoice_totals(t *testing.T) {
+	invoice := testInvoice()
+
+	if invoice.Subtotal != 4000 || invoice.Total != 4000 {
+		t.Errorf("expected subtotal and total of 4000, got %d and %d", invoice.Subtotal, invoice.Total)
+	}
+
+	if invoice.DisplayNumber() != "INV-000042" {
+		t.Errorf("expected INV-000042, got %s", invoice.DisplayNumber())
+	}
+
+	if invoice.PeriodForDisplay() != "May 12, 2022 to Jun 12, 2022" {
+		t.Errorf("unexpected period %s", invoice.PeriodForDisplay())
+	}
+}
+
+func Test_renderInvoicePDF(t *testing.T) {
+	pdf := renderInvoicePDF(testInvoice(), data.User{FirstName: "Lois", LastName: "Lane", Email: "lois@planet.com"})
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(buf.Bytes(), []byte("%PDF")) {
+		t.Error("expected a PDF")
+	}
+}
+
+func TestMail_invoiceTemplates(t *testing.T) {
+	invoice := testInvoice()
+	testApp.Tax.Apply(invoice, "GB")
+
+	msg := Message{
+		Template: "invoice",
+		Data:     newInvoiceNotice(invoice),
+	}
+
+	// as sent straight away, and as sent from the outbox or a replay
+	for _, msg := range []Message{msg, outboxRoundTrip(t, msg)} {
+		msg.DataMap = map[string]any{"message": msg.Data}
+
+		html, err := testApp.Mailer.buildHTMLMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plain, err := testApp.Mailer.buildTextMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range []string{"INV-000042", "Gold Plan subscription", "Extra seats", "$10.00", "$40.00", "VAT (GB) 20%", "$8.00", "$48.00"} {
+			if !strings.Contains(html, want) {
+				t.Errorf("expected %q in the HTML invoice", want)
+			}
+			if !strings.Contains(plain, want) {
+				t.Errorf("expected %q in the plain invoice", want)
+			}
+		}
+	}
+}
+
+// outboxRoundTrip returns msg as the mailer reads it back from the outbox,
+// or from a dead letter.
+func outboxRoundTrip(t *testing.T, msg Message) Message {
+	t.Helper()
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stored Message
+	if err := json.Unmarshal(payload, &stored); err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+func Test_formatMoney(t *testing.T) {
+	tests := []struct {
+		amount   int
+		currency string
+		locale   string
+		want     string
+	}{
+		{100000, "USD", "en-US", "$1,000.00"},
+		{100000, "EUR", "de-DE", "1.000,00\u00a0€"},
+		{123456789, "EUR", "fr-FR", "1\u202f234\u202f567,89\u00a0€"},
+		{1500, "GBP", "en-GB", "£15.00"},
+		{1400, "JPY", "ja-JP", "¥1,400"},
+		{-505, "USD", "", "-$5.05"},
+		{1234, "XYZ", "en-US", "12.34\u00a0XYZ"},
+	}
+
+	for _, tt := range tests {
+		if got := data.FormatMoney(tt.amount, tt.currency, tt.locale); got != tt.want {
+			t.Errorf("%d %s in %q: expected %q, got %q", tt.amount, tt.currency, tt.locale, tt.want, got)
+		}
+	}
+}
+
+func TestPlan_Price(t *testing.T) {
+	plan, _ := testApp.Models.Plan.GetOne(1)
+
+	if amount, currency := plan.Price("GBP"); currency != "GBP" || amount != 1200 {
+		t.Errorf("expected the plan at 1200 GBP, got %d %s", amount, currency)
+	}
+
+	// not sold in yen, so it is billed in dollars
+	if amount, currency := plan.Price("JPY"); currency != "USD" || amount != 1500 {
+		t.Errorf("expected the plan at 1500 USD, got %d %s", amount, currency)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"final-project/data"
+	"fmt"
+	"time"
+)
+
+// Job kinds
+const (
+	jobInvoice = "invoice"
+	jobManual  = "manual"
+	jobDunning = "dunning"
+)
+
+// SubscriptionJob is the payload for the work that follows a subscription.
+// It holds IDs rather than the user and plan, so a job that waits for a
+// retry picks up any changes made in the meantime.
+type SubscriptionJob struct {
+	UserID int
+	PlanID int
+	// the first billing period starts here; for a switch between plans,
+	// this is when the switch happened
+	SubscribedAt time.Time
+	RequestID    string
+	// for a switch between plans, the plan switched from, and the period
+	// the switch happened in
+	FromPlanID  int
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	// the coupon redeemed for the subscription, if any
+	CouponID int
+	// set when the job is for a renewal, whose period starts at
+	// SubscribedAt
+	Renewal bool
+}
+
+// context tags ctx with the request that queued the job, and its user.
+func (j SubscriptionJob) context(ctx context.Context) context.Context {
+	return withRequestTag(ctx, requestTag{RequestID: j.RequestID, UserID: j.UserID})
+}
+
+// registerJobs tells q how to run each kind of job.
+func (app *Config) registerJobs(q *JobQueue) {
+	HandleJob(q, jobInvoice, app.sendInvoice)
+	HandleJob(q, jobManual, app.sendManual)
+	HandleJob(q, jobDunning, app.dun)
+}
+
+// loadSubscription loads the user and plan a job is for.
+func (app *Config) loadSubscription(job SubscriptionJob) (*data.User, *data.Plan, error) {
+	user, err := app.Models.User.GetOne(job.UserID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading user %d: %w", job.UserID, err)
+	}
+
+	plan, err := app.Models.Plan.GetOne(job.PlanID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading plan %d: %w", job.PlanID, err)
+	}
+
+	return user, plan, nil
+}
+
+// sendInvoice issues the invoice for a new subscription, and mails it with
+// the invoice attached as a PDF. For a renewal, it is the receipt.
+func (app *Config) sendInvoice(ctx context.Context, job SubscriptionJob) error {
+	user, plan, err := app.loadSubscription(job)
+	if err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("You've Subscribed to Our %s", plan.PlanName)
+	switch {
+	case job.FromPlanID != 0:
+		subject = fmt.Sprintf("You've Switched to Our %s", plan.PlanName)
+	case job.Renewal:
+		subject = fmt.Sprintf("Your Receipt for Our %s", plan.PlanName)
+	}
+
+	invoice, err := app.subscriptionInvoice(*user, *plan, job)
+	if err != nil {
+		return fmt.Errorf("issuing invoice: %w", err)
+	}
+
+	pdf, err := app.writeInvoicePDF(invoice, *user)
+	if err != nil {
+		return fmt.Errorf("writing invoice %s: %w", invoice.DisplayNumber(), err)
+	}
+
+	msg := Message{
+		To:       user.Email,
+		Subject:  subject,
+		Data:     newInvoiceNotice(invoice),
+		Template: "invoice",
+		Files: map[string][]byte{
+			fmt.Sprintf("Invoice-%s.pdf", invoice.DisplayNumber()): pdf,
+		},
+	}
+	app.sendMail(job.context(ctx), msg)
+
+	return nil
+}
+
+// subscriptionInvoice issues the invoice for a subscription job: the
+// plan's price for a new subscription, or the proration for a switch,
+// less the coupon if there is one. Issuing it again returns the same
+// invoice.
+func (app *Config) subscriptionInvoice(user data.User, plan data.Plan, job SubscriptionJob) (*data.Invoice, error) {
+	var coupon *data.Coupon
+	if job.CouponID != 0 {
+		var err error
+		coupon, err = app.Models.Coupon.GetOne(job.CouponID)
+		if err != nil {
+			return nil, fmt.Errorf("loading coupon %d: %w", job.CouponID, err)
+		}
+	}
+
+	if job.FromPlanID == 0 {
+		return app.GenerateInvoice(user, plan, job.SubscribedAt, coupon)
+	}
+
+	from, err := app.Models.Plan.GetOne(job.FromPlanID)
+	if err != nil {
+		return nil, fmt.Errorf("loading plan %d: %w", job.FromPlanID, err)
+	}
+
+	paid, err := app.paidInvoice(user.ID, from.ID, job.PeriodEnd)
+	if err != nil {
+		return nil, fmt.Errorf("loading paid invoice: %w", err)
+	}
+
+	p := prorate(*from, plan, paid, userLocale(user), job.PeriodStart, job.PeriodEnd, job.SubscribedAt)
+	return app.GenerateProrationInvoice(user, p, coupon)
+}
+
+// sendManual generates a customized manual PDF for a new subscription, and
+// mails it.
+func (app *Config) sendManual(ctx context.Context, job SubscriptionJob) error {
+	user, plan, err := app.loadSubscription(job)
+	if err != nil {
+		return err
+	}
+
+	var manual bytes.Buffer
+	err = app.GenerateManual(*user, plan).Output(&manual)
+	if err != nil {
+		return fmt.Errorf("writing manual: %w", err)
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: fmt.Sprintf("Your %s User Manual", plan.PlanName),
+		Data:    "Your personalized manual is attached:",
+		Files: map[string][]byte{
+			"Manual.pdf": manual.Bytes(),
+		},
+	}
+	app.sendMail(job.context(ctx), msg)
+
+	return nil
+}
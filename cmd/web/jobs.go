@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"final-project/data"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// JobHandler runs one job, given its JSON payload.
+type JobHandler func(ctx context.Context, payload []byte) error
+
+// JobQueue runs jobs from the jobs table on a fixed pool of workers. Jobs
+// survive a restart: one that was running when we stopped is claimed
+// again once its lease lapses.
+type JobQueue struct {
+	Store       data.JobType
+	Workers     int
+	MaxAttempts int
+	RetryBase   time.Duration
+	RetryMax    time.Duration
+	Lease       time.Duration
+	PollEvery   time.Duration
+	Log         *slog.Logger
+	ErrorChan   chan ErrorEvent
+
+	handlers map[string]JobHandler
+
+	// lifecycle; see start and Stop
+	queue    chan *data.Job
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	pollDone chan struct{}
+	workers  sync.WaitGroup
+	ctx      context.Context
+	abort    context.CancelFunc
+}
+
+// HandleJob registers fn to run jobs of the given kind, decoding each
+// job's payload into a T first. Register every kind before start.
+func HandleJob[T any](q *JobQueue, kind string, fn func(ctx context.Context, payload T) error) {
+	if q.handlers == nil {
+		q.handlers = make(map[string]JobHandler)
+	}
+
+	q.handlers[kind] = func(ctx context.Context, raw []byte) error {
+		var payload T
+		if err := json.Unmarshal(raw, &payload); err != nil {
+			// it won't decode any better next time
+			return &permanentError{fmt.Errorf("decoding %s job: %w", kind, err)}
+		}
+		return fn(ctx, payload)
+	}
+}
+
+// Enqueue stores a job to run at runAt, or as soon as possible if runAt
+// is zero, and returns its ID.
+func (q *JobQueue) Enqueue(kind string, payload any, runAt time.Time) (int, error) {
+	if _, ok := q.handlers[kind]; !ok {
+		return 0, fmt.Errorf("no handler for %s jobs", kind)
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+
+	id, err := q.Store.Enqueue(kind, raw, runAt)
+	if err != nil {
+		return 0, err
+	}
+
+	// don't make a job that is due now wait for the next poll
+	if !runAt.After(time.Now()) {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return id, nil
+}
+
+// start launches the workers, and the poller that claims jobs for them.
+func (q *JobQueue) start() {
+	q.queue = make(chan *data.Job, q.Workers)
+	q.wake = make(chan struct{}, 1)
+	q.stop = make(chan struct{})
+	q.pollDone = make(chan struct{})
+	q.ctx, q.abort = context.WithCancel(context.Background())
+
+	for i := 0; i < q.Workers; i++ {
+		q.workers.Add(1)
+		go q.worker()
+	}
+
+	go q.poll()
+}
+
+// Stop stops claiming jobs and lets the workers finish what they have,
+// until ctx is done. Jobs still running then are cancelled; they will be
+// claimed again once their lease lapses.
+func (q *JobQueue) Stop(ctx context.Context) {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+	<-q.pollDone
+
+	// the poller was the only sender
+	close(q.queue)
+
+	finished := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		q.abort()
+		// hand back the jobs nobody started
+		for job := range q.queue {
+			q.release(job)
+		}
+		q.Log.Warn("stopped jobs before they finished")
+	}
+}
+
+// poll claims due jobs whenever there is room for them, and we are woken
+// or PollEvery passes.
+func (q *JobQueue) poll() {
+	defer close(q.pollDone)
+
+	ticker := time.NewTicker(q.PollEvery)
+	defer ticker.Stop()
+
+	for {
+		if err := q.claim(); err != nil {
+			q.report(ErrorEvent{Source: "jobs", Severity: SeverityWarning, Err: err, Time: time.Now()})
+		}
+
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// claim claims as many jobs as there is room for in the queue.
+func (q *JobQueue) claim() error {
+	free := cap(q.queue) - len(q.queue)
+	if free <= 0 {
+		return nil
+	}
+
+	jobs, err := q.Store.Claim(free, q.Lease)
+	if err != nil {
+		return fmt.Errorf("could not claim jobs: %w", err)
+	}
+
+	for _, job := range jobs {
+		select {
+		case q.queue <- job:
+		case <-q.stop:
+			q.release(job)
+		}
+	}
+
+	return nil
+}
+
+// worker runs jobs until the queue is closed.
+func (q *JobQueue) worker() {
+	defer q.workers.Done()
+
+	for job := range q.queue {
+		if q.ctx.Err() != nil {
+			q.release(job)
+			continue
+		}
+		q.run(job)
+	}
+}
+
+// run runs one job, and records the outcome: done, due again after a
+// backoff, or failed for good.
+func (q *JobQueue) run(job *data.Job) {
+	logger := q.Log.With("job_id", job.ID, "kind", job.Kind, "attempt", job.Attempts)
+
+	err := q.call(job)
+	if err == nil {
+		if err := q.Store.MarkDone(job.ID); err != nil {
+			logger.Error("could not mark job done", "error", err)
+		}
+		return
+	}
+
+	var permErr *permanentError
+	if errors.As(err, &permErr) || job.Attempts >= q.MaxAttempts {
+		if mfErr := q.Store.MarkFailed(job.ID, err.Error()); mfErr != nil {
+			logger.Error("could not mark job failed", "error", mfErr)
+		}
+
+		q.report(ErrorEvent{
+			Source:   job.Kind,
+			Severity: SeverityError,
+			Err:      fmt.Errorf("job %d failed after %d attempt(s): %w", job.ID, job.Attempts, err),
+			Payload:  map[string]any{"job_id": job.ID, "payload": string(job.Payload)},
+			Time:     time.Now(),
+		})
+		return
+	}
+
+	runAt := time.Now().Add(backoff(job.Attempts, q.RetryBase, q.RetryMax))
+	logger.Warn("job failed, will retry", "error", err, "run_at", runAt)
+
+	if err := q.Store.Retry(job.ID, runAt, err.Error()); err != nil {
+		// the lease will lapse, and it will run again anyway
+		logger.Error("could not reschedule job", "error", err)
+	}
+}
+
+// call runs the job's handler, turning a panic into an error.
+func (q *JobQueue) call(job *data.Job) (err error) {
+	handler, ok := q.handlers[job.Kind]
+	if !ok {
+		return &permanentError{fmt.Errorf("no handler for %s jobs", job.Kind)}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return handler(q.ctx, job.Payload)
+}
+
+// release hands back a job we claimed but will not run.
+func (q *JobQueue) release(job *data.Job) {
+	if err := q.Store.Release(job.ID); err != nil {
+		// the claim will lapse on its own; it just takes longer
+		q.Log.Error("could not release job", "job_id", job.ID, "error", err)
+	}
+}
+
+// report passes ev to the error listener, unless we are past the shutdown
+// deadline and it may be gone; then ev is only logged.
+func (q *JobQueue) report(ev ErrorEvent) {
+	select {
+	case q.ErrorChan <- ev:
+	case <-q.ctx.Done():
+		q.Log.Log(context.Background(), ev.Severity.level(), "job error", ev.logAttrs()...)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"final-project/data"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryJobs is a jobs table in memory, so queued jobs actually run.
+type memoryJobs struct {
+	mu   sync.Mutex
+	jobs []*data.Job
+}
+
+func (s *memoryJobs) Enqueue(kind string, payload []byte, runAt time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := &data.Job{
+		ID:      len(s.jobs) + 1,
+		Kind:    kind,
+		Payload: payload,
+		Status:  data.JobPending,
+		RunAt:   runAt,
+	}
+	s.jobs = append(s.jobs, job)
+	return job.ID, nil
+}
+
+func (s *memoryJobs) Claim(limit int, lease time.Duration) ([]*data.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var claimed []*data.Job
+	for _, job := range s.jobs {
+		if len(claimed) == limit {
+			break
+		}
+		if job.Status == data.JobPending && !job.RunAt.After(now) && !job.LockedUntil.After(now) {
+			job.LockedUntil = now.Add(lease)
+			job.Attempts++
+			copied := *job
+			claimed = append(claimed, &copied)
+		}
+	}
+	return claimed, nil
+}
+
+func (s *memoryJobs) update(id int, fn func(job *data.Job)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(s.jobs[id-1])
+	return nil
+}
+
+func (s *memoryJobs) MarkDone(id int) error {
+	return s.update(id, func(job *data.Job) { job.Status = data.JobDone })
+}
+
+func (s *memoryJobs) Retry(id int, runAt time.Time, lastError string) error {
+	return s.update(id, func(job *data.Job) {
+		job.RunAt, job.LockedUntil, job.LastError = runAt, time.Time{}, lastError
+	})
+}
+
+func (s *memoryJobs) MarkFailed(id int, lastError string) error {
+	return s.update(id, func(job *data.Job) { job.Status, job.LastError = data.JobFailed, lastError })
+}
+
+func (s *memoryJobs) Release(id int) error {
+	return s.update(id, func(job *data.Job) { job.LockedUntil = time.Time{} })
+}
+
+// count returns how many jobs have been queued.
+func (s *memoryJobs) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.jobs)
+}
+
+// since returns copies of the jobs queued after the first n.
+func (s *memoryJobs) since(n int) []data.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var jobs []data.Job
+	for _, job := range s.jobs[n:] {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+// get returns a copy of the job with the given ID.
+func (s *memoryJobs) get(id int) data.Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return *s.jobs[id-1]
+}
+
+// waitFor polls the job until it is no longer pending.
+func (s *memoryJobs) waitFor(t *testing.T, id int) data.Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job := s.get(id); job.Status != data.JobPending {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("job %d still pending", id)
+	return data.Job{}
+}
+
+func newTestJobQueue(store data.JobType) *JobQueue {
+	return &JobQueue{
+		Store:       store,
+		Workers:     2,
+		MaxAttempts: 3,
+		RetryBase:   time.Millisecond,
+		RetryMax:    5 * time.Millisecond,
+		Lease:       time.Minute,
+		PollEvery:   5 * time.Millisecond,
+		Log:         testApp.Log,
+		ErrorChan:   make(chan ErrorEvent, 10),
+	}
+}
+
+type greeting struct {
+	Name string
+}
+
+func TestJobQueue_retries(t *testing.T) {
+	store := &memoryJobs{}
+	q := newTestJobQueue(store)
+
+	var mu sync.Mutex
+	var calls []string
+	HandleJob(q, "greet", func(ctx context.Context, g greeting) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		calls = append(calls, g.Name)
+		if len(calls) < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+
+	q.start()
+	defer q.Stop(context.Background())
+
+	id, err := q.Enqueue("greet", greeting{Name: "Lois"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := store.waitFor(t, id)
+	if job.Status != data.JobDone || job.Attempts != 3 {
+		t.Errorf("expected the job done on the third attempt, got %s after %d", job.Status, job.Attempts)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 3 || calls[0] != "Lois" {
+		t.Errorf("expected the payload decoded three times, got %v", calls)
+	}
+}
+
+func TestJobQueue_gives_up(t *testing.T) {
+	store := &memoryJobs{}
+	q := newTestJobQueue(store)
+
+	HandleJob(q, "fail", func(ctx context.Context, g greeting) error {
+		return errors.New("never")
+	})
+	HandleJob(q, "panic", func(ctx context.Context, g greeting) error {
+		panic("oh no")
+	})
+
+	q.start()
+	defer q.Stop(context.Background())
+
+	failID, _ := q.Enqueue("fail", greeting{}, time.Time{})
+	panicID, _ := q.Enqueue("panic", greeting{}, time.Time{})
+	// a payload that won't decode is not retried
+	badID, _ := store.Enqueue("fail", []byte(`"not an object"`), time.Now())
+
+	for _, tc := range []struct {
+		name     string
+		id       int
+		attempts int
+	}{
+		{"fail", failID, 3},
+		{"panic", panicID, 3},
+		{"bad payload", badID, 1},
+	} {
+		job := store.waitFor(t, tc.id)
+		if job.Status != data.JobFailed || job.Attempts != tc.attempts {
+			t.Errorf("%s: expected failed after %d attempt(s), got %s after %d", tc.name, tc.attempts, job.Status, job.Attempts)
+		}
+
+		ev := <-q.ErrorChan
+		if ev.Severity != SeverityError {
+			t.Errorf("%s: expected an error event, got %s", tc.name, ev.Severity)
+		}
+	}
+}
+
+func TestJobQueue_Enqueue_scheduled(t *testing.T) {
+	store := &memoryJobs{}
+	q := newTestJobQueue(store)
+	HandleJob(q, "greet", func(ctx context.Context, g greeting) error { return nil })
+
+	q.start()
+	id, _ := q.Enqueue("greet", greeting{}, time.Now().Add(time.Hour))
+
+	time.Sleep(20 * time.Millisecond)
+	q.Stop(context.Background())
+
+	if job := store.get(id); job.Status != data.JobPending || job.Attempts != 0 {
+		t.Errorf("expected a job due in an hour left alone, got %s after %d attempt(s)", job.Status, job.Attempts)
+	}
+
+	if _, err := q.Enqueue("unknown", greeting{}, time.Time{}); err == nil {
+		t.Error("expected an error queueing a job nobody handles")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"final-project/data"
+	"fmt"
+	"sync"
+	"time"
+
+	goalone "github.com/bwmarrin/go-alone"
+)
+
+const (
+	// how often the keyring rereads the keys, to pick up a rotation
+	// made by another instance or by -rotate-link-key
+	keyringRefresh = time.Minute
+	// a token signed with a key we don't know rereads them sooner, but
+	// not more often than this, however many such tokens come in
+	keyringRetry = 5 * time.Second
+)
+
+var errNoSigningKey = errors.New("no key to sign links with")
+
+// Keyring holds the keys that sign and verify link tokens. The keys live
+// in the database, so every instance shares them, and a rotation doesn't
+// need a restart: the newest key signs, and the ones before it keep
+// verifying the links they signed until they are retired.
+type Keyring struct {
+	Store data.SigningKeyType
+	// how many keys before the current one still verify, after a rotation
+	Keep int
+	// secrets from before tokens carried a key ID; they only verify
+	Legacy []string
+
+	mu      sync.Mutex
+	current string
+	swords  map[string]*goalone.Sword
+	loaded  time.Time
+}
+
+// signer returns the current key's ID, and the sword to sign with it. If
+// there are no keys yet, it makes the first one.
+func (k *Keyring) signer() (string, *goalone.Sword, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if time.Since(k.loaded) > keyringRefresh {
+		if err := k.load(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if k.current == "" {
+		if _, err := rotateSigningKey(k.Store, k.Keep); err != nil {
+			return "", nil, err
+		}
+		if err := k.load(); err != nil {
+			return "", nil, err
+		}
+		if k.current == "" {
+			return "", nil, errNoSigningKey
+		}
+	}
+
+	return k.current, k.swords[k.current], nil
+}
+
+// verifiers returns the swords that might have signed a token with the key
+// ID: the key's own, or the legacy ones for a token without an ID.
+func (k *Keyring) verifiers(keyID string) ([]*goalone.Sword, error) {
+	if keyID == "" {
+		var swords []*goalone.Sword
+		for _, secret := range k.Legacy {
+			swords = append(swords, goalone.New([]byte(secret), goalone.Timestamp))
+		}
+		return swords, nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	sword, ok := k.swords[keyID]
+	if !ok && time.Since(k.loaded) > keyringRetry {
+		if err := k.load(); err != nil {
+			return nil, err
+		}
+		sword, ok = k.swords[keyID]
+	}
+	if !ok {
+		return nil, nil
+	}
+	return []*goalone.Sword{sword}, nil
+}
+
+// load rereads the active keys; k.mu must be held.
+func (k *Keyring) load() error {
+	keys, err := k.Store.Active()
+	if err != nil {
+		return fmt.Errorf("loading signing keys: %w", err)
+	}
+
+	k.current = ""
+	k.swords = make(map[string]*goalone.Sword, len(keys))
+	for i, key := range keys {
+		if i == 0 {
+			k.current = key.KeyID
+		}
+		k.swords[key.KeyID] = goalone.New([]byte(key.Secret), goalone.Timestamp)
+	}
+	k.loaded = time.Now()
+
+	return nil
+}
+
+// rotateSigningKey makes a new current key, keeping keep keys before it,
+// and returns its ID.
+func rotateSigningKey(store data.SigningKeyType, keep int) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("making signing key: %w", err)
+	}
+
+	key := data.SigningKey{
+		KeyID:  newID(),
+		Secret: hex.EncodeToString(secret),
+	}
+
+	if err := store.Rotate(key, keep); err != nil {
+		return "", fmt.Errorf("rotating signing key: %w", err)
+	}
+	return key.KeyID, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// newLogger builds the app's logger: JSON for production, text for
+// reading in a terminal.
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// requestTag identifies the request, and the user making it, that work
+// is being done for.
+type requestTag struct {
+	RequestID string
+	UserID    int
+}
+
+type requestTagKey struct{}
+
+// tagFromContext returns the request tag stored by RequestLogger, if any.
+func tagFromContext(ctx context.Context) requestTag {
+	tag, _ := ctx.Value(requestTagKey{}).(requestTag)
+	return tag
+}
+
+// withRequestTag returns a copy of ctx carrying tag.
+func withRequestTag(ctx context.Context, tag requestTag) context.Context {
+	return context.WithValue(ctx, requestTagKey{}, tag)
+}
+
+// attrs returns the log attributes for the tag, leaving out empty ones.
+func (t requestTag) attrs() []any {
+	var attrs []any
+	if t.RequestID != "" {
+		attrs = append(attrs, "request_id", t.RequestID)
+	}
+	if t.UserID != 0 {
+		attrs = append(attrs, "user_id", t.UserID)
+	}
+	return attrs
+}
+
+// logger returns the app logger, tagged with the request and user in ctx.
+func (app *Config) logger(ctx context.Context) *slog.Logger {
+	return app.Log.With(tagFromContext(ctx).attrs()...)
+}
+
+// RequestLogger gives every request an ID, taken from X-Request-ID if the
+// proxy in front of us set one, and logs the request once it is done.
+// Use after AddSessionToRequest, so the user is known.
+func (app *Config) RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = newID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		tag := requestTag{
+			RequestID: id,
+			UserID:    app.Session.GetInt(r.Context(), "userID"),
+		}
+		r = r.WithContext(withRequestTag(r.Context(), tag))
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		app.logger(r.Context()).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", ww.Status(),
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// newID returns a random ID for a request or a message.
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
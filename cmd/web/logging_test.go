@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfig_RequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	app := testApp
+	app.Log = newLogger(&buf, "json", slog.LevelInfo)
+
+	var tag requestTag
+	handler := app.Session.LoadAndSave(app.RequestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tag = tagFromContext(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	})))
+
+	// a request ID from the proxy is kept
+	req, _ := http.NewRequest("GET", "/teapot", nil)
+	req.Header.Set("X-Request-ID", "abc123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if tag.RequestID != "abc123" {
+		t.Errorf("expected request ID abc123 in the context, got %q", tag.RequestID)
+	}
+
+	if got := rr.Header().Get("X-Request-ID"); got != "abc123" {
+		t.Errorf("expected request ID abc123 in the response, got %q", got)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one JSON log line, got %q: %v", buf.String(), err)
+	}
+
+	if entry["request_id"] != "abc123" || entry["path"] != "/teapot" || entry["status"] != float64(http.StatusTeapot) {
+		t.Errorf("unexpected log entry %v", entry)
+	}
+
+	// otherwise, one is made up
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/teapot", nil))
+
+	if rr.Header().Get("X-Request-ID") == "" || tag.RequestID == "" {
+		t.Error("expected a new request ID")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	htmlTmpl "html/template"
+	"io/fs"
+	"sort"
+	"strings"
+	plainTmpl "text/template"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/vanng822/css"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// every template the app sends mail with; startup fails without them
+var requiredMailTemplates = []string{"mail", "invoice", "dunning", "confirmation-email", "password-reset", "error-digest"}
+
+// mailTemplate is one email template: the HTML part, the stylesheet to
+// inline into what it renders, and the plain text part.
+type mailTemplate struct {
+	html  *htmlTmpl.Template
+	css   *stylesheet
+	plain *plainTmpl.Template
+}
+
+// MailTemplates holds the email templates, parsed once at startup. In Dev
+// mode templates are re-read every time they are used, so with TEMPLATE_DIR
+// set they can be edited without a restart.
+type MailTemplates struct {
+	FS        fs.FS
+	Dev       bool
+	templates map[string]*mailTemplate
+}
+
+// NewMailTemplates parses the named templates from fsys. It fails if any of
+// them is missing or does not parse.
+func NewMailTemplates(fsys fs.FS, dev bool, names ...string) (*MailTemplates, error) {
+	mt := &MailTemplates{
+		FS:        fsys,
+		Dev:       dev,
+		templates: make(map[string]*mailTemplate),
+	}
+
+	for _, name := range names {
+		t, err := mt.parse(name)
+		if err != nil {
+			return nil, err
+		}
+		mt.templates[name] = t
+	}
+
+	return mt, nil
+}
+
+// get returns the named template, parsing it if it was not loaded at
+// startup or if we are in Dev mode.
+func (mt *MailTemplates) get(name string) (*mailTemplate, error) {
+	if t, ok := mt.templates[name]; ok && !mt.Dev {
+		return t, nil
+	}
+
+	return mt.parse(name)
+}
+
+func (mt *MailTemplates) parse(name string) (*mailTemplate, error) {
+	htmlFile := fmt.Sprintf("%s.html.gohtml", name)
+	plainFile := fmt.Sprintf("%s.plain.gohtml", name)
+
+	for _, f := range []string{htmlFile, plainFile} {
+		if _, err := fs.Stat(mt.FS, f); err != nil {
+			return nil, fmt.Errorf("mail template %q: %w", name, err)
+		}
+	}
+
+	html, err := htmlTmpl.New("email-html").ParseFS(mt.FS, htmlFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if html.Lookup("body") == nil {
+		return nil, fmt.Errorf("mail template %q has no body", htmlFile)
+	}
+
+	// the CSS is inlined into each message, once it is rendered, but it
+	// only needs reading once
+	source, err := fs.ReadFile(mt.FS, htmlFile)
+	if err != nil {
+		return nil, err
+	}
+
+	sheet, err := parseStylesheet(string(source))
+	if err != nil {
+		return nil, fmt.Errorf("mail template %q: %w", htmlFile, err)
+	}
+
+	plain, err := plainTmpl.New("email-plain").ParseFS(mt.FS, plainFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mailTemplate{html: html, css: sheet, plain: plain}, nil
+}
+
+// stylesheet is the CSS in a mail template's <style> elements, parsed when
+// the template is loaded. Many mail clients ignore <style>, so each rule is
+// copied onto the elements it matches in the rendered message. What can't
+// be, such as @import, @media or :hover, is left in a <style> in the head.
+type stylesheet struct {
+	// least specific first, so the most specific is applied last
+	rules    []inlineRule
+	leftover []string
+}
+
+// inlineRule is one selector of a rule, with its declarations as they go
+// in a style attribute.
+type inlineRule struct {
+	sel       cascadia.Sel
+	important bool
+	decls     []string
+}
+
+var (
+	styleElement = cascadia.MustCompile("style")
+	headElement  = cascadia.MustCompile("head")
+)
+
+// parseStylesheet reads the CSS in the <style> elements of source.
+func parseStylesheet(source string) (*stylesheet, error) {
+	doc, err := html.Parse(strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &stylesheet{}
+	for _, n := range styleElement.MatchAll(doc) {
+		if n.FirstChild == nil {
+			continue
+		}
+		for _, rule := range css.Parse(n.FirstChild.Data).GetCSSRuleList() {
+			s.add(rule)
+		}
+	}
+
+	// !important beats specificity; a later rule beats an earlier one
+	// just as specific
+	sort.SliceStable(s.rules, func(i, j int) bool {
+		a, b := s.rules[i], s.rules[j]
+		if a.important != b.important {
+			return b.important
+		}
+		return a.sel.Specificity().Less(b.sel.Specificity())
+	})
+
+	return s, nil
+}
+
+func (s *stylesheet) add(rule *css.CSSRule) {
+	if rule.Type != css.STYLE_RULE {
+		s.leftover = append(s.leftover, cssText(rule))
+		return
+	}
+
+	var normal, important []string
+	for _, decl := range rule.Style.Styles {
+		if decl.Important {
+			important = append(important, decl.Property+":"+decl.Value.Text()+" !important")
+		} else {
+			normal = append(normal, decl.Property+":"+decl.Value.Text())
+		}
+	}
+
+	for _, selector := range strings.Split(rule.Style.Selector.Text(), ",") {
+		selector = strings.TrimSpace(selector)
+
+		// cascadia doesn't know the selectors that depend on the
+		// reader, such as :hover; they can only be left in <style>
+		sel, err := cascadia.Parse(selector)
+		if err != nil {
+			one := css.CSSStyleRule{Selector: css.NewCSSValue(selector), Styles: rule.Style.Styles}
+			s.leftover = append(s.leftover, one.Text())
+			continue
+		}
+
+		if len(normal) > 0 {
+			s.rules = append(s.rules, inlineRule{sel: sel, decls: normal})
+		}
+		if len(important) > 0 {
+			s.rules = append(s.rules, inlineRule{sel: sel, important: true, decls: important})
+		}
+	}
+}
+
+// cssText writes a rule that can't be inlined back out as CSS.
+func cssText(rule *css.CSSRule) string {
+	var selector string
+	if rule.Style.Selector != nil {
+		selector = rule.Style.Selector.Text()
+	}
+
+	switch rule.Type {
+	case css.STYLE_RULE:
+		return rule.Style.Text()
+	case css.CHARSET_RULE, css.IMPORT_RULE:
+		return fmt.Sprintf("%s %s;", rule.Type.Text(), selector)
+	}
+
+	var body []string
+	for _, inner := range rule.Rules {
+		body = append(body, cssText(inner))
+	}
+	for _, decl := range rule.Style.Styles {
+		body = append(body, decl.Text()+";")
+	}
+	return fmt.Sprintf("%s %s {\n%s\n}", rule.Type.Text(), selector, strings.Join(body, "\n"))
+}
+
+// inline copies the stylesheet onto the elements of a rendered message,
+// in place of its <style> elements.
+func (s *stylesheet) inline(message string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(message))
+	if err != nil {
+		return "", err
+	}
+
+	for _, n := range styleElement.MatchAll(doc) {
+		n.Parent.RemoveChild(n)
+	}
+
+	styles := make(map[*html.Node][]string)
+	for _, rule := range s.rules {
+		for _, n := range cascadia.QueryAll(doc, rule.sel) {
+			styles[n] = append(styles[n], rule.decls...)
+		}
+	}
+
+	for n, decls := range styles {
+		setStyle(n, decls)
+	}
+
+	if head := headElement.MatchFirst(doc); head != nil && len(s.leftover) > 0 {
+		style := &html.Node{
+			Type:     html.ElementNode,
+			Data:     "style",
+			DataAtom: atom.Style,
+			Attr:     []html.Attribute{{Key: "type", Val: "text/css"}},
+		}
+		style.AppendChild(&html.Node{Type: html.TextNode, Data: strings.Join(s.leftover, "\n")})
+		head.AppendChild(style)
+	}
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// setStyle gives n the declarations in its style attribute, ahead of the
+// ones it already had there, so those still win.
+func setStyle(n *html.Node, decls []string) {
+	for i, a := range n.Attr {
+		if a.Key == "style" {
+			n.Attr[i].Val = strings.Join(append(decls, a.Val), ";")
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: "style", Val: strings.Join(decls, ";")})
+}
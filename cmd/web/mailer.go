@@ -2,33 +2,99 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"final-project/data"
 	"fmt"
-	htmlTmpl "html/template"
+	"log/slog"
+	"math/rand"
 	"sync"
-	plainTmpl "text/template"
+	"sync/atomic"
 
 	"time"
-
-	"github.com/vanng822/go-premailer/premailer"
-	mail "github.com/xhit/go-simple-mail/v2"
 )
 
 // Define our mail server
 type Mail struct {
 	Domain      string
-	Host        string
-	Port        int
-	Username    string
-	Password    string
 	FromAddress string
 	FromName    string
-	Encryption  string
+	Transport   MailTransport
+	Templates   *MailTemplates
+	Workers     int
+	MaxAttempts int
+	RetryBase   time.Duration
+	RetryMax    time.Duration
+	DeadLetters data.DeadLetterType
+	Outbox      data.OutboxType
+	OutboxLease time.Duration
+	SweepEvery  time.Duration
+	Metrics     *MailMetrics
+	Log         *slog.Logger
 	Wait        *sync.WaitGroup
 	MailerChan  chan Message
-	ErrorChan   chan error
+	ErrorChan   chan ErrorEvent
 	DoneChan    chan bool
+
+	// lifecycle; see start and Close
+	mu        sync.RWMutex
+	closed    bool
+	closing   chan struct{}
+	senders   sync.WaitGroup
+	workers   sync.WaitGroup
+	stopSweep chan struct{}
+	sweepDone chan struct{}
+	sweepOnce sync.Once
+	abort     chan struct{}
+}
+
+// MailMetrics holds the counters for the mail worker pool. Every worker
+// writes to these, so they are only touched through sync/atomic.
+type MailMetrics struct {
+	inFlight  int64
+	sent      int64
+	retried   int64
+	failed    int64
+	persisted int64
+	dropped   int64
+}
+
+// MailStats is a point-in-time snapshot of the mailer.
+type MailStats struct {
+	Workers  int
+	Queued   int
+	InFlight int64
+	Sent     int64
+	Retried  int64
+	Failed   int64
+}
+
+// MailShutdownReport says what became of the mail when the mailer closed.
+type MailShutdownReport struct {
+	// sent, or given up on and dead-lettered, during this run
+	Delivered int64
+	Failed    int64
+	// left in the outbox for the next start, or lost altogether
+	Persisted int64
+	Dropped   int64
+	// still sending when the deadline passed
+	InFlight int64
 }
 
+// permanentError marks a failure that retrying cannot fix, such as a
+// missing template.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// errMailAborted is returned by deliver when the mailer gave up waiting to
+// retry at shutdown; the message is shelved, not dead-lettered.
+var errMailAborted = errors.New("mailer closed before mail could be retried")
+
 type Message struct {
 	From        string
 	FromName    string
@@ -37,29 +103,332 @@ type Message struct {
 	Attachments []string
 	// allow attaching on a different name than file
 	AttachmentMap map[string]string
-	Data          any
-	DataMap       map[string]any
-	Template      string
+	// attachment name -> contents, for files made for this message; they
+	// travel with it, so it can be sent from the outbox on any instance
+	Files    map[string][]byte
+	Data     any
+	DataMap  map[string]any
+	Template string
+	// identify the message, and the request and user it was sent for
+	ID        string
+	RequestID string
+	UserID    int
+	// row in the mail outbox, if the message was persisted
+	OutboxID int `json:"-"`
+}
+
+// logAttrs returns the attributes that identify msg in the logs.
+func (msg Message) logAttrs() []any {
+	attrs := []any{"message_id", msg.ID, "to", msg.To}
+	attrs = append(attrs, requestTag{RequestID: msg.RequestID, UserID: msg.UserID}.attrs()...)
+	if msg.OutboxID != 0 {
+		attrs = append(attrs, "outbox_id", msg.OutboxID)
+	}
+	return attrs
 }
 
 func (app *Config) listenForMail() {
 	for {
 		select {
-		case msg := <-app.Mailer.MailerChan:
-			// spin off a mailer
-			go app.Mailer.sendMail(msg, app.Mailer.ErrorChan)
-		case err := <-app.Mailer.ErrorChan:
-			// might want more here than just an error message!
-			app.ErrorLog.Println(err)
+		case ev := <-app.Mailer.ErrorChan:
+			app.Errors.Route(ev)
 		case <-app.Mailer.DoneChan:
 			return // stop the goroutine I want to get off.
 		}
 	}
 }
 
-func (m *Mail) sendMail(msg Message, errorChan chan error) {
-	defer m.Wait.Done()
+// start launches the worker pool and the outbox sweeper. A fixed pool of
+// workers drains the queue, so a burst of mail never opens more than
+// Workers connections to the SMTP server.
+func (m *Mail) start() {
+	m.abort = make(chan struct{})
+	m.closing = make(chan struct{})
+	m.stopSweep = make(chan struct{})
+	m.sweepDone = make(chan struct{})
+
+	for i := 0; i < m.Workers; i++ {
+		m.workers.Add(1)
+		go m.mailWorker()
+	}
+
+	if m.Outbox != nil {
+		go func() {
+			defer close(m.sweepDone)
+			m.sweepOutbox(m.stopSweep)
+		}()
+	} else {
+		close(m.sweepDone)
+	}
+}
+
+// queue hands msg to the workers. If the queue is full it waits for
+// room, but only until ctx is done or the mailer starts closing; then the
+// message is shelved, and if it is in the outbox it goes out from there.
+// The lock is only held to check for and register the send, never while
+// waiting, so Close is never held up by a full queue.
+func (m *Mail) queue(ctx context.Context, msg Message) {
+	m.mu.RLock()
+	if m.closed {
+		m.mu.RUnlock()
+		m.shelve(msg)
+		return
+	}
+	m.senders.Add(1)
+	m.mu.RUnlock()
+	defer m.senders.Done()
+
+	m.Wait.Add(1)
+	select {
+	case m.MailerChan <- msg:
+		return
+	case <-ctx.Done():
+	case <-m.closing:
+	}
+	m.Wait.Done()
+	m.shelve(msg)
+}
+
+// StopSweeping stops the outbox sweeper, and waits for it to finish
+// queueing anything it already claimed.
+func (m *Mail) StopSweeping() {
+	m.sweepOnce.Do(func() {
+		close(m.stopSweep)
+	})
+	<-m.sweepDone
+}
+
+// Close stops accepting mail and sends what is already queued, until ctx
+// is done. Whatever is left then stays in the outbox for the next start.
+// Mail being sent when the deadline passes is left to finish on its own.
+func (m *Mail) Close(ctx context.Context) MailShutdownReport {
+	m.StopSweeping()
+
+	// no new sends once closed is set; the ones already waiting for room
+	// give up when closing is closed, and once they have all returned
+	// nobody can be sending on the channel.
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.closing)
+	}
+	m.mu.Unlock()
+	m.senders.Wait()
+	close(m.MailerChan)
+
+	drained := make(chan struct{})
+	go func() {
+		m.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		// out of time: workers shelve rather than send from here on, and
+		// we shelve whatever they haven't picked up yet.
+		close(m.abort)
+		for msg := range m.MailerChan {
+			m.shelve(msg)
+			m.Wait.Done()
+		}
+	}
+
+	return MailShutdownReport{
+		Delivered: atomic.LoadInt64(&m.Metrics.sent),
+		Failed:    atomic.LoadInt64(&m.Metrics.failed),
+		Persisted: atomic.LoadInt64(&m.Metrics.persisted),
+		Dropped:   atomic.LoadInt64(&m.Metrics.dropped),
+		InFlight:  atomic.LoadInt64(&m.Metrics.inFlight),
+	}
+}
+
+// shelve sets aside a message we won't send in this run. If it is in the
+// outbox its claim is released, so any instance can pick it up straight
+// away; if it never made it to the outbox, it is lost.
+func (m *Mail) shelve(msg Message) {
+	if msg.OutboxID == 0 || m.Outbox == nil {
+		atomic.AddInt64(&m.Metrics.dropped, 1)
+		m.logger().Warn("mailer closed, dropping mail", append(msg.logAttrs(), "subject", msg.Subject)...)
+		return
+	}
+
+	atomic.AddInt64(&m.Metrics.persisted, 1)
+	if err := m.Outbox.Release(msg.OutboxID); err != nil {
+		// the claim will lapse on its own; it just takes longer
+		m.logger().Error("could not release outbox mail", append(msg.logAttrs(), "error", err)...)
+	}
+}
+
+// report passes the failure to the listener. Past the shutdown deadline
+// there may be no listener, so it is logged directly instead.
+func (m *Mail) report(msg Message, severity Severity, err error, payload map[string]any) {
+	if payload == nil {
+		payload = make(map[string]any)
+	}
+	payload["message_id"] = msg.ID
+	payload["to"] = msg.To
+	if msg.OutboxID != 0 {
+		payload["outbox_id"] = msg.OutboxID
+	}
+
+	ev := ErrorEvent{
+		Source:    "mail",
+		Severity:  severity,
+		UserID:    msg.UserID,
+		RequestID: msg.RequestID,
+		Err:       err,
+		Payload:   payload,
+		Time:      time.Now(),
+	}
+
+	select {
+	case m.ErrorChan <- ev:
+	case <-m.abort:
+		m.logger().Log(context.Background(), severity.level(), "mail failed", ev.logAttrs()...)
+	}
+}
+
+// logger returns the mailer's logger, or the default one if it has none.
+func (m *Mail) logger() *slog.Logger {
+	if m.Log == nil {
+		return slog.Default()
+	}
+	return m.Log
+}
+
+// mailWorker sends messages until MailerChan is closed.
+func (m *Mail) mailWorker() {
+	defer m.workers.Done()
+
+	for msg := range m.MailerChan {
+		select {
+		case <-m.abort:
+			m.shelve(msg)
+			m.Wait.Done()
+			continue
+		default:
+		}
+
+		atomic.AddInt64(&m.Metrics.inFlight, 1)
+		attempts, err := m.deliver(msg)
 
+		if errors.Is(err, errMailAborted) {
+			atomic.AddInt64(&m.Metrics.inFlight, -1)
+			m.shelve(msg)
+			m.Wait.Done()
+			continue
+		}
+
+		if err != nil {
+			atomic.AddInt64(&m.Metrics.failed, 1)
+			m.report(msg, SeverityError,
+				fmt.Errorf("mail to %s failed after %d attempt(s): %w", msg.To, attempts, err),
+				map[string]any{"attempts": attempts, "template": msg.Template},
+			)
+
+			if dlErr := m.deadLetter(msg, attempts, err); dlErr != nil {
+				// the mail is lost for good
+				m.report(msg, SeverityCritical, fmt.Errorf("could not dead-letter mail to %s: %w", msg.To, dlErr), nil)
+			}
+		} else {
+			atomic.AddInt64(&m.Metrics.sent, 1)
+		}
+		atomic.AddInt64(&m.Metrics.inFlight, -1)
+
+		if obErr := m.settleOutbox(msg, err); obErr != nil {
+			m.report(msg, SeverityWarning, fmt.Errorf("could not update outbox for mail to %s: %w", msg.To, obErr), nil)
+		}
+
+		// only release the message once any error has been reported,
+		// so shutdown cannot stop the listener out from under us.
+		m.Wait.Done()
+	}
+}
+
+// Stats reports the current queue depth and worker activity.
+func (m *Mail) Stats() MailStats {
+	return MailStats{
+		Workers:  m.Workers,
+		Queued:   len(m.MailerChan),
+		InFlight: atomic.LoadInt64(&m.Metrics.inFlight),
+		Sent:     atomic.LoadInt64(&m.Metrics.sent),
+		Retried:  atomic.LoadInt64(&m.Metrics.retried),
+		Failed:   atomic.LoadInt64(&m.Metrics.failed),
+	}
+}
+
+// deliver tries to send msg up to MaxAttempts times, backing off between
+// attempts. It returns the number of attempts made and the last error, or
+// errMailAborted if the shutdown deadline passed while it was backing off.
+func (m *Mail) deliver(msg Message) (int, error) {
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		err = m.sendMail(msg)
+		if err == nil {
+			return attempt, nil
+		}
+
+		var permErr *permanentError
+		if errors.As(err, &permErr) || attempt >= m.MaxAttempts {
+			return attempt, err
+		}
+
+		atomic.AddInt64(&m.Metrics.retried, 1)
+		timer := time.NewTimer(backoff(attempt, m.RetryBase, m.RetryMax))
+		select {
+		case <-timer.C:
+		case <-m.abort:
+			timer.Stop()
+			return attempt, errMailAborted
+		}
+	}
+}
+
+// backoff returns how long to wait after a failed attempt: the delay
+// doubles with each attempt up to max, and half of it is randomized so
+// that workers failing together don't all retry together.
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// deadLetter stores a message we gave up on, so it can be inspected
+// and replayed later.
+func (m *Mail) deadLetter(msg Message, attempts int, cause error) error {
+	if m.DeadLetters == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.DeadLetters.Insert(data.DeadLetter{
+		Recipient: msg.To,
+		Subject:   msg.Subject,
+		Template:  msg.Template,
+		Payload:   payload,
+		LastError: cause.Error(),
+		Attempts:  attempts,
+	})
+	return err
+}
+
+func (m *Mail) sendMail(msg Message) error {
 	if msg.Template == "" {
 		msg.Template = "mail"
 	}
@@ -89,119 +458,53 @@ func (m *Mail) sendMail(msg Message, errorChan chan error) {
 
 	formattedMessage, err := m.buildHTMLMessage(msg)
 	if err != nil {
-		errorChan <- err
+		return &permanentError{err}
 	}
 
 	plainMessage, err := m.buildTextMessage(msg)
 	if err != nil {
-		errorChan <- err
-	}
-
-	server := mail.NewSMTPClient()
-	server.Host = m.Host
-	server.Port = m.Port
-	server.Username = m.Username
-	server.Password = m.Password
-	server.Encryption = m.getEncryption(m.Encryption)
-	server.KeepAlive = false
-	server.ConnectTimeout = 10 * time.Second
-
-	smtpClient, err := server.Connect()
-	if err != nil {
-		errorChan <- err
-	}
-
-	email := mail.NewMSG()
-	email.SetFrom(msg.From).
-		AddTo(msg.To).
-		SetSubject(msg.Subject).
-		SetBody(mail.TextPlain, plainMessage).
-		AddAlternative(mail.TextHTML, formattedMessage)
-
-	if len(msg.AttachmentMap) > 0 {
-		for fname, atmt := range msg.AttachmentMap {
-			email.AddAttachment(atmt, fname)
-		}
-	}
-
-	err = email.Send(smtpClient)
-	if err != nil {
-		errorChan <- err
+		return &permanentError{err}
 	}
 
+	return m.Transport.Send(Envelope{
+		From:        msg.From,
+		To:          msg.To,
+		Subject:     msg.Subject,
+		PlainBody:   plainMessage,
+		HTMLBody:    formattedMessage,
+		Attachments: msg.AttachmentMap,
+		Files:       msg.Files,
+	})
 }
 
 func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
-	templateToRender := fmt.Sprintf("./cmd/web/templates/%s.html.gohtml", msg.Template)
-
-	t, err := htmlTmpl.New("email-html").ParseFiles(templateToRender)
+	t, err := m.Templates.get(msg.Template)
 	if err != nil {
 		return "", err
 	}
 
 	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
+	if err = t.html.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
 		return "", err
 	}
 
-	formattedMsg := tpl.String()
-
-	html, err := m.inlineCSS(formattedMsg)
-	if err != nil {
-		return "", err
-	}
-
-	return html, nil
+	return t.css.inline(tpl.String())
 }
 
 func (m *Mail) buildTextMessage(msg Message) (string, error) {
 	if msg.Template == "" {
 		msg.Template = "mail"
 	}
-	templateToRender := fmt.Sprintf("./cmd/web/templates/%s.plain.gohtml", msg.Template)
 
-	t, err := plainTmpl.New("email-plain").ParseFiles(templateToRender)
+	t, err := m.Templates.get(msg.Template)
 	if err != nil {
 		return "", err
 	}
 
 	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
+	if err = t.plain.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
 		return "", err
 	}
 
 	return tpl.String(), nil
 }
-
-func (m *Mail) inlineCSS(s string) (string, error) {
-	options := premailer.Options{
-		RemoveClasses:     false,
-		CssToAttributes:   false,
-		KeepBangImportant: true,
-	}
-
-	prem, err := premailer.NewPremailerFromString(s, &options)
-	if err != nil {
-		return "", err
-	}
-
-	html, err := prem.Transform()
-	if err != nil {
-		return "", err
-	}
-
-	return html, nil
-}
-
-func (m *Mail) getEncryption(e string) mail.Encryption {
-	switch e {
-	case "tls":
-		return mail.EncryptionSTARTTLS
-	case "ssl":
-		return mail.EncryptionSSLTLS
-	case "none":
-		return mail.Encryption(mail.EncryptionNone)
-	default:
-		return mail.EncryptionSTARTTLS
-	}
-}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"final-project/data"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMail_Stats(t *testing.T) {
+	m := Mail{
+		Workers:    3,
+		Metrics:    &MailMetrics{},
+		MailerChan: make(chan Message, 10),
+	}
+
+	m.MailerChan <- Message{To: "one@here.com"}
+	m.MailerChan <- Message{To: "two@here.com"}
+
+	stats := m.Stats()
+	if stats.Queued != 2 {
+		t.Errorf("expected queue depth of 2, got %d", stats.Queued)
+	}
+
+	if stats.Workers != 3 {
+		t.Errorf("expected 3 workers, got %d", stats.Workers)
+	}
+
+	if stats.InFlight != 0 {
+		t.Errorf("expected nothing in flight, got %d", stats.InFlight)
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	base := time.Second
+	max := 10 * time.Second
+
+	var tests = []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, max},
+		{50, max},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			d := backoff(tt.attempt, base, max)
+			if d < tt.ceiling/2 || d > tt.ceiling {
+				t.Errorf("attempt %d: expected between %s and %s, got %s", tt.attempt, tt.ceiling/2, tt.ceiling, d)
+			}
+		}
+	}
+}
+
+// claimOnceOutbox hands out its rows on the first claim only.
+type claimOnceOutbox struct {
+	data.OutboxTest
+	rows []*data.OutboxMessage
+}
+
+func (o *claimOnceOutbox) Claim(limit int, lease time.Duration) ([]*data.OutboxMessage, error) {
+	rows := o.rows
+	o.rows = nil
+	return rows, nil
+}
+
+func TestMail_claimOutbox(t *testing.T) {
+	m := Mail{
+		Outbox: &claimOnceOutbox{
+			rows: []*data.OutboxMessage{
+				{ID: 7, Payload: []byte(`{"To":"left@over.com","Subject":"From before the restart"}`)},
+			},
+		},
+		Wait:       &sync.WaitGroup{},
+		MailerChan: make(chan Message, 10),
+	}
+
+	err := m.claimOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.MailerChan) != 1 {
+		t.Fatalf("expected 1 message queued, got %d", len(m.MailerChan))
+	}
+
+	msg := <-m.MailerChan
+	if msg.OutboxID != 7 || msg.To != "left@over.com" {
+		t.Errorf("expected outbox row 7 to left@over.com, got %d to %s", msg.OutboxID, msg.To)
+	}
+}
+
+func TestNewMailTemplates(t *testing.T) {
+	_, err := NewMailTemplates(templateFS, false, "mail", "no-such-template")
+	if err == nil {
+		t.Error("expected startup to fail on a missing template")
+	}
+
+	mt, err := NewMailTemplates(templateFS, false, "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := Mail{Templates: mt}
+	html, err := m.buildHTMLMessage(Message{
+		Template: "mail",
+		DataMap:  map[string]any{"message": "Where you was?"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(html, "Where you was?") {
+		t.Error("expected the message in the rendered mail")
+	}
+
+	if !strings.Contains(html, `style="font-family:`) {
+		t.Error("expected the CSS to be inlined into the rendered mail")
+	}
+}
+
+func Test_stylesheet(t *testing.T) {
+	sheet, err := parseStylesheet(`<html><head><style>
+		td { padding: 2px; }
+		.amount { text-align: right; }
+		td.amount { color: red; }
+		a:hover { color: blue; }
+	</style></head><body></body></html>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows rendered in a loop stay in their table, and get their styles
+	html, err := sheet.inline(`<html><head><style>td { color: green; }</style></head><body><table>
+		<tr><td class="amount" style="font-weight: bold">1</td></tr>
+		<tr><td class="amount">2</td></tr>
+	</table></body></html>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`<td class="amount" style="padding:2px;text-align:right;color:red;font-weight: bold">1</td>`,
+		`<td class="amount" style="padding:2px;text-align:right;color:red">2</td>`,
+		"a:hover {",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("expected %s in %s", want, html)
+		}
+	}
+
+	// the message's own <style> was read with the template, not now
+	if strings.Contains(html, "green") {
+		t.Errorf("expected the rendered <style> to be replaced, got %s", html)
+	}
+}
+
+// countingOutbox hands out a fresh ID for every message, and counts the
+// claims given back.
+type countingOutbox struct {
+	data.OutboxTest
+	lastID   int64
+	released int64
+}
+
+func (o *countingOutbox) Enqueue(payload []byte, lease time.Duration) (int, error) {
+	return int(atomic.AddInt64(&o.lastID, 1)), nil
+}
+
+func (o *countingOutbox) Release(id int) error {
+	atomic.AddInt64(&o.released, 1)
+	return nil
+}
+
+// slowTransport takes a while over every message.
+type slowTransport struct {
+	MemoryTransport
+	delay time.Duration
+}
+
+func (t *slowTransport) Send(env Envelope) error {
+	time.Sleep(t.delay)
+	return t.MemoryTransport.Send(env)
+}
+
+// Run with -race: mail is queued from many goroutines while the mailer
+// closes, and every message must be accounted for.
+func TestMail_Close(t *testing.T) {
+	outbox := &countingOutbox{}
+	m := &Mail{
+		Transport:   &slowTransport{delay: 20 * time.Millisecond},
+		Templates:   testApp.Mailer.Templates,
+		Workers:     3,
+		Outbox:      outbox,
+		OutboxLease: time.Minute,
+		SweepEvery:  time.Minute,
+		Metrics:     &MailMetrics{},
+		Wait:        &sync.WaitGroup{},
+		MailerChan:  make(chan Message, 5),
+		ErrorChan:   make(chan ErrorEvent),
+		DoneChan:    make(chan bool),
+	}
+	m.start()
+
+	listenerDone := make(chan struct{})
+	defer close(listenerDone)
+	go func() {
+		for {
+			select {
+			case <-m.ErrorChan:
+			case <-listenerDone:
+				return
+			}
+		}
+	}()
+
+	const total = 100
+	var senders sync.WaitGroup
+	for i := 0; i < total; i++ {
+		senders.Add(1)
+		go func(i int) {
+			defer senders.Done()
+
+			msg := Message{To: fmt.Sprintf("user%d@here.com", i), Subject: "Hello"}
+			// only half of the mail makes it into the outbox
+			if i%2 == 0 {
+				_ = m.persist(&msg)
+			}
+			m.queue(context.Background(), msg)
+		}(i)
+	}
+
+	// let some mail go out, then close with a short deadline
+	time.Sleep(30 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	closed := make(chan MailShutdownReport, 1)
+	go func() {
+		closed <- m.Close(ctx)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return; deadlock?")
+	}
+
+	// mail queued after Close is shelved, and sends in progress finish
+	senders.Wait()
+	m.workers.Wait()
+
+	stats := m.Stats()
+	persisted := atomic.LoadInt64(&m.Metrics.persisted)
+	dropped := atomic.LoadInt64(&m.Metrics.dropped)
+
+	if got := stats.Sent + stats.Failed + persisted + dropped; got != total {
+		t.Errorf("expected all %d messages accounted for, got %d (%d sent, %d failed, %d persisted, %d dropped)",
+			total, got, stats.Sent, stats.Failed, persisted, dropped)
+	}
+
+	if stats.Sent == 0 {
+		t.Error("expected some mail to be delivered before the deadline")
+	}
+
+	if persisted+dropped == 0 {
+		t.Error("expected some mail to be left over after the deadline")
+	}
+
+	if released := atomic.LoadInt64(&outbox.released); released != persisted {
+		t.Errorf("expected %d outbox claims released, got %d", persisted, released)
+	}
+}
+
+// A worker backing off from a failed send, and a sender waiting for room
+// in a full queue, must neither hold up Close past its deadline.
+func TestMail_Close_backingOff(t *testing.T) {
+	outbox := &countingOutbox{}
+	m := &Mail{
+		Transport:   &flakyTransport{failures: 100},
+		Templates:   testApp.Mailer.Templates,
+		Workers:     1,
+		MaxAttempts: 5,
+		RetryBase:   time.Hour,
+		RetryMax:    time.Hour,
+		Outbox:      outbox,
+		OutboxLease: time.Minute,
+		SweepEvery:  time.Hour,
+		Metrics:     &MailMetrics{},
+		Wait:        &sync.WaitGroup{},
+		MailerChan:  make(chan Message, 1),
+		ErrorChan:   make(chan ErrorEvent),
+		DoneChan:    make(chan bool),
+	}
+	m.start()
+
+	const total = 3
+	queued := make(chan struct{})
+	go func() {
+		defer close(queued)
+		for i := 0; i < total; i++ {
+			msg := Message{To: fmt.Sprintf("user%d@here.com", i), Subject: "Hello"}
+			_ = m.persist(&msg)
+			m.queue(context.Background(), msg)
+		}
+	}()
+
+	// one message backing off in the worker, one in the queue, and one
+	// waiting for room
+	time.Sleep(30 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	closed := make(chan MailShutdownReport, 1)
+	go func() {
+		closed <- m.Close(ctx)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return; deadlock?")
+	}
+
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue did not return after Close")
+	}
+	m.workers.Wait()
+	m.Wait.Wait()
+
+	if failed := atomic.LoadInt64(&m.Metrics.failed); failed != 0 {
+		t.Errorf("expected nothing dead-lettered, got %d", failed)
+	}
+
+	if released := atomic.LoadInt64(&outbox.released); released != total {
+		t.Errorf("expected %d outbox claims released, got %d", total, released)
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/gob"
+	"errors"
 	"final-project/data"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,71 +27,155 @@ import (
 	_ "github.com/jackc/pgx/v4/stdlib"
 )
 
-const webPort = "8080"
-
 var app *Config
 
 func main() {
+	configFile := flag.String("config", "", "optional KEY=VALUE config file; environment variables win")
+	rotateKey := flag.Bool("rotate-link-key", false, "make a new key to sign mail links with, and exit")
+	flag.Parse()
+
+	// read and check every setting before starting anything
+	settings, err := loadSettings(os.LookupEnv, *configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// everything logs through slog, including the standard log package
+	logger := newLogger(os.Stdout, settings.LogFormat, settings.LogLevel)
+	slog.SetDefault(logger)
+
+	// read templates from disk if asked to
+	useAssetDirs(settings.TemplateDir, settings.PDFDir)
+
+	// the root context is cancelled on SIGINT or SIGTERM, which starts
+	// the shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// connect to the database
-	conn := initDB()
+	conn := initDB(settings.DSN, logger)
+
+	// an admin rotating the link signing key; the running instances pick
+	// the new key up within a minute
+	if *rotateKey {
+		keyID, err := rotateSigningKey(data.New(conn, logger).SigningKey, settings.Links.KeepKeys)
+		if err != nil {
+			logger.Error("could not rotate link signing key", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("rotated link signing key", "key_id", keyID, "kept", settings.Links.KeepKeys)
+		return
+	}
 
 	// create sessions
-	session := initSession()
+	redisPool := initRedis(settings)
+	session := initSession(settings, redisPool)
 
 	// create channels
 
 	// create waitgroup
 	wg := sync.WaitGroup{}
 
+	// cache the page templates; dev mode reads them on every request instead
+	templateCache, err := newTemplateCache(templateFS)
+	if err != nil {
+		logger.Error("could not parse page templates", "error", err)
+		os.Exit(1)
+	}
+
 	// set up the application config
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ltime|log.Ldate)
-	errorLog := log.New(os.Stdout, "ERROR\t", log.Ltime|log.Ldate|log.Lshortfile)
 
 	app = &Config{
 		DB:            conn,
+		Redis:         redisPool,
 		Session:       session,
 		Wait:          &wg,
-		InfoLog:       infoLog,
-		ErrorLog:      errorLog,
-		Models:        data.New(conn),
-		ErrorChan:     make(chan error),
+		Log:           logger,
+		Models:        data.New(conn, logger),
+		ErrorChan:     make(chan ErrorEvent),
 		ErrorChanDone: make(chan bool),
+		ErrorsStopped: make(chan struct{}),
+		TemplateCache: templateCache,
+		Settings:      settings,
 	}
 
+	// tax rates are read once, at startup
+	rates, err := loadTaxRates(settings.Tax.RatesFile, app.Models.TaxRate)
+	if err != nil {
+		logger.Error("could not load tax rates", "error", err)
+		os.Exit(1)
+	}
+	app.Tax = newTaxCalculator(rates, settings.Tax)
+
+	app.Payments, err = newPaymentGateway(settings.Payments, settings.BaseURL)
+	if err != nil {
+		logger.Error("could not set up payments", "error", err)
+		os.Exit(1)
+	}
+
+	// sign the links we mail out
+	app.Tokens = NewTokenService(&Keyring{
+		Store:  app.Models.SigningKey,
+		Keep:   settings.Links.KeepKeys,
+		Legacy: settings.Links.LegacySecrets,
+	}, app.Models.LinkToken)
+
+	// route error events by severity; the mailer reports to it too
+	app.Errors = app.newErrorRouter()
+
 	// set up mail
-	app.Mailer = app.createMail()
+	app.Mailer, err = app.createMail()
+	if err != nil {
+		logger.Error("could not set up mail", "error", err)
+		os.Exit(1)
+	}
+	app.Mailer.start()
 	go app.listenForMail()
 
+	// set up background jobs; they send mail, so they start after it
+	app.Jobs = app.createJobs()
+	app.Jobs.start()
+
+	// renew subscriptions; they queue receipts, so this starts after jobs
+	app.Billing = app.createBilling()
+	app.Billing.start()
+
 	// set up error handler
 	go app.listenForError()
 
-	// listen for web connections
-	go app.listenForShutdown()
-	app.serve()
+	// listen for web connections until we are told to stop
+	err = app.serve(ctx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		app.Log.Error("web server failed", "error", err)
+	}
+
+	app.shutdown()
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		os.Exit(1)
+	}
 }
 
-func initDB() *sql.DB {
-	conn := connectToDB()
+func initDB(dsn string, logger *slog.Logger) *sql.DB {
+	conn := connectToDB(dsn, logger)
 	if conn == nil {
-		log.Panic("could not connect to DB")
+		logger.Error("could not connect to DB")
+		os.Exit(1)
 	}
 	return conn
 }
 
-func connectToDB() *sql.DB {
+func connectToDB(dsn string, logger *slog.Logger) *sql.DB {
 	count := 0
 
-	dsn := os.Getenv("DSN")
-
 	for {
 		connection, err := openDB(dsn)
 		if err != nil {
 			count++
-			log.Printf("error: %v\n", err)
-			log.Println("backing off from db...")
+			logger.Warn("backing off from db", "error", err, "attempt", count)
 			time.Sleep(2 * time.Second)
 		} else {
-			log.Println("connected to DB")
+			logger.Info("connected to DB")
 			return connection
 		}
 
@@ -112,11 +201,11 @@ func openDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-func initSession() *scs.SessionManager {
+func initSession(settings Settings, redisPool *redis.Pool) *scs.SessionManager {
 	gob.Register(data.User{})
 	session := scs.New()
-	session.Store = redisstore.New(initRedis())
-	session.Lifetime = 24 * time.Hour
+	session.Store = redisstore.New(redisPool)
+	session.Lifetime = settings.SessionLifetime
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
 	session.Cookie.Secure = true
@@ -124,93 +213,244 @@ func initSession() *scs.SessionManager {
 	return session
 }
 
-func initRedis() *redis.Pool {
+func initRedis(settings Settings) *redis.Pool {
 	redisPool := &redis.Pool{
-		MaxIdle: 10,
+		MaxIdle: settings.RedisMaxIdle,
 		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", os.Getenv("REDIS"))
+			return redis.Dial("tcp", settings.Redis)
 		},
 	}
 
 	return redisPool
 }
 
+// newErrorRouter subscribes the error sinks: everything is logged,
+// warnings and worse are stored, and errors are mailed to an admin.
+func (app *Config) newErrorRouter() *ErrorRouter {
+	router := &ErrorRouter{Log: app.Log}
+	router.Subscribe(SeverityInfo, &LogSink{Log: app.Log})
+	router.Subscribe(SeverityWarning, &StoreSink{Errors: app.Models.AppError})
+
+	if app.Settings.Errors.DigestTo != "" {
+		router.Subscribe(SeverityError, &DigestSink{
+			To:  app.Settings.Errors.DigestTo,
+			Max: 100,
+			Send: func(msg Message) {
+				app.sendMail(context.Background(), msg)
+			},
+		})
+	}
+
+	return router
+}
+
+// listenForError routes error events, and sends the digest every
+// ErrorDigestEvery. Sending it writes to the outbox and waits for room in
+// the mail queue, so it happens on its own goroutine; a slow send mustn't
+// hold up the events behind it. Whatever is left is sent when we stop,
+// and ErrorsStopped is closed once it has been.
 func (app *Config) listenForError() {
+	defer close(app.ErrorsStopped)
+
+	ticker := time.NewTicker(app.Settings.Errors.DigestEvery)
+	defer ticker.Stop()
+
+	var flushing sync.WaitGroup
 	for {
 		select {
-		case err := <-app.ErrorChan:
-			app.ErrorLog.Println(err)
+		case ev := <-app.ErrorChan:
+			app.Errors.Route(ev)
+		case <-ticker.C:
+			flushing.Add(1)
+			go func() {
+				defer flushing.Done()
+				app.Errors.Flush()
+			}()
 		case <-app.ErrorChanDone:
+			flushing.Wait()
+			app.Errors.Flush()
 			return
 		}
 	}
 }
 
-func (app *Config) serve() {
-	defer app.InfoLog.Println("Web listener exited.")
+// serve runs the web server until ctx is cancelled, then stops accepting
+// requests and gives those in flight up to ShutdownTimeout to finish.
+func (app *Config) serve(ctx context.Context) error {
+	defer app.Log.Info("web listener exited")
 
 	srv := http.Server{
-		Addr:    fmt.Sprintf(":%s", webPort),
+		Addr:    fmt.Sprintf(":%s", app.Settings.WebPort),
 		Handler: app.routes(),
 	}
 
-	app.InfoLog.Printf("starting server on port %s\n", webPort)
-	err := srv.ListenAndServe()
-	if err != nil {
-		log.Panicln(err)
+	serveErr := make(chan error, 1)
+	go func() {
+		app.Log.Info("starting server", "port", app.Settings.WebPort)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		// the listener failed before we were asked to stop
+		return err
+	case <-ctx.Done():
 	}
-}
 
-// Implement a graceful shutdown. We use a goroutine that listens
-// for OS signals.
+	app.Log.Info("draining web requests", "timeout", app.Settings.ShutdownTimeout)
+	atomic.StoreInt32(&app.draining, 1)
 
-func (app *Config) listenForShutdown() {
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	app.shutdown()
-	os.Exit(0)
+	drainCtx, cancel := context.WithTimeout(context.Background(), app.Settings.ShutdownTimeout)
+	defer cancel()
+
+	return srv.Shutdown(drainCtx)
 }
 
+// shutdown stops everything behind the web server, in order, within
+// ShutdownTimeout: background work, then the error listener, the mailer,
+// and finally the database and Redis pools.
 func (app *Config) shutdown() {
-	app.InfoLog.Println("goroutines get shut down here.")
+	app.Log.Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), app.Settings.ShutdownTimeout)
+	defer cancel()
+
+	// stop starting new work: billing first, since it queues jobs, then
+	// jobs, since they send mail, then the outbox sweeper
+	app.Billing.Stop(ctx)
+	app.Jobs.Stop(ctx)
+	app.Mailer.StopSweeping()
+
+	// let background work, and the mail it queues, finish
+	finished := make(chan struct{})
+	go func() {
+		app.Wait.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		app.Log.Error("gave up waiting for background work", "timeout", app.Settings.ShutdownTimeout)
+	}
 
-	// wait for all systems to finish
-	app.Wait.Wait()
+	// stop the error listener while the mailer still takes mail, and wait
+	// for it to send the last digest
+	app.ErrorChanDone <- true
+	select {
+	case <-app.ErrorsStopped:
+	case <-ctx.Done():
+		app.Log.Error("gave up waiting for the error digest", "timeout", app.Settings.ShutdownTimeout)
+	}
 
-	// stop the listeners
+	// stop taking mail, and send what is queued while time remains
+	report := app.Mailer.Close(ctx)
+	app.Log.Info("mail at shutdown",
+		"delivered", report.Delivered,
+		"failed", report.Failed,
+		"persisted", report.Persisted,
+		"dropped", report.Dropped,
+		"still_sending", report.InFlight,
+	)
+
+	// stop the mail listener. We don't close its channel: a goroutine we
+	// gave up waiting for could still be holding it.
 	app.Mailer.DoneChan <- true
-	app.ErrorChanDone <- true
 
-	app.InfoLog.Println("shutdown complete.")
+	// nothing needs the pools any more
+	if app.DB != nil {
+		if err := app.DB.Close(); err != nil {
+			app.Log.Error("closing database", "error", err)
+		}
+	}
 
-	// and close our channels
-	close(app.Mailer.MailerChan)
-	close(app.Mailer.ErrorChan)
-	close(app.Mailer.DoneChan)
-	close(app.ErrorChan)
-	close(app.ErrorChanDone)
+	if app.Redis != nil {
+		if err := app.Redis.Close(); err != nil {
+			app.Log.Error("closing redis", "error", err)
+		}
+	}
+
+	app.Log.Info("shutdown complete")
+}
+
+func (app *Config) createJobs() *JobQueue {
+	jobs := &JobQueue{
+		Store:       app.Models.Job,
+		Workers:     app.Settings.Jobs.Workers,
+		MaxAttempts: app.Settings.Jobs.MaxAttempts,
+		RetryBase:   10 * time.Second,
+		RetryMax:    10 * time.Minute,
+		Lease:       10 * time.Minute,
+		PollEvery:   5 * time.Second,
+		Log:         app.Log,
+		ErrorChan:   app.ErrorChan,
+	}
+	app.registerJobs(jobs)
+
+	return jobs
+}
+
+func (app *Config) createBilling() *BillingScheduler {
+	return &BillingScheduler{
+		Lock:      app.Models.BillingLock,
+		Store:     app.Models.Plan,
+		Renew:     app.renewSubscription,
+		Every:     app.Settings.Billing.Every,
+		Batch:     app.Settings.Billing.Batch,
+		RetryBase: app.Settings.Billing.RetryBase,
+		RetryMax:  app.Settings.Billing.RetryMax,
+		Log:       app.Log,
+		ErrorChan: app.ErrorChan,
+	}
 }
 
-func (app *Config) createMail() Mail {
+func (app *Config) createMail() (*Mail, error) {
 
-	errorChan := make(chan error)
+	errorChan := make(chan ErrorEvent)
 	mailerChan := make(chan Message, 100)
 	doneChan := make(chan bool)
 
-	mailer := Mail{
-		Domain:      "localhost",
-		Host:        "localhost",
-		Port:        1025,
-		FromAddress: "joe@mamma.org",
-		FromName:    "Joe Yo",
-		Encryption:  "none",
+	settings := app.Settings.Mail
+
+	transport, err := newMailTransport(settings.Transport, settings.Dir, &SMTPTransport{
+		Host:       settings.Host,
+		Port:       settings.Port,
+		Username:   settings.Username,
+		Password:   settings.Password,
+		Encryption: settings.Encryption,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("setting up mail transport: %w", err)
+	}
+
+	// in dev mode, email templates are re-read for every message
+	templates, err := NewMailTemplates(templateFS, app.Settings.Dev, requiredMailTemplates...)
+	if err != nil {
+		return nil, fmt.Errorf("loading mail templates: %w", err)
+	}
+
+	mailer := &Mail{
+		Domain:      settings.Domain,
+		FromAddress: settings.FromAddress,
+		FromName:    settings.FromName,
+		Transport:   transport,
+		Templates:   templates,
+		Workers:     settings.Workers,
+		MaxAttempts: settings.MaxAttempts,
+		RetryBase:   time.Second,
+		RetryMax:    time.Minute,
+		DeadLetters: app.Models.DeadLetter,
+		Outbox:      app.Models.Outbox,
+		OutboxLease: 10 * time.Minute,
+		SweepEvery:  30 * time.Second,
+		Metrics:     &MailMetrics{},
+		Log:         app.Log,
 		ErrorChan:   errorChan,
 		MailerChan:  mailerChan,
 		DoneChan:    doneChan,
 		Wait:        app.Wait,
 	}
 
-	return mailer
+	return mailer, nil
 
 }
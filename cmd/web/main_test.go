@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConfig_serve(t *testing.T) {
+	// a copy, so draining doesn't leak into other tests
+	app := testApp
+	app.Settings.WebPort = "0"
+	app.Settings.ShutdownTimeout = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- app.serve(ctx)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after its context was cancelled")
+	}
+
+	if app.draining != 1 {
+		t.Error("expected the server to be marked as draining")
+	}
+}
+
+func TestConfig_RejectWhileDraining(t *testing.T) {
+	app := testApp
+	handler := app.RejectWhileDraining(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected %d before draining, got %d", http.StatusOK, rr.Code)
+	}
+
+	app.draining = 1
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected %d while draining, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+}
@@ -1,13 +1,34 @@
 package main
 
-import "net/http"
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"final-project/data"
+	"net/http"
+	"sync/atomic"
+)
+
+// Turn away new requests while we drain for shutdown
+func (app *Config) RejectWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&app.draining) == 1 {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
 
 // Add session to the request
 func (app *Config) AddSessionToRequest(next http.Handler) http.Handler {
 	return app.Session.LoadAndSave(next)
 }
 
-// Enforce auth
+// Enforce auth. A session from before the user's password was last reset
+// is ended, so a reset signs them out everywhere.
 func (app *Config) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !app.Session.Exists(r.Context(), "userID") {
@@ -15,6 +36,55 @@ func (app *Config) Auth(next http.Handler) http.Handler {
 			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
 			return
 		}
+
+		user, err := app.Models.User.GetOne(app.Session.GetInt(r.Context(), "userID"))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			app.logger(r.Context()).Error("could not check session user", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if err != nil || passwordStamp(*user) != app.Session.GetString(r.Context(), "passwordStamp") {
+			_ = app.Session.Destroy(r.Context())
+			_ = app.Session.RenewToken(r.Context())
+			app.Session.Put(r.Context(), "error", "Your session has ended. Please log in again.")
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Enforce admin; use after Auth
+func (app *Config) Admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := app.Session.Get(r.Context(), "user").(data.User)
+		if !ok || user.IsAdmin != 1 {
+			app.Session.Put(r.Context(), "error", "You are not allowed to see that page.")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Enforce the CSRF token on anything that changes state. The token is kept
+// in the session, and every form we render sends it back, so a form on
+// another site, or a prefetched link, can't act for the user.
+func (app *Config) CheckCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		want := app.Session.GetString(r.Context(), csrfSessionKey)
+		got := r.PostFormValue(csrfField)
+		if want == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			app.logger(r.Context()).Warn("rejected request without a valid CSRF token", "path", r.URL.Path)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// persist writes msg to the outbox, claimed by this instance, and records
+// the row ID on the message. If we crash before sending, the claim lapses
+// and the sweeper on whichever instance gets there first picks it up.
+func (m *Mail) persist(msg *Message) error {
+	if m.Outbox == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	id, err := m.Outbox.Enqueue(payload, m.OutboxLease)
+	if err != nil {
+		return err
+	}
+
+	msg.OutboxID = id
+	return nil
+}
+
+// persistTx is persist as part of tx: the message is only in the outbox,
+// and only sent, if tx commits. Queue it once tx has committed.
+func (m *Mail) persistTx(tx *sql.Tx, msg *Message) error {
+	if m.Outbox == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	id, err := m.Outbox.EnqueueTx(tx, payload, m.OutboxLease)
+	if err != nil {
+		return err
+	}
+
+	msg.OutboxID = id
+	return nil
+}
+
+// settleOutbox records the outcome of a send against its outbox row.
+func (m *Mail) settleOutbox(msg Message, sendErr error) error {
+	if m.Outbox == nil || msg.OutboxID == 0 {
+		return nil
+	}
+
+	if sendErr != nil {
+		return m.Outbox.MarkFailed(msg.OutboxID, sendErr.Error())
+	}
+
+	return m.Outbox.MarkSent(msg.OutboxID)
+}
+
+// sweepOutbox periodically queues outbox rows that nobody is working on:
+// mail left over from before a restart, or claimed by an instance that died.
+func (m *Mail) sweepOutbox(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.SweepEvery)
+	defer ticker.Stop()
+
+	for {
+		if err := m.claimOutbox(); err != nil {
+			ev := ErrorEvent{Source: "mail outbox", Severity: SeverityWarning, Err: err, Time: time.Now()}
+			select {
+			case m.ErrorChan <- ev:
+			case <-stop:
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// claimOutbox claims as many rows as there is room for in MailerChan, and
+// hands them to the workers.
+func (m *Mail) claimOutbox() error {
+	free := cap(m.MailerChan) - len(m.MailerChan)
+	if free <= 0 {
+		return nil
+	}
+
+	rows, err := m.Outbox.Claim(free, m.OutboxLease)
+	if err != nil {
+		return fmt.Errorf("could not claim outbox mail: %w", err)
+	}
+
+	for _, row := range rows {
+		var msg Message
+		err := json.Unmarshal(row.Payload, &msg)
+		if err != nil {
+			// a payload we can't read will never send; take it out of rotation.
+			_ = m.Outbox.MarkFailed(row.ID, err.Error())
+			continue
+		}
+
+		msg.OutboxID = row.ID
+		m.queue(context.Background(), msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"final-project/data"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PaymentGateway takes payments through a payment provider. Amounts are in
+// the minor unit of the currency.
+type PaymentGateway interface {
+	// CreateCustomer registers the user with the provider, and returns
+	// their customer ID there.
+	CreateCustomer(user data.User) (string, error)
+	// AttachPaymentMethod makes method, a token from the provider's
+	// payment form, the customer's way to pay.
+	AttachPaymentMethod(customerID, method string) error
+	// Charge charges the customer. A declined charge is not an error, but
+	// a charge that failed; a charge may also be left pending, to be
+	// settled later by a webhook.
+	Charge(req ChargeRequest) (*Charge, error)
+	// Refund gives back amount of a charge that succeeded.
+	Refund(chargeID string, amount int) (*Refund, error)
+	// HandleWebhook checks that a webhook came from the provider, and
+	// reads the event in it.
+	HandleWebhook(r *http.Request) (*PaymentEvent, error)
+}
+
+// Charge statuses
+const (
+	chargeSucceeded = "succeeded"
+	chargePending   = "pending"
+	chargeFailed    = "failed"
+)
+
+// Webhook events
+const (
+	eventChargeSucceeded = "charge.succeeded"
+	eventChargeFailed    = "charge.failed"
+	eventChargeRefunded  = "charge.refunded"
+)
+
+var (
+	errNoPaymentMethod = errors.New("customer has no payment method")
+	errUnknownCustomer = errors.New("no such customer")
+	errBadWebhook      = errors.New("webhook signature does not match")
+	errPaymentOpen     = errors.New("invoice already has a payment pending or paid")
+)
+
+// ChargeRequest is what to charge a customer.
+type ChargeRequest struct {
+	CustomerID  string
+	Amount      int
+	Currency    string
+	Description string
+	// a second charge with the same key returns the first, rather than
+	// charging again
+	IdempotencyKey string
+}
+
+// Charge is a charge made at the provider. A failed charge says why, in
+// the provider's code and in words for the customer.
+type Charge struct {
+	ID             string
+	CustomerID     string
+	Amount         int
+	Currency       string
+	Status         string
+	FailureCode    string
+	FailureMessage string
+}
+
+// Refund is money given back on a charge.
+type Refund struct {
+	ID       string
+	ChargeID string
+	Amount   int
+}
+
+// PaymentEvent is something the provider tells us about by webhook, such
+// as a pending charge going through.
+type PaymentEvent struct {
+	ID     string
+	Type   string
+	Charge Charge
+}
+
+// newPaymentGateway picks a gateway by name. Only "fake" exists so far.
+func newPaymentGateway(settings PaymentSettings, baseURL string) (PaymentGateway, error) {
+	switch settings.Gateway {
+	case "", "fake":
+		secret := settings.WebhookSecret
+		if secret == "" {
+			// the fake only sends webhooks to us, so any secret will do
+			secret = randomHex(32)
+		}
+		return &FakeGateway{
+			WebhookURL:   baseURL + "/webhooks/payments",
+			WebhookDelay: settings.WebhookDelay,
+			Secret:       secret,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", settings.Gateway)
+	}
+}
+
+// FakeCard is a payment method the fake gateway knows, and what charging
+// it does. A pending charge settles to Settles.
+type FakeCard struct {
+	Method         string
+	Description    string
+	Status         string
+	Settles        string
+	FailureCode    string
+	FailureMessage string
+}
+
+var fakeCards = []FakeCard{
+	{Method: "pm_card_visa", Description: "Visa, always succeeds", Status: chargeSucceeded},
+	{Method: "pm_card_declined", Description: "Declined", Status: chargeFailed,
+		FailureCode: "card_declined", FailureMessage: "Your card was declined."},
+	{Method: "pm_card_insufficient_funds", Description: "Declined for insufficient funds", Status: chargeFailed,
+		FailureCode: "insufficient_funds", FailureMessage: "Your card has insufficient funds."},
+	{Method: "pm_card_delayed", Description: "Pending, then succeeds", Status: chargePending,
+		Settles: chargeSucceeded},
+	{Method: "pm_card_delayed_declined", Description: "Pending, then declined", Status: chargePending,
+		Settles: chargeFailed, FailureCode: "card_declined", FailureMessage: "Your card was declined."},
+}
+
+// FakeGateway is a payment gateway that runs in process, for development
+// and tests. What a charge does depends on the card: see FakeCards.
+// Pending charges settle after WebhookDelay, and the webhook for them is
+// POSTed to WebhookURL, signed with Secret. It keeps nothing when it
+// stops, but a customer it made before is known again the first time it
+// comes back, without a card.
+type FakeGateway struct {
+	WebhookURL   string
+	WebhookDelay time.Duration
+	Secret       string
+	// delivers a signed webhook; nil means POST it to WebhookURL
+	Send func(req *http.Request) error
+
+	mu        sync.Mutex
+	run       string
+	seq       int
+	customers map[string]string
+	charges   map[string]*fakeCharge
+	keys      map[string]string
+}
+
+// fakeCharge is a charge, the card it was made on, and how much of it has
+// been refunded.
+type fakeCharge struct {
+	Charge
+	card     FakeCard
+	refunded int
+}
+
+// FakeCards lists the cards the fake gateway takes.
+func (g *FakeGateway) FakeCards() []FakeCard {
+	return fakeCards
+}
+
+func fakeCard(method string) (FakeCard, bool) {
+	for _, card := range fakeCards {
+		if card.Method == method {
+			return card, true
+		}
+	}
+	return FakeCard{}, false
+}
+
+// fakeCustomerPrefix starts the ID of every customer the fake gateway
+// makes.
+const fakeCustomerPrefix = "cus_fake_"
+
+// nextID returns a new ID with prefix. IDs from before a restart are kept
+// in the database, so each run's are its own. g.mu must be held.
+func (g *FakeGateway) nextID(prefix string) string {
+	if g.run == "" {
+		g.run = randomHex(4)
+	}
+	g.seq++
+	return fmt.Sprintf("%s_fake_%s_%d", prefix, g.run, g.seq)
+}
+
+// customer returns the customer's payment method, and whether the
+// customer exists. One made before a restart is remembered here. g.mu
+// must be held.
+func (g *FakeGateway) customer(customerID string) (string, bool) {
+	method, ok := g.customers[customerID]
+	if !ok && strings.HasPrefix(customerID, fakeCustomerPrefix) {
+		if g.customers == nil {
+			g.customers = make(map[string]string)
+		}
+		g.customers[customerID] = ""
+		return "", true
+	}
+	return method, ok
+}
+
+func (g *FakeGateway) CreateCustomer(user data.User) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.customers == nil {
+		g.customers = make(map[string]string)
+	}
+
+	id := g.nextID("cus")
+	g.customers[id] = ""
+	return id, nil
+}
+
+func (g *FakeGateway) AttachPaymentMethod(customerID, method string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.customer(customerID); !ok {
+		return fmt.Errorf("%w %q", errUnknownCustomer, customerID)
+	}
+	if _, ok := fakeCard(method); !ok {
+		return fmt.Errorf("no such payment method %q", method)
+	}
+
+	g.customers[customerID] = method
+	return nil
+}
+
+func (g *FakeGateway) Charge(req ChargeRequest) (*Charge, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.charges == nil {
+		g.charges = make(map[string]*fakeCharge)
+		g.keys = make(map[string]string)
+	}
+
+	if id, ok := g.keys[req.IdempotencyKey]; ok && req.IdempotencyKey != "" {
+		charge := g.charges[id].Charge
+		return &charge, nil
+	}
+
+	method, ok := g.customer(req.CustomerID)
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownCustomer, req.CustomerID)
+	}
+	if method == "" {
+		return nil, errNoPaymentMethod
+	}
+	card, _ := fakeCard(method)
+
+	charge := &fakeCharge{
+		Charge: Charge{
+			ID:         g.nextID("ch"),
+			CustomerID: req.CustomerID,
+			Amount:     req.Amount,
+			Currency:   req.Currency,
+			Status:     card.Status,
+		},
+		card: card,
+	}
+	if card.Status == chargeFailed {
+		charge.FailureCode = card.FailureCode
+		charge.FailureMessage = card.FailureMessage
+	}
+
+	g.charges[charge.ID] = charge
+	if req.IdempotencyKey != "" {
+		g.keys[req.IdempotencyKey] = charge.ID
+	}
+
+	if card.Status == chargePending {
+		id := charge.ID
+		time.AfterFunc(g.WebhookDelay, func() {
+			_ = g.Settle(id)
+		})
+	}
+
+	result := charge.Charge
+	return &result, nil
+}
+
+// Settle settles a pending charge now, the way its card says, and sends
+// the webhook for it. Tests use it rather than waiting for WebhookDelay.
+func (g *FakeGateway) Settle(chargeID string) error {
+	g.mu.Lock()
+	charge, ok := g.charges[chargeID]
+	if !ok || charge.Status != chargePending {
+		g.mu.Unlock()
+		return fmt.Errorf("no pending charge %q", chargeID)
+	}
+
+	event := PaymentEvent{ID: g.nextID("evt"), Type: eventChargeSucceeded}
+	charge.Status = charge.card.Settles
+	if charge.Status == chargeFailed {
+		charge.FailureCode = charge.card.FailureCode
+		charge.FailureMessage = charge.card.FailureMessage
+		event.Type = eventChargeFailed
+	}
+	event.Charge = charge.Charge
+	g.mu.Unlock()
+
+	return g.sendWebhook(event)
+}
+
+func (g *FakeGateway) Refund(chargeID string, amount int) (*Refund, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	charge, ok := g.charges[chargeID]
+	if !ok || charge.Status != chargeSucceeded {
+		return nil, fmt.Errorf("no successful charge %q", chargeID)
+	}
+
+	if amount <= 0 || charge.refunded+amount > charge.Amount {
+		return nil, fmt.Errorf("cannot refund %d of charge %q", amount, chargeID)
+	}
+	charge.refunded += amount
+
+	refund := &Refund{ID: g.nextID("re"), ChargeID: chargeID, Amount: amount}
+	event := PaymentEvent{ID: g.nextID("evt"), Type: eventChargeRefunded, Charge: charge.Charge}
+	go func() {
+		_ = g.sendWebhook(event)
+	}()
+
+	return refund, nil
+}
+
+// sendWebhook signs an event and delivers it. Like a real provider, it
+// tries again a few times if we don't take it.
+func (g *FakeGateway) sendWebhook(event PaymentEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest("POST", g.WebhookURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Fake-Signature", hex.EncodeToString(g.sign(body)))
+
+		err = g.send(req)
+		if err == nil || attempt == 3 {
+			return err
+		}
+		time.Sleep(g.WebhookDelay)
+	}
+}
+
+func (g *FakeGateway) send(req *http.Request) error {
+	if g.Send != nil {
+		return g.Send(req)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (g *FakeGateway) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(g.Secret))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func (g *FakeGateway) HandleWebhook(r *http.Request) (*PaymentEvent, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := hex.DecodeString(r.Header.Get("Fake-Signature"))
+	if err != nil || !hmac.Equal(signature, g.sign(body)) {
+		return nil, errBadWebhook
+	}
+
+	var event PaymentEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"final-project/data"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+// pendingCharges returns the IDs of the charges waiting to settle.
+func (g *FakeGateway) pendingCharges() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var ids []string
+	for id, charge := range g.charges {
+		if charge.Status == chargePending {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// forgetCharges forgets every charge. The mock models give every invoice
+// the same ID, so without it a test would get an earlier test's charge
+// back for the same idempotency key.
+func (g *FakeGateway) forgetCharges() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.charges = nil
+	g.keys = nil
+}
+
+// forgetCustomer loses the customer, as the fake gateway does when it
+// restarts.
+func (g *FakeGateway) forgetCustomer(customerID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.customers, customerID)
+}
+
+// setCard makes method, which may be empty, the customer's way to pay,
+// whatever an earlier test left there.
+func (g *FakeGateway) setCard(customerID, method string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.customers[customerID] = method
+}
+
+func TestFakeGateway_Charge(t *testing.T) {
+	var events []*PaymentEvent
+	g := &FakeGateway{WebhookDelay: time.Hour, Secret: "secret"}
+	g.Send = func(req *http.Request) error {
+		event, err := g.HandleWebhook(req)
+		if err != nil {
+			return err
+		}
+		events = append(events, event)
+		return nil
+	}
+
+	tests := []struct {
+		method string
+		status string
+		code   string
+	}{
+		{"pm_card_visa", chargeSucceeded, ""},
+		{"pm_card_declined", chargeFailed, "card_declined"},
+		{"pm_card_insufficient_funds", chargeFailed, "insufficient_funds"},
+		{"pm_card_delayed", chargePending, ""},
+	}
+
+	for _, tt := range tests {
+		customer, _ := g.CreateCustomer(data.User{ID: 1})
+		if err := g.AttachPaymentMethod(customer, tt.method); err != nil {
+			t.Fatalf("%s: %s", tt.method, err)
+		}
+
+		charge, err := g.Charge(ChargeRequest{CustomerID: customer, Amount: 1500, Currency: "USD", IdempotencyKey: tt.method})
+		if err != nil {
+			t.Fatalf("%s: %s", tt.method, err)
+		}
+		if charge.Status != tt.status || charge.FailureCode != tt.code {
+			t.Errorf("%s: expected %s %q, got %s %q", tt.method, tt.status, tt.code, charge.Status, charge.FailureCode)
+		}
+
+		// the same key gets the same charge
+		again, _ := g.Charge(ChargeRequest{CustomerID: customer, Amount: 1500, Currency: "USD", IdempotencyKey: tt.method})
+		if again.ID != charge.ID {
+			t.Errorf("%s: expected charge %s again, got %s", tt.method, charge.ID, again.ID)
+		}
+	}
+
+	// the pending charge settles, and says so by webhook
+	pending := g.pendingCharges()
+	if len(pending) != 1 {
+		t.Fatalf("expected one pending charge, got %v", pending)
+	}
+	if err := g.Settle(pending[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != eventChargeSucceeded || events[0].Charge.ID != pending[0] {
+		t.Errorf("expected a charge.succeeded webhook for %s, got %+v", pending[0], events)
+	}
+	if err := g.Settle(pending[0]); err == nil {
+		t.Error("expected settling twice to fail")
+	}
+}
+
+func TestFakeGateway_ChargeWithoutMethod(t *testing.T) {
+	g := &FakeGateway{}
+	customer, _ := g.CreateCustomer(data.User{ID: 1})
+
+	_, err := g.Charge(ChargeRequest{CustomerID: customer, Amount: 1500, Currency: "USD"})
+	if !errors.Is(err, errNoPaymentMethod) {
+		t.Errorf("expected %v, got %v", errNoPaymentMethod, err)
+	}
+}
+
+func TestFakeGateway_restart(t *testing.T) {
+	before := &FakeGateway{}
+	customer, _ := before.CreateCustomer(data.User{ID: 1})
+
+	// the customer saved from before the restart is known, without the card
+	after := &FakeGateway{}
+	_, err := after.Charge(ChargeRequest{CustomerID: customer, Amount: 1500, Currency: "USD"})
+	if !errors.Is(err, errNoPaymentMethod) {
+		t.Errorf("expected %v, got %v", errNoPaymentMethod, err)
+	}
+	if err := after.AttachPaymentMethod(customer, "pm_card_visa"); err != nil {
+		t.Errorf("expected a card attached to %s, got %v", customer, err)
+	}
+
+	// and isn't handed out again
+	if again, _ := after.CreateCustomer(data.User{ID: 2}); again == customer {
+		t.Errorf("expected a new customer ID, got %s again", again)
+	}
+
+	// a customer it never made is still unknown
+	if err := after.AttachPaymentMethod("cus_test", "pm_card_visa"); !errors.Is(err, errUnknownCustomer) {
+		t.Errorf("expected %v, got %v", errUnknownCustomer, err)
+	}
+}
+
+func TestFakeGateway_Refund(t *testing.T) {
+	g := &FakeGateway{Send: func(*http.Request) error { return nil }}
+	customer, _ := g.CreateCustomer(data.User{ID: 1})
+	_ = g.AttachPaymentMethod(customer, "pm_card_visa")
+	charge, _ := g.Charge(ChargeRequest{CustomerID: customer, Amount: 1500, Currency: "USD"})
+
+	if _, err := g.Refund(charge.ID, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Refund(charge.ID, 600); err == nil {
+		t.Error("expected refunding more than was charged to fail")
+	}
+	if _, err := g.Refund(charge.ID, 500); err != nil {
+		t.Error("expected the rest to be refunded, got", err)
+	}
+}
+
+func TestFakeGateway_HandleWebhook(t *testing.T) {
+	g := &FakeGateway{Secret: "secret"}
+	body := []byte(`{"ID":"evt_1","Type":"charge.succeeded","Charge":{"ID":"ch_1"}}`)
+
+	req, _ := http.NewRequest("POST", "/webhooks/payments", bytes.NewReader(body))
+	req.Header.Set("Fake-Signature", "00ff")
+	if _, err := g.HandleWebhook(req); !errors.Is(err, errBadWebhook) {
+		t.Errorf("expected a bad signature to be rejected, got %v", err)
+	}
+
+	var sent *http.Request
+	g.Send = func(req *http.Request) error {
+		sent = req
+		return nil
+	}
+	_ = g.sendWebhook(PaymentEvent{ID: "evt_1", Type: eventChargeSucceeded, Charge: Charge{ID: "ch_1"}})
+
+	event, err := g.HandleWebhook(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Charge.ID != "ch_1" {
+		t.Errorf("expected the event for ch_1, got %+v", event)
+	}
+}
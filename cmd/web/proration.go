@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"final-project/data"
+	"fmt"
+	"time"
+)
+
+// Proration is what a switch between plans part way through a billing
+// period costs: a credit for the time left on the old plan, and a charge
+// for the same time on the new one. Amounts are in the minor unit of
+// Currency; Net is negative when the switch is to a cheaper plan.
+type Proration struct {
+	From        data.Plan
+	To          data.Plan
+	Currency    string
+	Locale      string
+	At          time.Time
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Credit      int
+	Charge      int
+	Net         int
+}
+
+// prorate works out the cost of switching from one plan to another at at,
+// in the period from start to end, by the second. The credit is for what
+// was paid for the old plan, on the paid invoice, less any coupon; with no
+// invoice, it is for the old plan's price. It is billed in the paid
+// invoice's currency, or else the locale's, if the plans are sold in it,
+// or else in the new plan's own currency.
+func prorate(from, to data.Plan, paid *data.Invoice, locale data.Locale, start, end, at time.Time) Proration {
+	currency := to.Currency
+	if _, c := from.Price(locale.Currency); c == locale.Currency {
+		if _, c := to.Price(locale.Currency); c == locale.Currency {
+			currency = locale.Currency
+		}
+	}
+	if paid != nil {
+		if _, c := to.Price(paid.Currency); c == paid.Currency {
+			currency = paid.Currency
+		}
+	}
+	fromAmount, _ := from.Price(currency)
+	toAmount, _ := to.Price(currency)
+
+	if at.Before(start) {
+		at = start
+	}
+	if at.After(end) {
+		at = end
+	}
+
+	p := Proration{
+		From:        from,
+		To:          to,
+		Currency:    currency,
+		Locale:      locale.Tag,
+		At:          at,
+		PeriodStart: start,
+		PeriodEnd:   end,
+	}
+
+	total := int(end.Sub(start) / time.Second)
+	if total <= 0 {
+		return p
+	}
+	left := int(end.Sub(at) / time.Second)
+
+	p.Credit = divRound(fromAmount*left, total)
+	if paid != nil && paid.Currency == currency {
+		// the invoice may be for less than the period, after a switch
+		if span := int(paid.PeriodEnd.Sub(paid.PeriodStart) / time.Second); span > 0 {
+			p.Credit = divRound(planAmount(paid)*min(left, span), span)
+		}
+	}
+	p.Charge = divRound(toAmount*left, total)
+	p.Net = p.Charge - p.Credit
+
+	return p
+}
+
+// addLines adds the credit and the charge to an invoice.
+func (p Proration) addLines(invoice *data.Invoice) {
+	period := fmt.Sprintf("%s to %s", p.At.Format("Jan 2"), p.PeriodEnd.Format("Jan 2, 2006"))
+
+	invoice.AddCredit(fmt.Sprintf("Unused time on %s, %s", p.From.PlanName, period), p.Credit)
+	invoice.AddLine(fmt.Sprintf("Remaining time on %s, %s", p.To.PlanName, period), 1, p.Charge)
+}
+
+// planAmount returns what an invoice charged for its plan, before tax and
+// after any coupon: its subtotal, less any credit on it for unused time on
+// the plan before.
+func planAmount(invoice *data.Invoice) int {
+	amount := invoice.Subtotal
+	for _, line := range invoice.Lines {
+		if line.Credit {
+			amount -= line.Amount
+		}
+	}
+	return amount
+}
+
+// paidInvoice returns the invoice the user paid for their plan up to
+// periodEnd, the end of their current period, or nil if they paid nothing
+// for it, as for one they switched to in a trial.
+func (app *Config) paidInvoice(userID, planID int, periodEnd time.Time) (*data.Invoice, error) {
+	invoice, err := app.Models.Invoice.GetPaidThrough(userID, planID, periodEnd)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return invoice, err
+}
+
+// CreditForDisplay formats the credit as a currency string
+func (p Proration) CreditForDisplay() string {
+	return data.FormatMoney(-p.Credit, p.Currency, p.Locale)
+}
+
+// ChargeForDisplay formats the charge as a currency string
+func (p Proration) ChargeForDisplay() string {
+	return data.FormatMoney(p.Charge, p.Currency, p.Locale)
+}
+
+// NetForDisplay formats what is due, before tax, as a currency string
+func (p Proration) NetForDisplay() string {
+	return data.FormatMoney(p.Net, p.Currency, p.Locale)
+}
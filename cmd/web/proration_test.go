@@ -0,0 +1,113 @@
+package main
+
+import (
+	"final-project/data"
+	"testing"
+	"time"
+)
+
+var (
+	bronze = data.Plan{ID: 1, PlanName: "Bronze Plan", PlanAmount: 1000, Currency: "USD", Prices: map[string]int{"EUR": 900}}
+	gold   = data.Plan{ID: 3, PlanName: "Gold Plan", PlanAmount: 3000, Currency: "USD", Prices: map[string]int{"EUR": 2800}}
+)
+
+func Test_prorate(t *testing.T) {
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		from, to data.Plan
+		locale   string
+		at       time.Time
+		currency string
+		credit   int
+		charge   int
+		net      int
+	}{
+		{"upgrade half way", bronze, gold, "en-US", start.AddDate(0, 0, 15), "USD", 500, 1500, 1000},
+		{"downgrade half way", gold, bronze, "en-US", start.AddDate(0, 0, 15), "USD", 1500, 500, -1000},
+		{"in the user's currency", bronze, gold, "de-DE", start.AddDate(0, 0, 15), "EUR", 450, 1400, 950},
+		{"not sold in the user's currency", bronze, gold, "en-GB", start.AddDate(0, 0, 15), "USD", 500, 1500, 1000},
+		{"rounds to the cent", bronze, gold, "en-US", start.AddDate(0, 0, 10), "USD", 667, 2000, 1333},
+		{"after the period ends", bronze, gold, "en-US", end.Add(time.Hour), "USD", 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		p := prorate(tt.from, tt.to, nil, data.LocaleFor(tt.locale), start, end, tt.at)
+
+		if p.Currency != tt.currency {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.currency, p.Currency)
+		}
+		if p.Credit != tt.credit || p.Charge != tt.charge || p.Net != tt.net {
+			t.Errorf("%s: expected credit %d, charge %d and net %d, got %d, %d and %d",
+				tt.name, tt.credit, tt.charge, tt.net, p.Credit, p.Charge, p.Net)
+		}
+	}
+}
+
+func Test_prorate_paid(t *testing.T) {
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	switched := start.AddDate(0, 0, 15)
+
+	// bronze for the month, half off with a coupon
+	discounted := &data.Invoice{Currency: "USD", PeriodStart: start, PeriodEnd: end}
+	discounted.AddLine("Bronze Plan", 1, 1000)
+	discounted.AddLine("Coupon HALF, 50% off", 1, -500)
+
+	// gold from half way through, after a switch from bronze
+	proration := prorate(bronze, gold, nil, data.LocaleFor("en-US"), start, end, switched)
+	switchedTo := &data.Invoice{Currency: "USD", PeriodStart: switched, PeriodEnd: end}
+	proration.addLines(switchedTo)
+
+	// the same, with the credit described another way
+	translated := &data.Invoice{Currency: "USD", PeriodStart: switched, PeriodEnd: end}
+	translated.AddCredit("Nicht genutzte Zeit", proration.Credit)
+	translated.AddLine("Restlaufzeit", 1, proration.Charge)
+
+	tests := []struct {
+		name     string
+		from, to data.Plan
+		paid     *data.Invoice
+		at       time.Time
+		credit   int
+		charge   int
+		net      int
+	}{
+		{"coupon", bronze, gold, discounted, switched, 250, 1500, 1250},
+		{"switched before", gold, bronze, switchedTo, start.AddDate(0, 0, 22), 800, 267, -533},
+		{"described another way", gold, bronze, translated, start.AddDate(0, 0, 22), 800, 267, -533},
+	}
+
+	for _, tt := range tests {
+		p := prorate(tt.from, tt.to, tt.paid, data.LocaleFor("en-US"), start, end, tt.at)
+
+		if p.Credit != tt.credit || p.Charge != tt.charge || p.Net != tt.net {
+			t.Errorf("%s: expected credit %d, charge %d and net %d, got %d, %d and %d",
+				tt.name, tt.credit, tt.charge, tt.net, p.Credit, p.Charge, p.Net)
+		}
+	}
+}
+
+func TestProration_addLines(t *testing.T) {
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	p := prorate(bronze, gold, nil, data.LocaleFor("en-US"), start, start.AddDate(0, 1, 0), start.AddDate(0, 0, 15))
+
+	invoice := &data.Invoice{Currency: p.Currency, Locale: p.Locale}
+	p.addLines(invoice)
+
+	if len(invoice.Lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(invoice.Lines))
+	}
+	if invoice.Lines[0].Amount != -500 || invoice.Lines[1].Amount != 1500 {
+		t.Errorf("expected a credit of -500 and a charge of 1500, got %d and %d",
+			invoice.Lines[0].Amount, invoice.Lines[1].Amount)
+	}
+	if invoice.Total != 1000 {
+		t.Errorf("expected a total of 1000, got %d", invoice.Total)
+	}
+	if got := p.CreditForDisplay(); got != "-$5.00" {
+		t.Errorf("expected a credit of -$5.00, got %s", got)
+	}
+}
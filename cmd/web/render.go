@@ -1,16 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"final-project/data"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"net/http"
+	"strings"
 	"time"
 )
 
-// use a varible for easier testing
-var pathToTemplates = "./cmd/web/templates"
-
 type TemplateData struct {
 	StringMap     map[string]string
 	IntMap        map[string]int
@@ -20,42 +20,87 @@ type TemplateData struct {
 	Warning       string
 	Error         string
 	Authenticated bool
+	CSRFToken     string
 	Now           time.Time
 	User          *data.User
 }
 
-func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) {
-	partials := []string{
-		fmt.Sprintf("%s/base.layout.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/alerts.partial.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/footer.partial.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/header.partial.gohtml", pathToTemplates),
-		fmt.Sprintf("%s/navbar.partial.gohtml", pathToTemplates),
+// every page is parsed together with these
+var pagePartials = []string{
+	"base.layout.gohtml",
+	"alerts.partial.gohtml",
+	"footer.partial.gohtml",
+	"header.partial.gohtml",
+	"navbar.partial.gohtml",
+}
+
+// newTemplateCache parses every page template in fsys, along with the
+// partials, keyed by page name.
+func newTemplateCache(fsys fs.FS) (map[string]*template.Template, error) {
+	cache := make(map[string]*template.Template)
+
+	pages, err := fs.Glob(fsys, "*.page.gohtml")
+	if err != nil {
+		return nil, err
 	}
 
+	for _, page := range pages {
+		tmpl, err := parsePage(fsys, page)
+		if err != nil {
+			return nil, err
+		}
+		cache[page] = tmpl
+	}
+
+	return cache, nil
+}
+
+func parsePage(fsys fs.FS, page string) (*template.Template, error) {
 	var templateSlice []string
-	templateSlice = append(templateSlice, fmt.Sprintf("%s/%s", pathToTemplates, t))
-	templateSlice = append(templateSlice, partials...)
+	templateSlice = append(templateSlice, page)
+	templateSlice = append(templateSlice, pagePartials...)
 
+	return template.ParseFS(fsys, templateSlice...)
+}
+
+func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) {
 	if td == nil {
 		td = &TemplateData{}
 	}
 
-	tmpl, err := template.ParseFiles(templateSlice...)
+	var tmpl *template.Template
+	var err error
+
+	// in dev mode, always read the page fresh so edits show up
+	if app.Settings.Dev {
+		tmpl, err = parsePage(templateFS, t)
+	} else if cached, ok := app.TemplateCache[t]; ok {
+		tmpl = cached
+	} else {
+		err = fmt.Errorf("no template named %s in the cache", t)
+	}
+
 	if err != nil {
-		app.ErrorLog.Printf("template issue: %v", err)
+		app.logger(r.Context()).Error("template issue", "template", t, "error", err)
 		http.Error(w, "server fault", http.StatusInternalServerError)
 		return
 	}
 
+	// render into a buffer first, so a failure part way through
+	// doesn't leave the browser with half a page.
+	var buf bytes.Buffer
 	td = app.AddDefaultData(td, r)
-	err = tmpl.Execute(w, td)
+	err = tmpl.Execute(&buf, td)
 	if err != nil {
-		app.ErrorLog.Printf("template issue: %v", err)
+		app.logger(r.Context()).Error("template issue", "template", t, "error", err)
 		http.Error(w, "server fault", http.StatusInternalServerError)
 		return
 	}
 
+	_, err = buf.WriteTo(w)
+	if err != nil {
+		app.logger(r.Context()).Error("could not write page", "template", t, "error", err)
+	}
 }
 
 func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateData {
@@ -69,8 +114,14 @@ func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateDa
 		if ok {
 			td.User = &user
 		}
+
+		// members are told on every page until they pay
+		if td.Warning == "" && strings.HasPrefix(r.URL.Path, "/members") {
+			td.Warning = app.pastDueWarning(r)
+		}
 	}
 
+	td.CSRFToken = app.csrfToken(r)
 	td.Now = time.Now()
 
 	return td
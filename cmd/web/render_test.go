@@ -1,8 +1,10 @@
 package main
 
 import (
+	"html/template"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -32,6 +34,31 @@ func TestConfig_AddDefaultData(t *testing.T) {
 
 }
 
+func TestConfig_AddDefaultData_pastDue(t *testing.T) {
+	tests := []struct {
+		path   string
+		userID int
+		banner bool
+	}{
+		{"/members/plans", 2, true},
+		{"/members/plans", 1, false},
+		{"/", 2, false},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.path, nil)
+		ctx := createMockContext(req)
+		req = req.WithContext(ctx)
+		testApp.Session.Put(ctx, "userID", tt.userID)
+
+		td := testApp.AddDefaultData(&TemplateData{}, req)
+
+		if banner := strings.HasPrefix(td.Warning, "We couldn't take payment"); banner != tt.banner {
+			t.Errorf("%s as user %d: expected banner %v, got warning %q", tt.path, tt.userID, tt.banner, td.Warning)
+		}
+	}
+}
+
 func TestConfig_IsAuthenticated(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/", nil)
 	ctx := createMockContext(req)
@@ -59,9 +86,6 @@ func TestConfig_render(t *testing.T) {
 	// and we need a writer
 	rr := httptest.NewRecorder()
 
-	// adjust location of template directory
-	pathToTemplates = "./templates"
-
 	// page does not exist
 	testApp.render(rr, req, "fake.page.gohtml", nil)
 
@@ -85,3 +109,43 @@ func TestConfig_render(t *testing.T) {
 	}
 
 }
+
+func TestConfig_render_executionError(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	ctx := createMockContext(req)
+	req = req.WithContext(ctx)
+
+	// a page that fails part way through
+	testApp.TemplateCache["broken.page.gohtml"] = template.Must(
+		template.New("broken").Parse("<p>half a page {{.NoSuchField}}</p>"),
+	)
+	defer delete(testApp.TemplateCache, "broken.page.gohtml")
+
+	rr := httptest.NewRecorder()
+	testApp.render(rr, req, "broken.page.gohtml", nil)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected internal server error %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+
+	if strings.Contains(rr.Body.String(), "half a page") {
+		t.Error("Expected no partial page in the response")
+	}
+}
+
+func Test_newTemplateCache(t *testing.T) {
+	cache, err := newTemplateCache(templateFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, page := range []string{"home.page.gohtml", "login.page.gohtml", "plans.page.gohtml"} {
+		if _, ok := cache[page]; !ok {
+			t.Errorf("Expected %s in the template cache", page)
+		}
+	}
+
+	if _, ok := cache["base.layout.gohtml"]; ok {
+		t.Error("Expected only pages in the template cache")
+	}
+}
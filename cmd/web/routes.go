@@ -11,7 +11,9 @@ func (app *Config) routes() http.Handler {
 	mux := chi.NewMux()
 
 	mux.Use(middleware.Recoverer)
+	mux.Use(app.RejectWhileDraining)
 	mux.Use(app.AddSessionToRequest)
+	mux.Use(app.RequestLogger)
 
 	mux.Get("/", app.HomePage)
 
@@ -23,7 +25,15 @@ func (app *Config) routes() http.Handler {
 	mux.Post("/register", app.PostRegister)
 	mux.Get("/activate", app.ActivateUser)
 
+	mux.Get("/forgot-password", app.ForgotPasswordPage)
+	mux.Post("/forgot-password", app.PostForgotPassword)
+	mux.Get("/reset-password", app.ResetPasswordPage)
+	mux.Post("/reset-password", app.PostResetPassword)
+
+	mux.Post("/webhooks/payments", app.PaymentWebhook)
+
 	mux.Mount("/members", app.AuthRouter())
+	mux.Mount("/admin", app.AdminRouter())
 
 	return mux
 }
@@ -66,9 +76,28 @@ func (app *Config) routes() http.Handler {
 func (app *Config) AuthRouter() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(app.Auth)
+	mux.Use(app.CheckCSRF)
 
 	mux.Get("/plans", app.ChoosePlans)
-	mux.Get("/subscribe", app.SubscribePlan)
+	mux.Post("/subscribe", app.SubscribePlan)
+	mux.Get("/subscription", app.MySubscription)
+	mux.Post("/subscription/cancel", app.CancelSubscription)
+	mux.Post("/subscription/resume", app.ResumeSubscription)
+	mux.Post("/subscription/pay", app.PaySubscription)
+
+	return mux
+}
+
+// admin-only routes
+func (app *Config) AdminRouter() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(app.Auth)
+	mux.Use(app.Admin)
+	mux.Use(app.CheckCSRF)
+
+	mux.Get("/mail/dead-letters", app.DeadLetters)
+	mux.Post("/mail/dead-letters/replay", app.ReplayDeadLetter)
+	mux.Get("/tax", app.TaxReport)
 
 	return mux
 }
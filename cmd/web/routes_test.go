@@ -12,8 +12,18 @@ var routes = []string{
 	"/login",
 	"/logout",
 	"/register",
+	"/forgot-password",
+	"/reset-password",
 	"/members/plans",
 	"/members/subscribe",
+	"/members/subscription",
+	"/members/subscription/cancel",
+	"/members/subscription/resume",
+	"/members/subscription/pay",
+	"/admin/mail/dead-letters",
+	"/admin/mail/dead-letters/replay",
+	"/admin/tax",
+	"/webhooks/payments",
 }
 
 func Test_routes_exist(t *testing.T) {
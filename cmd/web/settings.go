@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Settings holds everything the app is configured with. Each value comes
+// from the environment, then from the optional config file, then from the
+// default given in loadSettings.
+type Settings struct {
+	WebPort         string
+	BaseURL         string
+	DSN             string
+	Redis           string
+	RedisMaxIdle    int
+	SessionLifetime time.Duration
+	ShutdownTimeout time.Duration
+	Dev             bool
+	LogFormat       string
+	LogLevel        slog.Level
+	TemplateDir     string
+	PDFDir          string
+	Mail            MailSettings
+	Errors          ErrorSettings
+	Jobs            JobSettings
+	Tax             TaxSettings
+	Payments        PaymentSettings
+	Billing         BillingSettings
+	Dunning         DunningSettings
+	Links           LinkSettings
+}
+
+// MailSettings configures the mailer and its transport.
+type MailSettings struct {
+	Domain      string
+	Host        string
+	Port        int
+	Username    string
+	Password    string
+	Encryption  string
+	FromAddress string
+	FromName    string
+	Transport   string
+	Dir         string
+	Workers     int
+	MaxAttempts int
+}
+
+// ErrorSettings configures where error events go.
+type ErrorSettings struct {
+	// errors are mailed here as a digest, if set
+	DigestTo    string
+	DigestEvery time.Duration
+}
+
+// JobSettings configures the background job queue.
+type JobSettings struct {
+	Workers     int
+	MaxAttempts int
+}
+
+// TaxSettings configures how tax is charged on invoices.
+type TaxSettings struct {
+	// "exclusive" adds tax on top of plan prices; "inclusive" means the
+	// prices already include it
+	Pricing string
+	// rates are read from this CSV file if set, or else from the database
+	RatesFile string
+	// for users who haven't told us where they are
+	DefaultRegion string
+}
+
+// PaymentSettings configures the payment gateway.
+type PaymentSettings struct {
+	// only "fake" so far
+	Gateway string
+	// signs webhooks; the fake gateway makes one up if it isn't set
+	WebhookSecret string
+	// how long the fake gateway leaves pending charges before settling
+	WebhookDelay time.Duration
+}
+
+// BillingSettings configures the scheduler that renews subscriptions.
+type BillingSettings struct {
+	// how often to look for subscriptions whose period has ended
+	Every time.Duration
+	// how many of them to renew at a time
+	Batch int
+	// how long to wait before retrying a renewal that errored; the wait
+	// doubles with each try, up to RetryMax
+	RetryBase time.Duration
+	RetryMax  time.Duration
+}
+
+// DunningSettings configures how renewals that weren't paid are chased.
+type DunningSettings struct {
+	// how many days a past due member has to pay
+	GraceDays int
+	// the plan, usually a free one, to move them to if they don't; 0
+	// cancels their subscription instead
+	DowngradePlan int
+}
+
+// LinkSettings configures the signed tokens in the links we mail out.
+// They are signed with keys kept in the database; see Keyring.
+type LinkSettings struct {
+	// how many keys before the current one keep verifying links after a
+	// rotation; with 0, links signed before it stop working
+	KeepKeys int
+	// secrets that signed links before keys were kept in the database;
+	// they only verify, and can go once those links have expired
+	LegacySecrets []string
+	// the origin those links were signed with, which may not be BaseURL
+	LegacyOrigin string
+}
+
+// SettingsError lists every setting that was missing or invalid.
+type SettingsError []string
+
+func (e SettingsError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n\t%s", strings.Join(e, "\n\t"))
+}
+
+// loadSettings reads the configuration. lookup is normally os.LookupEnv;
+// configFile may be empty. All problems are reported together.
+func loadSettings(lookup func(string) (string, bool), configFile string) (Settings, error) {
+	l := settingsLoader{lookup: lookup}
+
+	if configFile != "" {
+		file, err := readConfigFile(configFile)
+		if err != nil {
+			return Settings{}, err
+		}
+		l.file = file
+	}
+
+	// logs are JSON in production, and easier on the eye in dev
+	dev := l.bool("DEV", false)
+	logFormat := "json"
+	if dev {
+		logFormat = "text"
+	}
+
+	s := Settings{
+		WebPort:         l.string("WEB_PORT", "8080"),
+		BaseURL:         strings.TrimSuffix(l.string("BASE_URL", "http://localhost:8080"), "/"),
+		DSN:             l.required("DSN"),
+		Redis:           l.required("REDIS"),
+		RedisMaxIdle:    l.int("REDIS_MAX_IDLE", 10),
+		SessionLifetime: l.duration("SESSION_LIFETIME", 24*time.Hour),
+		ShutdownTimeout: l.duration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		Dev:             dev,
+		LogFormat:       l.oneOf("LOG_FORMAT", logFormat, "text", "json"),
+		LogLevel:        l.level("LOG_LEVEL", slog.LevelInfo),
+		TemplateDir:     l.string("TEMPLATE_DIR", ""),
+		PDFDir:          l.string("PDF_DIR", ""),
+		Mail: MailSettings{
+			Domain:      l.string("MAIL_DOMAIN", "localhost"),
+			Host:        l.string("MAIL_HOST", "localhost"),
+			Port:        l.int("MAIL_PORT", 1025),
+			Username:    l.string("MAIL_USERNAME", ""),
+			Password:    l.string("MAIL_PASSWORD", ""),
+			Encryption:  l.oneOf("MAIL_ENCRYPTION", "none", "none", "tls", "ssl"),
+			FromAddress: l.string("MAIL_FROM_ADDRESS", "joe@mamma.org"),
+			FromName:    l.string("MAIL_FROM_NAME", "Joe Yo"),
+			Transport:   l.oneOf("MAIL_TRANSPORT", "smtp", "smtp", "file", "memory"),
+			Dir:         l.string("MAIL_DIR", "./tmp/mail"),
+			Workers:     l.int("MAIL_WORKERS", 5),
+			MaxAttempts: l.int("MAIL_MAX_ATTEMPTS", 5),
+		},
+		Errors: ErrorSettings{
+			DigestTo:    l.string("ERROR_DIGEST_TO", ""),
+			DigestEvery: l.duration("ERROR_DIGEST_EVERY", time.Hour),
+		},
+		Jobs: JobSettings{
+			Workers:     l.int("JOB_WORKERS", 3),
+			MaxAttempts: l.int("JOB_MAX_ATTEMPTS", 5),
+		},
+		Tax: TaxSettings{
+			Pricing:       l.oneOf("TAX_PRICING", taxExclusive, taxExclusive, taxInclusive),
+			RatesFile:     l.string("TAX_RATES_FILE", ""),
+			DefaultRegion: l.string("TAX_DEFAULT_REGION", ""),
+		},
+		Payments: PaymentSettings{
+			Gateway:       l.oneOf("PAYMENT_GATEWAY", "fake", "fake"),
+			WebhookSecret: l.string("PAYMENT_WEBHOOK_SECRET", ""),
+			WebhookDelay:  l.duration("PAYMENT_WEBHOOK_DELAY", 5*time.Second),
+		},
+		Billing: BillingSettings{
+			Every:     l.duration("BILLING_EVERY", time.Minute),
+			Batch:     l.int("BILLING_BATCH", 100),
+			RetryBase: l.duration("BILLING_RETRY_BASE", 5*time.Minute),
+			RetryMax:  l.duration("BILLING_RETRY_MAX", 24*time.Hour),
+		},
+		Dunning: DunningSettings{
+			GraceDays:     l.int("DUNNING_GRACE_DAYS", 14),
+			DowngradePlan: l.count("DUNNING_DOWNGRADE_PLAN", 0),
+		},
+		Links: LinkSettings{
+			KeepKeys:      l.count("LINK_KEYS_KEEP", 2),
+			LegacySecrets: l.list("MAIL_LINK_SECRET"),
+			LegacyOrigin:  strings.TrimSuffix(l.string("MAIL_LINK_ORIGIN", "http://localhost:8080"), "/"),
+		},
+	}
+
+	if !strings.HasPrefix(s.BaseURL, "http://") && !strings.HasPrefix(s.BaseURL, "https://") {
+		l.errs = append(l.errs, fmt.Sprintf("BASE_URL: %q must start with http:// or https://", s.BaseURL))
+	}
+
+	if len(l.errs) > 0 {
+		return s, l.errs
+	}
+
+	return s, nil
+}
+
+// readConfigFile reads KEY=VALUE lines, in the same format as .env.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+
+	return values, scanner.Err()
+}
+
+// settingsLoader looks up settings and collects what's wrong with them.
+type settingsLoader struct {
+	lookup func(string) (string, bool)
+	file   map[string]string
+	errs   SettingsError
+}
+
+func (l *settingsLoader) get(key string) (string, bool) {
+	if v, ok := l.lookup(key); ok && v != "" {
+		return v, true
+	}
+	v, ok := l.file[key]
+	return v, ok && v != ""
+}
+
+func (l *settingsLoader) string(key, def string) string {
+	if v, ok := l.get(key); ok {
+		return v
+	}
+	return def
+}
+
+func (l *settingsLoader) required(key string) string {
+	v, ok := l.get(key)
+	if !ok {
+		l.errs = append(l.errs, fmt.Sprintf("%s: required", key))
+	}
+	return v
+}
+
+// list reads a comma separated list.
+func (l *settingsLoader) list(key string) []string {
+	v, _ := l.get(key)
+
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (l *settingsLoader) int(key string, def int) int {
+	v, ok := l.get(key)
+	if !ok {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		l.errs = append(l.errs, fmt.Sprintf("%s: %q is not a positive whole number", key, v))
+		return def
+	}
+	return n
+}
+
+// count is int for settings where 0 means none, or off.
+func (l *settingsLoader) count(key string, def int) int {
+	v, ok := l.get(key)
+	if !ok {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		l.errs = append(l.errs, fmt.Sprintf("%s: %q is not a whole number, 0 or more", key, v))
+		return def
+	}
+	return n
+}
+
+func (l *settingsLoader) duration(key string, def time.Duration) time.Duration {
+	v, ok := l.get(key)
+	if !ok {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		l.errs = append(l.errs, fmt.Sprintf("%s: %q is not a duration such as 30s or 24h", key, v))
+		return def
+	}
+	return d
+}
+
+func (l *settingsLoader) bool(key string, def bool) bool {
+	v, ok := l.get(key)
+	if !ok {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Sprintf("%s: %q is not true or false", key, v))
+		return def
+	}
+	return b
+}
+
+func (l *settingsLoader) oneOf(key, def string, allowed ...string) string {
+	v := l.string(key, def)
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+
+	l.errs = append(l.errs, fmt.Sprintf("%s: %q must be one of %s", key, v, strings.Join(allowed, ", ")))
+	return def
+}
+
+func (l *settingsLoader) level(key string, def slog.Level) slog.Level {
+	v, ok := l.get(key)
+	if !ok {
+		return def
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		l.errs = append(l.errs, fmt.Sprintf("%s: %q is not one of debug, info, warn, error", key, v))
+		return def
+	}
+	return level
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeEnv builds a lookup function over a map, in place of os.LookupEnv.
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+func Test_loadSettings(t *testing.T) {
+	settings, err := loadSettings(fakeEnv(map[string]string{
+		"DSN":              "host=localhost",
+		"REDIS":            "127.0.0.1:6379",
+		"BASE_URL":         "https://example.com/",
+		"SESSION_LIFETIME": "2h",
+		"MAIL_PORT":        "587",
+		"MAIL_ENCRYPTION":  "tls",
+		"MAIL_LINK_SECRET": "new-secret, old-secret",
+	}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.WebPort != "8080" {
+		t.Errorf("expected default port 8080, got %s", settings.WebPort)
+	}
+
+	if settings.BaseURL != "https://example.com" {
+		t.Errorf("expected base URL without trailing slash, got %s", settings.BaseURL)
+	}
+
+	if settings.SessionLifetime != 2*time.Hour {
+		t.Errorf("expected 2h session lifetime, got %s", settings.SessionLifetime)
+	}
+
+	if settings.Mail.Port != 587 || settings.Mail.Encryption != "tls" {
+		t.Errorf("expected tls on port 587, got %s on %d", settings.Mail.Encryption, settings.Mail.Port)
+	}
+
+	if settings.Mail.Workers != 5 {
+		t.Errorf("expected 5 mail workers by default, got %d", settings.Mail.Workers)
+	}
+
+	if settings.LogFormat != "json" || settings.LogLevel != slog.LevelInfo {
+		t.Errorf("expected json logs at info by default, got %s at %s", settings.LogFormat, settings.LogLevel)
+	}
+
+	if !slices.Equal(settings.Links.LegacySecrets, []string{"new-secret", "old-secret"}) {
+		t.Errorf("expected both legacy link secrets, got %v", settings.Links.LegacySecrets)
+	}
+}
+
+func Test_loadSettings_devLogs(t *testing.T) {
+	settings, err := loadSettings(fakeEnv(map[string]string{
+		"DSN":       "host=localhost",
+		"REDIS":     "127.0.0.1:6379",
+		"DEV":       "true",
+		"LOG_LEVEL": "debug",
+	}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.LogFormat != "text" || settings.LogLevel != slog.LevelDebug {
+		t.Errorf("expected text logs at debug in dev, got %s at %s", settings.LogFormat, settings.LogLevel)
+	}
+}
+
+func Test_loadSettings_keepNoKeys(t *testing.T) {
+	settings, err := loadSettings(fakeEnv(map[string]string{
+		"DSN":            "host=localhost",
+		"REDIS":          "127.0.0.1:6379",
+		"LINK_KEYS_KEEP": "0",
+	}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.Links.KeepKeys != 0 {
+		t.Errorf("expected no keys kept, got %d", settings.Links.KeepKeys)
+	}
+}
+
+func Test_loadSettings_downgradeOff(t *testing.T) {
+	settings, err := loadSettings(fakeEnv(map[string]string{
+		"DSN":                    "host=localhost",
+		"REDIS":                  "127.0.0.1:6379",
+		"DUNNING_DOWNGRADE_PLAN": "0",
+	}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.Dunning.DowngradePlan != 0 {
+		t.Errorf("expected no downgrade plan, got %d", settings.Dunning.DowngradePlan)
+	}
+}
+
+func Test_loadSettings_reportsEverything(t *testing.T) {
+	_, err := loadSettings(fakeEnv(map[string]string{
+		"MAIL_PORT":        "lots",
+		"MAIL_ENCRYPTION":  "rot13",
+		"SESSION_LIFETIME": "forever",
+	}), "")
+
+	var settingsErr SettingsError
+	if !errors.As(err, &settingsErr) {
+		t.Fatalf("expected a SettingsError, got %v", err)
+	}
+
+	for _, key := range []string{"DSN", "REDIS", "MAIL_PORT", "MAIL_ENCRYPTION", "SESSION_LIFETIME"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("expected %s in the error, got %s", key, err)
+		}
+	}
+
+	if len(settingsErr) != 5 {
+		t.Errorf("expected 5 problems, got %d", len(settingsErr))
+	}
+}
+
+func Test_loadSettings_configFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.env")
+	err := os.WriteFile(file, []byte(`
+# database
+DSN="host=from-file"
+REDIS=127.0.0.1:6379
+WEB_PORT=9090
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := loadSettings(fakeEnv(map[string]string{
+		"WEB_PORT": "8181",
+	}), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if settings.DSN != "host=from-file" {
+		t.Errorf("expected DSN from the file, got %s", settings.DSN)
+	}
+
+	if settings.WebPort != "8181" {
+		t.Errorf("expected the environment to win over the file, got %s", settings.WebPort)
+	}
+}
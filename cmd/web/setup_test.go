@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/gob"
 	"final-project/data"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"sync"
 	"testing"
@@ -15,17 +18,11 @@ import (
 )
 
 var testApp Config
-var mailMessages = []Message{}
+var testTransport *MemoryTransport
+var testGateway *FakeGateway
 
 func TestMain(m *testing.M) {
 
-	// Test directory locations
-	tempDirectory = "../../tmp"
-	pdfDirectory = "../../pdfs"
-
-	// Populated env variables
-	os.Setenv("MAIL_LINK_SECRET", "oops-did-it-again")
-
 	gob.Register(data.User{})
 	session := scs.New()
 	session.Lifetime = 24 * time.Hour
@@ -41,53 +38,102 @@ func TestMain(m *testing.M) {
 	wg := sync.WaitGroup{}
 
 	// set up the application config
-	infoLog := log.New(os.Stdout, "INFO\t", log.Ltime|log.Ldate)
-	errorLog := log.New(os.Stdout, "ERROR\t", log.Ltime|log.Ldate|log.Lshortfile)
+	logger := newLogger(os.Stdout, "text", slog.LevelInfo)
+
+	templateCache, err := newTemplateCache(templateFS)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	testApp = Config{
 		Session:       session,
 		Models:        data.NewTestModels(nil),
 		Wait:          &wg,
-		InfoLog:       infoLog,
-		ErrorLog:      errorLog,
-		ErrorChan:     make(chan error),
+		Log:           logger,
+		ErrorChan:     make(chan ErrorEvent),
 		ErrorChanDone: make(chan bool),
+		TemplateCache: templateCache,
+		Settings: Settings{
+			BaseURL: "http://localhost:8080",
+			Dunning: DunningSettings{GraceDays: 14},
+		},
+	}
+
+	// tax at the mock rates, with GB for users who have no region
+	rates, err := testApp.Models.TaxRate.GetAll()
+	if err != nil {
+		log.Fatal(err)
+	}
+	testApp.Tax = newTaxCalculator(rates, TaxSettings{Pricing: taxExclusive, DefaultRegion: "GB"})
+
+	// payments go to the fake gateway. Tests settle pending charges
+	// themselves, and webhooks go straight to the handler.
+	testGateway = &FakeGateway{
+		WebhookDelay: time.Hour,
+		Secret:       "test-webhook-secret",
+		Send: func(req *http.Request) error {
+			rr := httptest.NewRecorder()
+			testApp.PaymentWebhook(rr, req)
+			if rr.Code != http.StatusOK {
+				return fmt.Errorf("webhook returned %d", rr.Code)
+			}
+			return nil
+		},
 	}
+	testApp.Payments = testGateway
+
+	// link tokens are kept in memory, so they can be used up
+	testApp.Tokens = NewTokenService(&Keyring{Store: testApp.Models.SigningKey, Keep: 2}, &memoryLinkTokens{})
+
+	// the mock user is already a customer, with no way to pay yet
+	testGateway.customers = map[string]string{"cus_test": ""}
+
+	// errors are only logged in tests
+	testApp.Errors = &ErrorRouter{Log: logger}
+	testApp.Errors.Subscribe(SeverityInfo, &LogSink{Log: logger})
 
 	// error listener
 	go func() {
 		for {
 			select {
-			case err := <-testApp.ErrorChan:
-				testApp.ErrorLog.Println(err)
+			case ev := <-testApp.ErrorChan:
+				testApp.Errors.Route(ev)
 			case <-testApp.ErrorChanDone:
 				return
 			}
 		}
 	}()
 
-	// Mailer mock
-	mailer := Mail{
-		Wait:       &wg,
-		MailerChan: make(chan Message),
-		ErrorChan:  make(chan error),
-		DoneChan:   make(chan bool),
+	// Mailer, delivering to memory
+	templates, err := NewMailTemplates(templateFS, false, requiredMailTemplates...)
+	if err != nil {
+		log.Fatal(err)
 	}
-	testApp.Mailer = mailer
 
-	// Mail listener
-	go func() {
-		for {
-			select {
-			case msg := <-testApp.Mailer.MailerChan:
-				mailMessages = append(mailMessages, msg)
-				wg.Done()
-			case <-testApp.Mailer.ErrorChan:
-			case <-testApp.Mailer.DoneChan:
-				return
-			}
-		}
-	}()
+	testTransport = &MemoryTransport{}
+	testApp.Mailer = &Mail{
+		FromAddress: "test@example.com",
+		FromName:    "Test Mailer",
+		Transport:   testTransport,
+		Templates:   templates,
+		Workers:     2,
+		Outbox:      testApp.Models.Outbox,
+		SweepEvery:  time.Minute,
+		Metrics:     &MailMetrics{},
+		Log:         logger,
+		Wait:        &wg,
+		MailerChan:  make(chan Message, 10),
+		ErrorChan:   make(chan ErrorEvent),
+		DoneChan:    make(chan bool),
+	}
+	testApp.Mailer.start()
+	go testApp.listenForMail()
+
+	// jobs run from memory
+	testApp.Jobs = newTestJobQueue(&memoryJobs{})
+	testApp.Jobs.ErrorChan = testApp.ErrorChan
+	testApp.registerJobs(testApp.Jobs)
+	testApp.Jobs.start()
 
 	os.Exit(m.Run())
 }
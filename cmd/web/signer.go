@@ -1,65 +1,252 @@
 package main
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"final-project/data"
 	"fmt"
-	"log"
-	"os"
+	"strconv"
 	"strings"
 	"time"
+)
+
+// What a link token is for. A token made for one purpose is no good for
+// another, so an activation link can't be used to reset a password.
+const (
+	purposeActivate    = "activate"
+	purposeReset       = "reset"
+	purposeEmailChange = "email-change"
+)
+
+// how long a token for each purpose works for
+var tokenLifetimes = map[string]time.Duration{
+	purposeActivate:    time.Hour,
+	purposeReset:       30 * time.Minute,
+	purposeEmailChange: time.Hour,
+}
+
+// separates the key ID from the rest of a token
+const tokenKeySep = "~"
 
-	goalone "github.com/bwmarrin/go-alone"
+var (
+	errTokenInvalid = errors.New("link token is invalid")
+	errTokenExpired = errors.New("link token has expired")
+	errTokenUsed    = errors.New("link token has already been used")
 )
 
-// const secret = "abc123abc123abc123"
+// TokenService makes and checks the signed tokens in the links we mail
+// out. A token is signed over its purpose, the user it is for and a
+// nonce; the nonce is stored, so a token can only be used once. It starts
+// with the ID of the key that signed it, so it can be checked against
+// that key after the keys are rotated.
+type TokenService struct {
+	Keys  *Keyring
+	Store data.LinkTokenType
+}
+
+// linkClaims is what a link token says.
+type linkClaims struct {
+	Purpose  string
+	UserID   int
+	Nonce    string
+	IssuedAt time.Time
+}
+
+// NewTokenService signs and verifies tokens with the keys, and keeps
+// track of them in store.
+func NewTokenService(keys *Keyring, store data.LinkTokenType) *TokenService {
+	return &TokenService{Keys: keys, Store: store}
+}
+
+// Issue stores a new token for the user and purpose, and returns it signed.
+func (s *TokenService) Issue(purpose string, userID int) (string, error) {
+	return s.issue(purpose, userID, s.Store.Insert)
+}
+
+// IssueTx is Issue, storing the token as part of tx.
+func (s *TokenService) IssueTx(tx *sql.Tx, purpose string, userID int) (string, error) {
+	return s.issue(purpose, userID, func(token data.LinkToken) (int, error) {
+		return s.Store.InsertTx(tx, token)
+	})
+}
+
+func (s *TokenService) issue(purpose string, userID int, insert func(data.LinkToken) (int, error)) (string, error) {
+	if _, ok := tokenLifetimes[purpose]; !ok {
+		return "", fmt.Errorf("unknown link token purpose %q", purpose)
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return "", err
+	}
+
+	keyID, sword, err := s.Keys.signer()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = insert(data.LinkToken{Purpose: purpose, UserID: userID, Nonce: nonce})
+	if err != nil {
+		return "", fmt.Errorf("storing link token: %w", err)
+	}
 
-var secretKey []byte
+	payload := fmt.Sprintf("%s.%d.%s", purpose, userID, nonce)
+	return keyID + tokenKeySep + string(sword.Sign([]byte(payload))), nil
+}
 
-// NewURLSigner creates a new signer
-func NewURLSigner() {
-	var secret = []byte(os.Getenv("MAIL_LINK_SECRET"))
-	if string(secret) == "" {
-		log.Println("oops! no secret in env.")
+// Verify checks that the token is for the purpose, and still good, and
+// returns the user it is for. It doesn't use the token up; see Redeem.
+func (s *TokenService) Verify(token, purpose string) (int, error) {
+	claims, stored, err := s.check(token, purpose)
+	if err != nil {
+		return 0, err
 	}
-	secretKey = []byte(secret)
+	if stored.UsedAt.Valid {
+		return 0, errTokenUsed
+	}
+	return claims.UserID, nil
+}
+
+// Redeem checks the token like Verify, and uses it up, so the same link
+// can't be used again.
+func (s *TokenService) Redeem(token, purpose string) (int, error) {
+	return s.redeem(token, purpose, s.Store.Use)
+}
+
+// RedeemTx is Redeem, using the token up as part of tx, so that it is only
+// used up if what it was used for is done too.
+func (s *TokenService) RedeemTx(tx *sql.Tx, token, purpose string) (int, error) {
+	return s.redeem(token, purpose, func(id int) (bool, error) {
+		return s.Store.UseTx(tx, id)
+	})
 }
 
-// GenerateTokenFromString generates a signed token
-func GenerateTokenFromString(data string) string {
-	var urlToSign string
+func (s *TokenService) redeem(token, purpose string, use func(id int) (bool, error)) (int, error) {
+	claims, stored, err := s.check(token, purpose)
+	if err != nil {
+		return 0, err
+	}
+
+	used, err := use(stored.ID)
+	if err != nil {
+		return 0, fmt.Errorf("using link token: %w", err)
+	}
+	if !used {
+		return 0, errTokenUsed
+	}
+	return claims.UserID, nil
+}
 
-	s := goalone.New(secretKey, goalone.Timestamp)
-	if strings.Contains(data, "?") {
-		urlToSign = fmt.Sprintf("%s&hash=", data)
-	} else {
-		urlToSign = fmt.Sprintf("%s?hash=", data)
+// VerifyLegacy checks a link from before link tokens: the whole URL, signed
+// with one of the legacy secrets, no more than lifetime ago. Nothing is
+// stored for these, so they can't be used up.
+func (s *TokenService) VerifyLegacy(signedURL string, lifetime time.Duration) error {
+	swords, err := s.Keys.verifiers("")
+	if err != nil {
+		return err
 	}
 
-	tokenBytes := s.Sign([]byte(urlToSign))
-	token := string(tokenBytes)
+	for _, sword := range swords {
+		if _, err := sword.Unsign([]byte(signedURL)); err != nil {
+			continue
+		}
+		if time.Since(sword.Parse([]byte(signedURL)).Timestamp) > lifetime {
+			return errTokenExpired
+		}
+		return nil
+	}
+	return errTokenInvalid
+}
 
-	return token
+// Revoke uses up every token the user has for the purpose.
+func (s *TokenService) Revoke(userID int, purpose string) error {
+	return s.Store.UseAll(userID, purpose)
 }
 
-// VerifyToken verifies a signed token
-func VerifyToken(token string) bool {
-	s := goalone.New(secretKey, goalone.Timestamp)
-	_, err := s.Unsign([]byte(token))
+// check verifies the token's signature, purpose and age, and finds it in
+// the store.
+func (s *TokenService) check(token, purpose string) (linkClaims, *data.LinkToken, error) {
+	claims, err := s.parse(token)
+	if err != nil {
+		return claims, nil, err
+	}
+
+	if claims.Purpose != purpose {
+		return claims, nil, errTokenInvalid
+	}
+	if time.Since(claims.IssuedAt) > tokenLifetimes[purpose] {
+		return claims, nil, errTokenExpired
+	}
 
+	stored, err := s.Store.GetByNonce(claims.Nonce)
+	if errors.Is(err, sql.ErrNoRows) {
+		return claims, nil, errTokenInvalid
+	}
 	if err != nil {
-		// signature is not valid. Token was tampered with, forged, or maybe it's
-		// not even a token at all! Either way, it's not safe to use it.
-		return false
+		return claims, nil, fmt.Errorf("finding link token: %w", err)
+	}
+
+	// the nonce is only ever issued once, but make sure it is this one
+	if stored.Purpose != claims.Purpose || stored.UserID != claims.UserID {
+		return claims, nil, errTokenInvalid
 	}
-	// valid hash
-	return true
 
+	return claims, stored, nil
 }
 
-// Expired checks to see if a token has expired
-func Expired(token string, minutesUntilExpire int) bool {
-	s := goalone.New(secretKey, goalone.Timestamp)
-	ts := s.Parse([]byte(token))
+// parse verifies the token's signature with the key that signed it, and
+// reads what it says.
+func (s *TokenService) parse(token string) (linkClaims, error) {
+	var claims linkClaims
+
+	// tokens from before key IDs have none
+	keyID, signed, ok := strings.Cut(token, tokenKeySep)
+	if !ok {
+		keyID, signed = "", token
+	}
+
+	swords, err := s.Keys.verifiers(keyID)
+	if err != nil {
+		return claims, err
+	}
+
+	for _, sword := range swords {
+		if _, err := sword.Unsign([]byte(signed)); err != nil {
+			continue
+		}
+
+		// the signed part is the payload and a timestamp
+		t := sword.Parse([]byte(signed))
+		parts := strings.Split(string(t.Payload), ".")
+		if len(parts) != 3 {
+			return claims, errTokenInvalid
+		}
+
+		userID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return claims, errTokenInvalid
+		}
+
+		claims = linkClaims{
+			Purpose:  parts[0],
+			UserID:   userID,
+			Nonce:    parts[2],
+			IssuedAt: t.Timestamp,
+		}
+		return claims, nil
+	}
+
+	// tampered with, forged, or signed with a key that has been retired
+	return claims, errTokenInvalid
+}
 
-	// time.Duration(seconds)*time.Second
-	return time.Since(ts.Timestamp) > time.Duration(minutesUntilExpire)*time.Minute
+// newNonce returns 16 random bytes, hex encoded.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("making nonce: %w", err)
+	}
+	return hex.EncodeToString(b), nil
 }
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"final-project/data"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	goalone "github.com/bwmarrin/go-alone"
+)
+
+// memoryLinkTokens is a link_tokens table in memory, so tokens can be
+// used up.
+type memoryLinkTokens struct {
+	mu     sync.Mutex
+	tokens []*data.LinkToken
+}
+
+func (s *memoryLinkTokens) Insert(token data.LinkToken) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token.ID = len(s.tokens) + 1
+	token.CreatedAt = time.Now()
+	s.tokens = append(s.tokens, &token)
+	return token.ID, nil
+}
+
+func (s *memoryLinkTokens) InsertTx(tx *sql.Tx, token data.LinkToken) (int, error) {
+	return s.Insert(token)
+}
+
+func (s *memoryLinkTokens) GetByNonce(nonce string) (*data.LinkToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if t.Nonce == nonce {
+			copied := *t
+			return &copied, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *memoryLinkTokens) Use(id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.tokens[id-1]
+	if t.UsedAt.Valid {
+		return false, nil
+	}
+	t.UsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	return true, nil
+}
+
+func (s *memoryLinkTokens) UseTx(tx *sql.Tx, id int) (bool, error) {
+	return s.Use(id)
+}
+
+func (s *memoryLinkTokens) UseAll(userID int, purpose string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tokens {
+		if t.UserID == userID && t.Purpose == purpose && !t.UsedAt.Valid {
+			t.UsedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+	return nil
+}
+
+// memorySigningKeys is a signing_keys table in memory, so keys can be
+// rotated.
+type memorySigningKeys struct {
+	mu   sync.Mutex
+	keys []*data.SigningKey
+}
+
+func (s *memorySigningKeys) Active() ([]*data.SigningKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var active []*data.SigningKey
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if !s.keys[i].RetiredAt.Valid {
+			copied := *s.keys[i]
+			active = append(active, &copied)
+		}
+	}
+	return active, nil
+}
+
+func (s *memorySigningKeys) Rotate(key data.SigningKey, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key.ID = len(s.keys) + 1
+	key.CreatedAt = time.Now()
+	s.keys = append(s.keys, &key)
+
+	kept := 0
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		if s.keys[i].RetiredAt.Valid {
+			continue
+		}
+		if kept++; kept > keep+1 {
+			s.keys[i].RetiredAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+	return nil
+}
+
+// newTestTokens is a token service with its own keys and tokens.
+func newTestTokens(keep int, legacy ...string) *TokenService {
+	keys := &Keyring{Store: &memorySigningKeys{}, Keep: keep, Legacy: legacy}
+	return NewTokenService(keys, &memoryLinkTokens{})
+}
+
+func TestTokenService_Redeem(t *testing.T) {
+	s := newTestTokens(2)
+
+	token, err := s.Issue(purposeReset, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it is only good for what it was made for
+	if _, err := s.Verify(token, purposeActivate); !errors.Is(err, errTokenInvalid) {
+		t.Errorf("expected a reset token to be no good for activation, got %v", err)
+	}
+
+	// and can't be changed to be for someone else
+	forged := strings.Replace(token, "reset.7.", "reset.8.", 1)
+	if _, err := s.Verify(forged, purposeReset); !errors.Is(err, errTokenInvalid) {
+		t.Errorf("expected a tampered token to be invalid, got %v", err)
+	}
+
+	userID, err := s.Redeem(token, purposeReset)
+	if err != nil || userID != 7 {
+		t.Fatalf("expected to redeem the token for user 7, got %d, %v", userID, err)
+	}
+
+	// it is used up
+	if _, err := s.Redeem(token, purposeReset); !errors.Is(err, errTokenUsed) {
+		t.Errorf("expected a used token to be rejected, got %v", err)
+	}
+	if _, err := s.Verify(token, purposeReset); !errors.Is(err, errTokenUsed) {
+		t.Errorf("expected a used token to fail verification, got %v", err)
+	}
+}
+
+func TestTokenService_expired(t *testing.T) {
+	s := newTestTokens(2, "a-secret")
+
+	// a token signed, before key IDs, just over the lifetime of a reset
+	// link ago
+	_, _ = s.Store.Insert(data.LinkToken{Purpose: purposeReset, UserID: 7, Nonce: "old"})
+	epoch := goalone.Epoch(int64((tokenLifetimes[purposeReset] + time.Minute).Seconds()))
+	sword := goalone.New([]byte("a-secret"), goalone.Timestamp, epoch)
+	token := string(sword.Sign([]byte("reset.7.old")))
+
+	if _, err := s.Verify(token, purposeReset); !errors.Is(err, errTokenExpired) {
+		t.Errorf("expected an old token to have expired, got %v", err)
+	}
+}
+
+func TestTokenService_legacy(t *testing.T) {
+	s := newTestTokens(2, "new-secret", "old-secret")
+
+	// a link in flight from before key IDs
+	_, _ = s.Store.Insert(data.LinkToken{Purpose: purposeActivate, UserID: 7, Nonce: "legacy"})
+	sword := goalone.New([]byte("old-secret"), goalone.Timestamp)
+	token := string(sword.Sign([]byte("activate.7.legacy")))
+
+	if userID, err := s.Redeem(token, purposeActivate); err != nil || userID != 7 {
+		t.Errorf("expected a legacy token to redeem for user 7, got %d, %v", userID, err)
+	}
+
+	// new tokens are signed with a key from the keyring
+	token, err := s.Issue(purposeActivate, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID, _, _ := strings.Cut(token, tokenKeySep); keyID == "" || keyID == token {
+		t.Errorf("expected a key ID in the token, got %q", token)
+	}
+}
+
+func TestTokenService_VerifyLegacy(t *testing.T) {
+	s := newTestTokens(2, "mail-secret")
+	link := "http://localhost:8080/activate?email=me@here.com&hash="
+
+	signed := string(goalone.New([]byte("mail-secret"), goalone.Timestamp).Sign([]byte(link)))
+	if err := s.VerifyLegacy(signed, time.Hour); err != nil {
+		t.Errorf("expected a legacy link to verify, got %v", err)
+	}
+
+	forged := strings.Replace(signed, "me@here.com", "you@here.com", 1)
+	if err := s.VerifyLegacy(forged, time.Hour); !errors.Is(err, errTokenInvalid) {
+		t.Errorf("expected a tampered link to be invalid, got %v", err)
+	}
+
+	epoch := goalone.Epoch(int64((time.Hour + time.Minute).Seconds()))
+	old := string(goalone.New([]byte("mail-secret"), goalone.Timestamp, epoch).Sign([]byte(link)))
+	if err := s.VerifyLegacy(old, time.Hour); !errors.Is(err, errTokenExpired) {
+		t.Errorf("expected a link from over an hour ago to have expired, got %v", err)
+	}
+}
+
+func TestTokenService_rotation(t *testing.T) {
+	s := newTestTokens(1)
+	keys := s.Keys.Store
+
+	// the first key is made on first use
+	first, err := s.Issue(purposeActivate, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another instance, or -rotate-link-key, rotates the keys
+	if _, err := rotateSigningKey(keys, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the key that signed the first token still verifies it
+	if _, err := s.Verify(first, purposeActivate); err != nil {
+		t.Errorf("expected a token from before the rotation to verify, got %v", err)
+	}
+
+	// new tokens are signed with the new key, once we have reread them
+	s.Keys.loaded = time.Time{}
+	second, err := s.Issue(purposeActivate, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstKey, _, _ := strings.Cut(first, tokenKeySep)
+	secondKey, _, _ := strings.Cut(second, tokenKeySep)
+	if firstKey == secondKey {
+		t.Errorf("expected the new token to be signed with the new key, got %s for both", firstKey)
+	}
+
+	// a second instance that hasn't seen the new key yet rereads the keys
+	// when a token signed with it comes in
+	other := NewTokenService(&Keyring{Store: keys, Keep: 1}, s.Store)
+	other.Keys.loaded = time.Now().Add(-keyringRetry - time.Second)
+	other.Keys.swords = map[string]*goalone.Sword{}
+	if _, err := other.Verify(second, purposeActivate); err != nil {
+		t.Errorf("expected another instance to pick up the new key, got %v", err)
+	}
+
+	// keeping one key before the current one, a second rotation retires
+	// the first key, and its tokens with it
+	if _, err := rotateSigningKey(keys, 1); err != nil {
+		t.Fatal(err)
+	}
+	s.Keys.loaded = time.Time{}
+	s.Keys.mu.Lock()
+	_ = s.Keys.load()
+	s.Keys.mu.Unlock()
+
+	if _, err := s.Verify(first, purposeActivate); !errors.Is(err, errTokenInvalid) {
+		t.Errorf("expected a token signed with a retired key to be invalid, got %v", err)
+	}
+	if _, err := s.Verify(second, purposeActivate); err != nil {
+		t.Errorf("expected a token signed with a kept key to verify, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/csv"
+	"final-project/data"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tax pricing modes; see TaxSettings.
+const (
+	taxExclusive = "exclusive"
+	taxInclusive = "inclusive"
+)
+
+// TaxCalculator works out the tax on invoices from the rates for each
+// region. Rates are in hundredths of a percent, and every amount is
+// rounded half away from zero to the cent.
+type TaxCalculator struct {
+	// prices already include tax
+	Inclusive bool
+	// used for a user with no region, or one we have no rates for
+	DefaultRegion string
+
+	rates map[string][]data.TaxRate
+}
+
+// newTaxCalculator indexes rates by region.
+func newTaxCalculator(rates []*data.TaxRate, settings TaxSettings) *TaxCalculator {
+	c := &TaxCalculator{
+		Inclusive:     settings.Pricing == taxInclusive,
+		DefaultRegion: settings.DefaultRegion,
+		rates:         make(map[string][]data.TaxRate),
+	}
+
+	for _, rate := range rates {
+		c.rates[rate.Region] = append(c.rates[rate.Region], *rate)
+	}
+
+	return c
+}
+
+// Regions returns the regions we have rates for, sorted.
+func (c *TaxCalculator) Regions() []string {
+	regions := make([]string, 0, len(c.rates))
+	for region := range c.rates {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// HasRegion says whether we have rates for region.
+func (c *TaxCalculator) HasRegion(region string) bool {
+	_, ok := c.rates[region]
+	return ok
+}
+
+// Rates returns the rates charged in region, falling back to the default
+// region. Nil means no tax.
+func (c *TaxCalculator) Rates(region string) []data.TaxRate {
+	if rates, ok := c.rates[region]; ok {
+		return rates
+	}
+	return c.rates[c.DefaultRegion]
+}
+
+// Apply sets the tax lines on an invoice whose line items are all added.
+// With exclusive pricing each tax is charged on the subtotal. With
+// inclusive pricing the subtotal is split into its net amount and the
+// taxes; the last tax takes up any rounding, so that they add up.
+func (c *TaxCalculator) Apply(invoice *data.Invoice, region string) {
+	rates := c.Rates(region)
+
+	net := invoice.Subtotal
+	if c.Inclusive {
+		total := 0
+		for _, rate := range rates {
+			total += rate.Rate
+		}
+		net = divRound(invoice.Subtotal*10000, 10000+total)
+	}
+
+	var lines []data.InvoiceTaxLine
+	tax := 0
+	for _, rate := range rates {
+		line := data.InvoiceTaxLine{
+			Region:  rate.Region,
+			Name:    rate.Name,
+			Rate:    rate.Rate,
+			Taxable: net,
+			Amount:  divRound(net*rate.Rate, 10000),
+		}
+		lines = append(lines, line)
+		tax += line.Amount
+	}
+
+	if c.Inclusive && len(lines) > 0 {
+		lines[len(lines)-1].Amount += invoice.Subtotal - net - tax
+	}
+
+	invoice.SetTax(lines, c.Inclusive)
+}
+
+// divRound divides a by b, rounding half away from zero. b must be
+// positive.
+func divRound(a, b int) int {
+	if a < 0 {
+		return -((-a + b/2) / b)
+	}
+	return (a + b/2) / b
+}
+
+// loadTaxRates reads the tax rates from file if it is set, or else from
+// the database.
+func loadTaxRates(file string, store data.TaxRateType) ([]*data.TaxRate, error) {
+	if file == "" {
+		return store.GetAll()
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rates, err := parseTaxRates(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return rates, nil
+}
+
+// parseTaxRates reads region,name,percent lines, such as "US-CA,Sales
+// tax,7.25". Lines starting with # are skipped.
+func parseTaxRates(r io.Reader) ([]*data.TaxRate, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+
+	var rates []*data.TaxRate
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(record[2], "%"), 64)
+		if err != nil || percent < 0 {
+			return nil, fmt.Errorf("line %d: invalid rate %q", line, record[2])
+		}
+
+		rates = append(rates, &data.TaxRate{
+			ID:     len(rates) + 1,
+			Region: strings.ToUpper(strings.TrimSpace(record[0])),
+			Name:   strings.TrimSpace(record[1]),
+			Rate:   int(math.Round(percent * 100)),
+		})
+	}
+
+	return rates, nil
+}
+
+// taxReportPeriod parses the first and last days of a tax report, as
+// 2006-01-02 dates. Either may be empty: from then defaults to the start
+// of the quarter that now falls in, and to defaults to now's date.
+func taxReportPeriod(from, to string, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	start := time.Date(now.Year(), (now.Month()-1)/3*3+1, 1, 0, 0, 0, 0, time.UTC)
+	if from != "" {
+		t, err := time.Parse("2006-01-02", from)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		start = t
+	}
+
+	end := today
+	if to != "" {
+		t, err := time.Parse("2006-01-02", to)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		end = t
+	}
+
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("report ends on %s, before it starts", to)
+	}
+
+	return start, end, nil
+}
+
+// writeTaxReportCSV writes the tax summary with plain decimal amounts, for
+// loading into a spreadsheet.
+func writeTaxReportCSV(w io.Writer, summary []*data.TaxSummary) error {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"currency", "region", "tax", "rate_percent", "invoices", "taxable", "tax_amount"})
+
+	for _, row := range summary {
+		units := data.CurrencyFor(row.Currency).MinorUnits
+		_ = out.Write([]string{
+			row.Currency,
+			row.Region,
+			row.Name,
+			strconv.FormatFloat(float64(row.Rate)/100, 'f', 2, 64),
+			strconv.Itoa(row.Invoices),
+			strconv.FormatFloat(float64(row.Taxable)/math.Pow10(units), 'f', units, 64),
+			strconv.FormatFloat(float64(row.Amount)/math.Pow10(units), 'f', units, 64),
+		})
+	}
+
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"final-project/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTaxCalculator(pricing string) *TaxCalculator {
+	return newTaxCalculator([]*data.TaxRate{
+		{Region: "GB", Name: "VAT", Rate: 2000},
+		{Region: "US-CA", Name: "State tax", Rate: 600},
+		{Region: "US-CA", Name: "County tax", Rate: 125},
+	}, TaxSettings{Pricing: pricing, DefaultRegion: "GB"})
+}
+
+func TestTaxCalculator_Apply(t *testing.T) {
+	tests := []struct {
+		name     string
+		pricing  string
+		region   string
+		amount   int
+		taxes    []int
+		subtotal int
+		total    int
+	}{
+		{"exclusive", taxExclusive, "GB", 4000, []int{800}, 4000, 4800},
+		{"exclusive rounds each tax", taxExclusive, "US-CA", 1999, []int{120, 25}, 1999, 2144},
+		{"unknown region uses the default", taxExclusive, "ZZ", 1000, []int{200}, 1000, 1200},
+		{"inclusive", taxInclusive, "GB", 4800, []int{800}, 4800, 4800},
+		{"inclusive adds up", taxInclusive, "US-CA", 1999, []int{112, 23}, 1999, 1999},
+	}
+
+	for _, tt := range tests {
+		invoice := &data.Invoice{}
+		invoice.AddLine("Plan", 1, tt.amount)
+		testTaxCalculator(tt.pricing).Apply(invoice, tt.region)
+
+		if len(invoice.TaxLines) != len(tt.taxes) {
+			t.Errorf("%s: expected %d tax lines, got %d", tt.name, len(tt.taxes), len(invoice.TaxLines))
+			continue
+		}
+		for i, want := range tt.taxes {
+			if invoice.TaxLines[i].Amount != want {
+				t.Errorf("%s: expected %s of %d, got %d", tt.name, invoice.TaxLines[i].Name, want, invoice.TaxLines[i].Amount)
+			}
+		}
+		if invoice.Subtotal != tt.subtotal || invoice.Total != tt.total {
+			t.Errorf("%s: expected subtotal %d and total %d, got %d and %d",
+				tt.name, tt.subtotal, tt.total, invoice.Subtotal, invoice.Total)
+		}
+		if tt.pricing == taxInclusive && invoice.TaxLines[0].Taxable+invoice.Tax != invoice.Total {
+			t.Errorf("%s: net %d and tax %d don't add up to %d", tt.name, invoice.TaxLines[0].Taxable, invoice.Tax, invoice.Total)
+		}
+	}
+}
+
+func TestTaxCalculator_noDefault(t *testing.T) {
+	calc := newTaxCalculator(nil, TaxSettings{Pricing: taxExclusive})
+
+	invoice := &data.Invoice{}
+	invoice.AddLine("Plan", 1, 1000)
+	calc.Apply(invoice, "GB")
+
+	if len(invoice.TaxLines) != 0 || invoice.Total != 1000 {
+		t.Errorf("expected no tax, got %d tax line(s) and a total of %d", len(invoice.TaxLines), invoice.Total)
+	}
+}
+
+func Test_parseTaxRates(t *testing.T) {
+	rates, err := parseTaxRates(strings.NewReader("# region,name,percent\ngb,VAT,20\nUS-CA, Sales tax, 7.25%\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rates) != 2 {
+		t.Fatalf("expected 2 rates, got %d", len(rates))
+	}
+	if rates[0].Region != "GB" || rates[0].Rate != 2000 {
+		t.Errorf("expected GB at 2000, got %s at %d", rates[0].Region, rates[0].Rate)
+	}
+	if rates[1].Name != "Sales tax" || rates[1].Rate != 725 {
+		t.Errorf("expected Sales tax at 725, got %s at %d", rates[1].Name, rates[1].Rate)
+	}
+
+	_, err = parseTaxRates(strings.NewReader("GB,VAT,twenty\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected an error for line 1, got %v", err)
+	}
+}
+
+func Test_taxReportPeriod(t *testing.T) {
+	now := time.Date(2022, 5, 12, 15, 0, 0, 0, time.UTC)
+
+	from, to, err := taxReportPeriod("", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Format("2006-01-02") != "2022-04-01" || to.Format("2006-01-02") != "2022-05-12" {
+		t.Errorf("expected the quarter to date, got %s to %s", from, to)
+	}
+
+	if _, _, err := taxReportPeriod("2022-05-01", "2022-04-01", now); err == nil {
+		t.Error("expected an error for a report that ends before it starts")
+	}
+}
+
+func TestHandlers_TaxReport_csv(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/admin/tax?from=2022-04-01&to=2022-06-30&format=csv", nil)
+	req = req.WithContext(createMockContext(req))
+
+	rr := httptest.NewRecorder()
+	testApp.TaxReport(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("tax-report: expected %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	if !strings.Contains(rr.Header().Get("Content-Disposition"), "tax-2022-04-01-2022-06-30.csv") {
+		t.Errorf("tax-report: unexpected Content-Disposition %q", rr.Header().Get("Content-Disposition"))
+	}
+
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 3 || lines[2] != "GBP,GB,VAT,20.00,3,45.00,9.00" {
+		t.Errorf("tax-report: unexpected CSV %q", rr.Body.String())
+	}
+}
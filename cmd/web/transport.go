@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// MailTransport hands a rendered message to whatever actually delivers it.
+type MailTransport interface {
+	Send(env Envelope) error
+}
+
+// Envelope is a fully rendered message, ready for a transport.
+type Envelope struct {
+	From      string
+	To        string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
+	// attachment name -> path of the file to attach
+	Attachments map[string]string
+	// attachment name -> contents
+	Files map[string][]byte
+}
+
+// newMailTransport picks a transport by name: "smtp" (the default),
+// "file" to write .eml files into dir, or "memory" to keep messages
+// in process.
+func newMailTransport(kind, dir string, smtp *SMTPTransport) (MailTransport, error) {
+	switch kind {
+	case "", "smtp":
+		return smtp, nil
+	case "file":
+		return &FileTransport{Dir: dir}, nil
+	case "memory":
+		return &MemoryTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", kind)
+	}
+}
+
+// toEmail builds the MIME message for env.
+func (env Envelope) toEmail() (*mail.Email, error) {
+	email := mail.NewMSG()
+	email.SetFrom(env.From).
+		AddTo(env.To).
+		SetSubject(env.Subject).
+		SetBody(mail.TextPlain, env.PlainBody).
+		AddAlternative(mail.TextHTML, env.HTMLBody)
+
+	for fname, atmt := range env.Attachments {
+		email.AddAttachment(atmt, fname)
+	}
+	for fname, contents := range env.Files {
+		email.Attach(&mail.File{Name: fname, Data: contents})
+	}
+
+	return email, email.GetError()
+}
+
+// SMTPTransport sends mail through an SMTP server.
+type SMTPTransport struct {
+	Host       string
+	Port       int
+	Username   string
+	Password   string
+	Encryption string
+}
+
+func (t *SMTPTransport) Send(env Envelope) error {
+	email, err := env.toEmail()
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	server := mail.NewSMTPClient()
+	server.Host = t.Host
+	server.Port = t.Port
+	server.Username = t.Username
+	server.Password = t.Password
+	server.Encryption = t.getEncryption(t.Encryption)
+	server.KeepAlive = false
+	server.ConnectTimeout = 10 * time.Second
+
+	smtpClient, err := server.Connect()
+	if err != nil {
+		return err
+	}
+
+	return email.Send(smtpClient)
+}
+
+func (t *SMTPTransport) getEncryption(e string) mail.Encryption {
+	switch e {
+	case "tls":
+		return mail.EncryptionSTARTTLS
+	case "ssl":
+		return mail.EncryptionSSLTLS
+	case "none":
+		return mail.Encryption(mail.EncryptionNone)
+	default:
+		return mail.EncryptionSTARTTLS
+	}
+}
+
+// FileTransport writes each message as an .eml file in Dir, which is
+// handy for local development without a mail server.
+type FileTransport struct {
+	Dir string
+	seq int64
+}
+
+func (t *FileTransport) Send(env Envelope) error {
+	email, err := env.toEmail()
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	err = os.MkdirAll(t.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%d.eml", time.Now().Format("20060102-150405.000"), atomic.AddInt64(&t.seq, 1))
+	return os.WriteFile(filepath.Join(t.Dir, name), []byte(email.GetMessage()), 0644)
+}
+
+// MemoryTransport keeps every message it is sent, for tests.
+type MemoryTransport struct {
+	mu   sync.Mutex
+	sent []Envelope
+}
+
+func (t *MemoryTransport) Send(env Envelope) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sent = append(t.sent, env)
+	return nil
+}
+
+// Messages returns a copy of everything sent so far.
+func (t *MemoryTransport) Messages() []Envelope {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Envelope(nil), t.sent...)
+}
+
+// Reset forgets everything sent so far.
+func (t *MemoryTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sent = nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testEnvelope = Envelope{
+	From:      "joe@mamma.org",
+	To:        "killroy@here.com",
+	Subject:   "Yer location",
+	PlainBody: "Where you was?",
+	HTMLBody:  "<p>Where you was?</p>",
+}
+
+func Test_newMailTransport(t *testing.T) {
+	var tests = []struct {
+		kind     string
+		expected string
+	}{
+		{"", "*main.SMTPTransport"},
+		{"smtp", "*main.SMTPTransport"},
+		{"file", "*main.FileTransport"},
+		{"memory", "*main.MemoryTransport"},
+	}
+
+	for _, tt := range tests {
+		transport, err := newMailTransport(tt.kind, "", &SMTPTransport{})
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.kind, err)
+			continue
+		}
+
+		if got := fmt.Sprintf("%T", transport); got != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.kind, tt.expected, got)
+		}
+	}
+
+	_, err := newMailTransport("carrier-pigeon", "", &SMTPTransport{})
+	if err == nil {
+		t.Error("expected an error for an unknown transport")
+	}
+}
+
+func TestFileTransport_Send(t *testing.T) {
+	dir := t.TempDir()
+	transport := &FileTransport{Dir: filepath.Join(dir, "mail")}
+
+	err := transport.Send(testEnvelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "mail", "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("expected 1 .eml file, got %d", len(files))
+	}
+
+	contents, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(contents), "Subject: Yer location") {
+		t.Error("expected the subject in the .eml file")
+	}
+}
+
+func TestEnvelope_toEmail_files(t *testing.T) {
+	// a message's files go through the outbox as JSON, and must come out
+	// the same
+	stored, err := json.Marshal(Message{Files: map[string][]byte{"Manual.pdf": []byte("%PDF-1.3")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	if err := json.Unmarshal(stored, &msg); err != nil {
+		t.Fatal(err)
+	}
+
+	env := testEnvelope
+	env.Files = msg.Files
+	email, err := env.toEmail()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := email.GetMessage()
+	if !strings.Contains(contents, `filename="Manual.pdf"`) {
+		t.Error("expected Manual.pdf attached")
+	}
+	if !strings.Contains(contents, base64.StdEncoding.EncodeToString([]byte("%PDF-1.3"))) {
+		t.Error("expected the file's contents attached")
+	}
+}
+
+// flakyTransport fails until it has been called failures times.
+type flakyTransport struct {
+	MemoryTransport
+	failures int
+	calls    int
+}
+
+func (t *flakyTransport) Send(env Envelope) error {
+	t.calls++
+	if t.calls <= t.failures {
+		return errors.New("421 try again later")
+	}
+	return t.MemoryTransport.Send(env)
+}
+
+func TestMail_deliver(t *testing.T) {
+	transport := &flakyTransport{failures: 2}
+	m := Mail{
+		Transport:   transport,
+		Templates:   testApp.Mailer.Templates,
+		MaxAttempts: 3,
+		Metrics:     &MailMetrics{},
+	}
+
+	msg := Message{To: "killroy@here.com", Subject: "Yer location", Data: "Where you was?"}
+
+	attempts, err := m.deliver(msg)
+	if err != nil {
+		t.Fatalf("expected delivery on the third attempt, got %v", err)
+	}
+
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+	if len(transport.Messages()) != 1 {
+		t.Errorf("expected 1 message sent, got %d", len(transport.Messages()))
+	}
+
+	// a template that doesn't exist is not worth retrying
+	transport = &flakyTransport{}
+	m.Transport = transport
+	msg.Template = "no-such-template"
+
+	attempts, err = m.deliver(msg)
+	if err == nil {
+		t.Fatal("expected an error for a missing template")
+	}
+
+	if attempts != 1 {
+		t.Errorf("expected a single attempt for a missing template, got %d", attempts)
+	}
+}
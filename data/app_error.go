@@ -0,0 +1,49 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// AppError is an error event kept for later inspection. Payload holds
+// whatever the reporter attached, as JSON.
+type AppError struct {
+	ID        int
+	Source    string
+	Severity  string
+	UserID    int
+	RequestID string
+	Message   string
+	Payload   []byte
+	CreatedAt time.Time
+}
+
+// Insert stores an error event, and returns the ID of the newly inserted row
+func (a *AppError) Insert(appErr AppError) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// not every error happens on behalf of a user
+	userID := sql.NullInt64{Int64: int64(appErr.UserID), Valid: appErr.UserID != 0}
+
+	var newID int
+	stmt := `insert into app_errors (source, severity, user_id, request_id, message, payload, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		appErr.Source,
+		appErr.Severity,
+		userID,
+		appErr.RequestID,
+		appErr.Message,
+		appErr.Payload,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
@@ -0,0 +1,190 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrCouponUnavailable is returned when a coupon has expired or been
+// redeemed as many times as it may be, and ErrCouponUsed when the user
+// has redeemed it before
+var (
+	ErrCouponUnavailable = errors.New("coupon is no longer available")
+	ErrCouponUsed        = errors.New("coupon already redeemed")
+)
+
+// Coupon is a discount code, for either PercentOff percent or AmountOff
+// off, in the minor unit of Currency. A coupon with a PlanID is only good
+// for that plan, and one with a MaxRedemptions of 0 may be redeemed any
+// number of times. Each user may redeem a coupon once.
+type Coupon struct {
+	ID             int
+	Code           string
+	PercentOff     int
+	AmountOff      int
+	Currency       string
+	PlanID         int
+	ExpiresAt      sql.NullTime
+	MaxRedemptions int
+	Redemptions    int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// Expired says whether the coupon had expired at now
+func (c Coupon) Expired(now time.Time) bool {
+	return c.ExpiresAt.Valid && !now.Before(c.ExpiresAt.Time)
+}
+
+// UsedUp says whether the coupon has been redeemed as often as it may be
+func (c Coupon) UsedUp() bool {
+	return c.MaxRedemptions > 0 && c.Redemptions >= c.MaxRedemptions
+}
+
+// Discount returns how much the coupon takes off amount, which must be in
+// the coupon's currency for a fixed amount off. Percentages are rounded
+// half up to the minor unit, and no discount is more than the amount.
+func (c Coupon) Discount(amount int) int {
+	if amount <= 0 {
+		return 0
+	}
+
+	discount := c.AmountOff
+	if c.PercentOff > 0 {
+		discount = (amount*c.PercentOff + 50) / 100
+	}
+	if discount > amount {
+		discount = amount
+	}
+	return discount
+}
+
+// DiscountForDisplay describes the discount, as in "10% off" or
+// "$5.00 off"
+func (c Coupon) DiscountForDisplay(locale string) string {
+	if c.PercentOff > 0 {
+		return fmt.Sprintf("%d%% off", c.PercentOff)
+	}
+	return fmt.Sprintf("%s off", FormatMoney(c.AmountOff, c.Currency, locale))
+}
+
+const couponColumns = `id, code, percent_off, amount_off, currency, coalesce(plan_id, 0), expires_at,
+	max_redemptions, redemptions, created_at, updated_at`
+
+// GetByCode returns the coupon with the given code, ignoring case
+func (c *Coupon) GetByCode(code string) (*Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + couponColumns + ` from coupons where code = $1`
+
+	return scanCoupon(db.QueryRowContext(ctx, query, strings.ToUpper(strings.TrimSpace(code))))
+}
+
+// GetOne returns one coupon by id
+func (c *Coupon) GetOne(id int) (*Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + couponColumns + ` from coupons where id = $1`
+
+	return scanCoupon(db.QueryRowContext(ctx, query, id))
+}
+
+func scanCoupon(row *sql.Row) (*Coupon, error) {
+	var coupon Coupon
+	err := row.Scan(
+		&coupon.ID,
+		&coupon.Code,
+		&coupon.PercentOff,
+		&coupon.AmountOff,
+		&coupon.Currency,
+		&coupon.PlanID,
+		&coupon.ExpiresAt,
+		&coupon.MaxRedemptions,
+		&coupon.Redemptions,
+		&coupon.CreatedAt,
+		&coupon.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &coupon, nil
+}
+
+// Redeemed says whether the user has redeemed the coupon
+func (c *Coupon) Redeemed(couponID, userID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var redeemed bool
+	err := db.QueryRowContext(ctx,
+		`select exists(select 1 from coupon_redemptions where coupon_id = $1 and user_id = $2)`,
+		couponID, userID).Scan(&redeemed)
+
+	return redeemed, err
+}
+
+// redeemCoupon records, as part of q, that the user has used the coupon.
+// It returns ErrCouponUsed if they have before, and ErrCouponUnavailable
+// if the coupon has expired or run out, which may have happened since it
+// was checked.
+func redeemCoupon(ctx context.Context, q queryer, couponID, userID int, now time.Time) error {
+	result, err := q.ExecContext(ctx, `insert into coupon_redemptions (coupon_id, user_id, created_at)
+		values ($1, $2, $3) on conflict (coupon_id, user_id) do nothing`,
+		couponID, userID, now)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCouponUsed
+	}
+
+	// counting the redemption in the same statement that checks the limit
+	// means two users can't both take the last one
+	result, err = q.ExecContext(ctx, `update coupons set redemptions = redemptions + 1, updated_at = $1
+		where id = $2
+		and (max_redemptions = 0 or redemptions < max_redemptions)
+		and (expires_at is null or expires_at > $1)`,
+		now, couponID)
+	if err != nil {
+		return err
+	}
+	n, err = result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCouponUnavailable
+	}
+
+	return nil
+}
+
+// releaseCoupon gives back, as part of q, the user's redemption of the
+// coupon, so that they, or someone else, can use it.
+func releaseCoupon(ctx context.Context, q queryer, couponID, userID int, now time.Time) error {
+	result, err := q.ExecContext(ctx, `delete from coupon_redemptions where coupon_id = $1 and user_id = $2`,
+		couponID, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return err
+	}
+
+	_, err = q.ExecContext(ctx, `update coupons set redemptions = redemptions - 1, updated_at = $1
+		where id = $2 and redemptions > 0`,
+		now, couponID)
+	return err
+}
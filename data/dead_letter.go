@@ -0,0 +1,155 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// DeadLetter is a mail message that could not be delivered. Payload holds
+// the original message as JSON so it can be replayed.
+type DeadLetter struct {
+	ID        int
+	Recipient string
+	Subject   string
+	Template  string
+	Payload   []byte
+	LastError string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// GetAll returns all dead letters, newest first
+func (d *DeadLetter) GetAll() ([]*DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, recipient, subject, template, payload, last_error, attempts, created_at
+	from mail_dead_letters order by created_at desc`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []*DeadLetter
+
+	for rows.Next() {
+		var letter DeadLetter
+		err := rows.Scan(
+			&letter.ID,
+			&letter.Recipient,
+			&letter.Subject,
+			&letter.Template,
+			&letter.Payload,
+			&letter.LastError,
+			&letter.Attempts,
+			&letter.CreatedAt,
+		)
+		if err != nil {
+			logger.Error("error scanning dead letter", "error", err)
+			return nil, err
+		}
+
+		letters = append(letters, &letter)
+	}
+
+	return letters, nil
+}
+
+// GetOne returns one dead letter by id
+func (d *DeadLetter) GetOne(id int) (*DeadLetter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, recipient, subject, template, payload, last_error, attempts, created_at
+	from mail_dead_letters where id = $1`
+
+	var letter DeadLetter
+	row := db.QueryRowContext(ctx, query, id)
+
+	err := row.Scan(
+		&letter.ID,
+		&letter.Recipient,
+		&letter.Subject,
+		&letter.Template,
+		&letter.Payload,
+		&letter.LastError,
+		&letter.Attempts,
+		&letter.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &letter, nil
+}
+
+// Insert stores a failed message, and returns the ID of the newly inserted row
+func (d *DeadLetter) Insert(letter DeadLetter) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into mail_dead_letters (recipient, subject, template, payload, last_error, attempts, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		letter.Recipient,
+		letter.Subject,
+		letter.Template,
+		letter.Payload,
+		letter.LastError,
+		letter.Attempts,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteByID deletes one dead letter, typically once it has been replayed
+func (d *DeadLetter) DeleteByID(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from mail_dead_letters where id = $1`
+
+	_, err := db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Requeue moves a dead letter back to the mail outbox, claimed by the
+// caller for lease, and returns the ID of the new outbox row. The move is
+// one statement, so the letter is never lost, or queued twice: a letter
+// that has already been requeued returns sql.ErrNoRows.
+func (d *DeadLetter) Requeue(id int, lease time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	stmt := `
+	with letter as (
+		delete from mail_dead_letters where id = $1 returning payload
+	)
+	insert into mail_outbox (payload, status, attempts, locked_until, created_at, updated_at)
+		select payload, $2, 1, $3, $4, $4 from letter
+	returning id`
+
+	var outboxID int
+	err := db.QueryRowContext(ctx, stmt, id, OutboxPending, now.Add(lease), now).Scan(&outboxID)
+	if err != nil {
+		return 0, err
+	}
+
+	return outboxID, nil
+}
@@ -1,19 +1,119 @@
 package data
 
+import (
+	"database/sql"
+	"time"
+)
+
 type UserType interface {
 	GetAll() ([]*User, error)
 	GetByEmail(email string) (*User, error)
 	GetOne(id int) (*User, error)
 	Update(user User) error
+	SetLocale(id int, locale string) error
 	DeleteByID(id int) error
 	Insert(user User) (int, error)
+	InsertTx(tx *sql.Tx, user User) (int, error)
 	ResetPassword(user User, password string) error
+	ResetPasswordTx(tx *sql.Tx, user User, password string) error
 	PasswordMatches(user User, plainText string) (bool, error)
 }
 
 type PlanType interface {
 	GetAll() ([]*Plan, error)
 	GetOne(id int) (*Plan, error)
-	SubscribeUserToPlan(user User, plan Plan) error
+	SubscribeUserToPlan(user User, plan Plan, fromPlanID int, periodStart time.Time) error
+	GetSubscription(userID int) (*Subscription, error)
+	CancelSubscription(userID int, atPeriodEnd bool) error
+	ResumeSubscription(userID int) error
+	RenewSubscription(id int) error
+	DueSubscriptions(now time.Time, limit int) ([]*Subscription, error)
+	DeferRenewal(id int, retryAt time.Time) error
+	MarkPastDue(userID int) (bool, error)
+	RecoverSubscription(userID int) error
+	DowngradeSubscription(userID, planID int) error
+	SubscriptionHistory(userID int) ([]*SubscriptionEvent, error)
 	AmountForDisplay() string
 }
+
+type DeadLetterType interface {
+	GetAll() ([]*DeadLetter, error)
+	GetOne(id int) (*DeadLetter, error)
+	Insert(letter DeadLetter) (int, error)
+	DeleteByID(id int) error
+	Requeue(id int, lease time.Duration) (int, error)
+}
+
+type OutboxType interface {
+	Enqueue(payload []byte, lease time.Duration) (int, error)
+	EnqueueTx(tx *sql.Tx, payload []byte, lease time.Duration) (int, error)
+	Claim(limit int, lease time.Duration) ([]*OutboxMessage, error)
+	MarkSent(id int) error
+	MarkFailed(id int, lastError string) error
+	Release(id int) error
+}
+
+type JobType interface {
+	Enqueue(kind string, payload []byte, runAt time.Time) (int, error)
+	Claim(limit int, lease time.Duration) ([]*Job, error)
+	MarkDone(id int) error
+	Retry(id int, runAt time.Time, lastError string) error
+	MarkFailed(id int, lastError string) error
+	Release(id int) error
+}
+
+type InvoiceType interface {
+	Insert(invoice Invoice) (int, error)
+	GetOne(id int) (*Invoice, error)
+	GetForPeriod(userID, planID int, periodStart time.Time) (*Invoice, error)
+	GetPaidThrough(userID, planID int, periodEnd time.Time) (*Invoice, error)
+	UpdateStatus(id int, status string) error
+	Void(id int) (bool, error)
+	TaxSummary(from, to time.Time) ([]*TaxSummary, error)
+}
+
+type TaxRateType interface {
+	GetAll() ([]*TaxRate, error)
+}
+
+type CouponType interface {
+	GetByCode(code string) (*Coupon, error)
+	GetOne(id int) (*Coupon, error)
+	Redeemed(couponID, userID int) (bool, error)
+}
+
+type PaymentType interface {
+	Insert(payment Payment) (int, error)
+	SetCharge(id int, chargeID, status, failureMessage string) error
+	GetByChargeID(chargeID string) (*Payment, error)
+	GetForInvoice(invoiceID int) ([]*Payment, error)
+	SetStatus(id int, from, to, failureMessage string) (bool, error)
+}
+
+type LinkTokenType interface {
+	Insert(token LinkToken) (int, error)
+	InsertTx(tx *sql.Tx, token LinkToken) (int, error)
+	GetByNonce(nonce string) (*LinkToken, error)
+	Use(id int) (bool, error)
+	UseTx(tx *sql.Tx, id int) (bool, error)
+	UseAll(userID int, purpose string) error
+}
+
+type SigningKeyType interface {
+	Active() ([]*SigningKey, error)
+	Rotate(key SigningKey, keep int) error
+}
+
+type LockType interface {
+	TryAcquire() (bool, error)
+	Check() error
+	Release() error
+}
+
+type AppErrorType interface {
+	Insert(appErr AppError) (int, error)
+}
+
+type TxType interface {
+	InTx(fn func(tx *sql.Tx) error) error
+}
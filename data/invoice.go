@@ -0,0 +1,469 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Invoice statuses
+const (
+	InvoiceIssued = "issued"
+	InvoicePaid   = "paid"
+	InvoiceVoid   = "void"
+)
+
+// Invoice is a bill for one billing period. Amounts are in the minor unit
+// of Currency, and are written out the way Locale writes them. Number is
+// sequential, without gaps, across all invoices. When TaxInclusive is set,
+// the line amounts already include the tax, and Total equals Subtotal.
+// CouponID is the coupon taken off the invoice, if there is one; the
+// user's redemption of it is made with the invoice, and given back if the
+// invoice is voided.
+type Invoice struct {
+	ID           int
+	Number       int
+	UserID       int
+	PlanID       int
+	CouponID     int
+	Status       string
+	Currency     string
+	Locale       string
+	PeriodStart  time.Time
+	PeriodEnd    time.Time
+	Subtotal     int
+	Tax          int
+	Total        int
+	TaxInclusive bool
+	Lines        []InvoiceLine
+	TaxLines     []InvoiceTaxLine
+	IssuedAt     time.Time
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// InvoiceLine is one line item on an invoice. A credit gives back what was
+// paid for time not used on the plan before a switch.
+type InvoiceLine struct {
+	ID          int
+	InvoiceID   int
+	Description string
+	Quantity    int
+	UnitAmount  int
+	Amount      int
+	Credit      bool
+}
+
+// InvoiceTaxLine is one tax charged on an invoice. Taxable is the amount
+// the tax was charged on, net of tax.
+type InvoiceTaxLine struct {
+	ID        int
+	InvoiceID int
+	Region    string
+	Name      string
+	Rate      int
+	Taxable   int
+	Amount    int
+}
+
+// TaxSummary totals the tax charged at one rate, in one currency, over a
+// period, for filing
+type TaxSummary struct {
+	Currency string
+	Region   string
+	Name     string
+	Rate     int
+	Invoices int
+	Taxable  int
+	Amount   int
+}
+
+// AddLine adds a line item, and updates the totals to match. Add every
+// line before setting the tax.
+func (inv *Invoice) AddLine(description string, quantity, unitAmount int) {
+	line := InvoiceLine{
+		Description: description,
+		Quantity:    quantity,
+		UnitAmount:  unitAmount,
+		Amount:      quantity * unitAmount,
+	}
+	inv.Lines = append(inv.Lines, line)
+	inv.Subtotal += line.Amount
+	inv.updateTotals()
+}
+
+// AddCredit adds a credit of amount, and updates the totals to match. Add
+// every line before setting the tax.
+func (inv *Invoice) AddCredit(description string, amount int) {
+	inv.AddLine(description, 1, -amount)
+	inv.Lines[len(inv.Lines)-1].Credit = true
+}
+
+// SetTax replaces the tax lines, and updates the totals to match
+func (inv *Invoice) SetTax(lines []InvoiceTaxLine, inclusive bool) {
+	inv.TaxLines = lines
+	inv.TaxInclusive = inclusive
+	inv.updateTotals()
+}
+
+func (inv *Invoice) updateTotals() {
+	inv.Tax = 0
+	for _, line := range inv.TaxLines {
+		inv.Tax += line.Amount
+	}
+
+	inv.Total = inv.Subtotal
+	if !inv.TaxInclusive {
+		inv.Total += inv.Tax
+	}
+}
+
+// DisplayNumber is the invoice number as printed on the invoice
+func (inv *Invoice) DisplayNumber() string {
+	return fmt.Sprintf("INV-%06d", inv.Number)
+}
+
+// PeriodForDisplay is the billing period as printed on the invoice
+func (inv *Invoice) PeriodForDisplay() string {
+	return fmt.Sprintf("%s to %s", inv.PeriodStart.Format("Jan 2, 2006"), inv.PeriodEnd.Format("Jan 2, 2006"))
+}
+
+// FormatAmount writes an amount on the invoice, such as a line's, in the
+// invoice's currency and locale
+func (inv *Invoice) FormatAmount(amount int) string {
+	return FormatMoney(amount, inv.Currency, inv.Locale)
+}
+
+// SubtotalForDisplay formats the subtotal as a currency string
+func (inv *Invoice) SubtotalForDisplay() string {
+	return inv.FormatAmount(inv.Subtotal)
+}
+
+// TaxForDisplay formats the tax as a currency string
+func (inv *Invoice) TaxForDisplay() string {
+	return inv.FormatAmount(inv.Tax)
+}
+
+// TotalForDisplay formats the total as a currency string
+func (inv *Invoice) TotalForDisplay() string {
+	return inv.FormatAmount(inv.Total)
+}
+
+// Label describes the tax, as in "VAT (GB) 20%"
+func (l InvoiceTaxLine) Label() string {
+	return fmt.Sprintf("%s (%s) %s", l.Name, l.Region, rateForDisplay(l.Rate))
+}
+
+// RateForDisplay formats the rate as a percentage
+func (s TaxSummary) RateForDisplay() string {
+	return rateForDisplay(s.Rate)
+}
+
+// TaxableForDisplay formats the taxable amount as a currency string
+func (s TaxSummary) TaxableForDisplay() string {
+	return FormatMoney(s.Taxable, s.Currency, DefaultLocale)
+}
+
+// AmountForDisplay formats the tax amount as a currency string
+func (s TaxSummary) AmountForDisplay() string {
+	return FormatMoney(s.Amount, s.Currency, DefaultLocale)
+}
+
+// Insert stores an invoice and its lines, giving it the next invoice number,
+// and returns the ID of the newly inserted row. The user redeems the coupon
+// on it, if there is one; if they can't, Insert returns ErrCouponUsed or
+// ErrCouponUnavailable, and stores nothing.
+func (inv *Invoice) Insert(invoice Invoice) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// the counter row stays locked until we commit, so numbers are
+	// handed out in order and a rollback leaves no gap
+	var number int
+	err = tx.QueryRowContext(ctx,
+		`update invoice_numbers set last_number = last_number + 1 where id = 1 returning last_number`,
+	).Scan(&number)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+
+	var newID int
+	stmt := `insert into invoices (number, user_id, plan_id, coupon_id, status, currency, locale, period_start,
+		period_end, subtotal, tax, total, tax_inclusive, issued_at, created_at, updated_at)
+		values ($1, $2, $3, nullif($4, 0), $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		number,
+		invoice.UserID,
+		invoice.PlanID,
+		invoice.CouponID,
+		invoice.Status,
+		invoice.Currency,
+		invoice.Locale,
+		invoice.PeriodStart,
+		invoice.PeriodEnd,
+		invoice.Subtotal,
+		invoice.Tax,
+		invoice.Total,
+		invoice.TaxInclusive,
+		now,
+		now,
+		now,
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	// the coupon is the user's once the invoice is, before they are
+	// charged for it, so two checkouts at once can't both have it
+	if invoice.CouponID != 0 {
+		err = redeemCoupon(ctx, tx, invoice.CouponID, invoice.UserID, now)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	stmt = `insert into invoice_lines (invoice_id, description, quantity, unit_amount, amount, credit)
+		values ($1, $2, $3, $4, $5, $6)`
+
+	for _, line := range invoice.Lines {
+		_, err = tx.ExecContext(ctx, stmt, newID, line.Description, line.Quantity, line.UnitAmount, line.Amount, line.Credit)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	stmt = `insert into invoice_tax_lines (invoice_id, region, name, rate, taxable, amount)
+		values ($1, $2, $3, $4, $5, $6)`
+
+	for _, line := range invoice.TaxLines {
+		_, err = tx.ExecContext(ctx, stmt, newID, line.Region, line.Name, line.Rate, line.Taxable, line.Amount)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetOne returns one invoice, with its lines, by id
+func (inv *Invoice) GetOne(id int) (*Invoice, error) {
+	return inv.getOne(`where id = $1`, id)
+}
+
+// GetForPeriod returns the user's invoice for a plan and billing period, if
+// there is one
+func (inv *Invoice) GetForPeriod(userID, planID int, periodStart time.Time) (*Invoice, error) {
+	return inv.getOne(`where user_id = $1 and plan_id = $2 and period_start = $3`, userID, planID, periodStart)
+}
+
+// GetPaidThrough returns the user's latest paid invoice for a plan whose
+// period ends at periodEnd: what they paid for the plan's current period,
+// or the part of it since they switched to it
+func (inv *Invoice) GetPaidThrough(userID, planID int, periodEnd time.Time) (*Invoice, error) {
+	return inv.getOne(`where user_id = $1 and plan_id = $2 and period_end = $3 and status = $4
+		order by period_start desc, id desc limit 1`, userID, planID, periodEnd, InvoicePaid)
+}
+
+func (inv *Invoice) getOne(where string, args ...any) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, number, user_id, plan_id, coalesce(coupon_id, 0), status, currency, locale, period_start,
+		period_end, subtotal, tax, total, tax_inclusive, issued_at, created_at, updated_at
+	from invoices ` + where
+
+	var invoice Invoice
+	row := db.QueryRowContext(ctx, query, args...)
+
+	err := row.Scan(
+		&invoice.ID,
+		&invoice.Number,
+		&invoice.UserID,
+		&invoice.PlanID,
+		&invoice.CouponID,
+		&invoice.Status,
+		&invoice.Currency,
+		&invoice.Locale,
+		&invoice.PeriodStart,
+		&invoice.PeriodEnd,
+		&invoice.Subtotal,
+		&invoice.Tax,
+		&invoice.Total,
+		&invoice.TaxInclusive,
+		&invoice.IssuedAt,
+		&invoice.CreatedAt,
+		&invoice.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `select id, invoice_id, description, quantity, unit_amount, amount, credit
+	from invoice_lines where invoice_id = $1 order by id`
+
+	rows, err := db.QueryContext(ctx, query, invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var line InvoiceLine
+		err := rows.Scan(
+			&line.ID,
+			&line.InvoiceID,
+			&line.Description,
+			&line.Quantity,
+			&line.UnitAmount,
+			&line.Amount,
+			&line.Credit,
+		)
+		if err != nil {
+			logger.Error("error scanning invoice line", "error", err)
+			return nil, err
+		}
+
+		invoice.Lines = append(invoice.Lines, line)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `select id, invoice_id, region, name, rate, taxable, amount
+	from invoice_tax_lines where invoice_id = $1 order by id`
+
+	taxRows, err := db.QueryContext(ctx, query, invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer taxRows.Close()
+
+	for taxRows.Next() {
+		var line InvoiceTaxLine
+		err := taxRows.Scan(
+			&line.ID,
+			&line.InvoiceID,
+			&line.Region,
+			&line.Name,
+			&line.Rate,
+			&line.Taxable,
+			&line.Amount,
+		)
+		if err != nil {
+			logger.Error("error scanning invoice tax line", "error", err)
+			return nil, err
+		}
+
+		invoice.TaxLines = append(invoice.TaxLines, line)
+	}
+
+	return &invoice, taxRows.Err()
+}
+
+// TaxSummary totals the tax on invoices issued from from up to, but not
+// including, to. Void invoices are left out.
+func (inv *Invoice) TaxSummary(from, to time.Time) ([]*TaxSummary, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select i.currency, t.region, t.name, t.rate, count(distinct i.id), sum(t.taxable), sum(t.amount)
+	from invoice_tax_lines t
+	join invoices i on (i.id = t.invoice_id)
+	where i.issued_at >= $1 and i.issued_at < $2 and i.status <> $3
+	group by i.currency, t.region, t.name, t.rate
+	order by i.currency, t.region, t.name, t.rate`
+
+	rows, err := db.QueryContext(ctx, query, from, to, InvoiceVoid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summary []*TaxSummary
+
+	for rows.Next() {
+		var row TaxSummary
+		err := rows.Scan(
+			&row.Currency,
+			&row.Region,
+			&row.Name,
+			&row.Rate,
+			&row.Invoices,
+			&row.Taxable,
+			&row.Amount,
+		)
+		if err != nil {
+			logger.Error("error scanning tax summary", "error", err)
+			return nil, err
+		}
+
+		summary = append(summary, &row)
+	}
+
+	return summary, rows.Err()
+}
+
+// UpdateStatus sets the status of an invoice, such as marking it paid
+func (inv *Invoice) UpdateStatus(id int, status string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update invoices set status = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, status, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Void voids an invoice that is still waiting to be paid, and gives back
+// the coupon on it, and says whether it did. One that has been paid, say
+// by another try at the same checkout, is left alone.
+func (inv *Invoice) Void(id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	var userID, couponID int
+	err = tx.QueryRowContext(ctx, `update invoices set status = $1, updated_at = $2 where id = $3 and status = $4
+		returning user_id, coalesce(coupon_id, 0)`,
+		InvoiceVoid, now, id, InvoiceIssued).Scan(&userID, &couponID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if couponID != 0 {
+		if err := releaseCoupon(ctx, tx, couponID, userID, now); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit()
+}
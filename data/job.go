@@ -0,0 +1,180 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// Job statuses
+const (
+	JobPending = "pending"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is one unit of background work. Kind says which handler runs it, and
+// Payload holds its arguments as JSON. A pending job runs once RunAt has
+// passed. Like the mail outbox, a row is claimed by setting LockedUntil;
+// if the claiming process dies, the job becomes claimable again once the
+// lock lapses.
+type Job struct {
+	ID          int
+	Kind        string
+	Payload     []byte
+	Status      string
+	Attempts    int
+	RunAt       time.Time
+	LockedUntil time.Time
+	LastError   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Enqueue stores a new job to run at runAt, and returns the ID of the newly
+// inserted row
+func (j *Job) Enqueue(kind string, payload []byte, runAt time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	var newID int
+	stmt := `insert into jobs (kind, payload, status, attempts, run_at, locked_until, created_at, updated_at)
+		values ($1, $2, $3, 0, $4, $5, $6, $7) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		kind,
+		payload,
+		JobPending,
+		runAt,
+		now,
+		now,
+		now,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Claim locks up to limit pending jobs that are due and not claimed by
+// anyone else, counts an attempt against each, and returns them. Rows
+// locked by another instance are skipped rather than waited on.
+func (j *Job) Claim(limit int, lease time.Duration) ([]*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `
+	update jobs set
+		locked_until = $2,
+		attempts = attempts + 1,
+		updated_at = $3
+	where id in (
+		select id from jobs
+		where status = 'pending' and run_at <= $3 and locked_until <= $3
+		order by run_at, id
+		limit $1
+		for update skip locked
+	)
+	returning id, kind, payload, status, attempts, run_at, locked_until, created_at, updated_at`
+
+	rows, err := db.QueryContext(ctx, query, limit, now.Add(lease), now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+
+	for rows.Next() {
+		var job Job
+		err := rows.Scan(
+			&job.ID,
+			&job.Kind,
+			&job.Payload,
+			&job.Status,
+			&job.Attempts,
+			&job.RunAt,
+			&job.LockedUntil,
+			&job.CreatedAt,
+			&job.UpdatedAt,
+		)
+		if err != nil {
+			logger.Error("error scanning job", "error", err)
+			return nil, err
+		}
+
+		jobs = append(jobs, &job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// MarkDone records that a job succeeded
+func (j *Job) MarkDone(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set status = $1, last_error = null, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, JobDone, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Retry releases a job that failed, to run again at runAt
+func (j *Job) Retry(id int, runAt time.Time, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	stmt := `update jobs set run_at = $1, locked_until = $2, last_error = $3, updated_at = $2
+		where id = $4 and status = $5`
+
+	_, err := db.ExecContext(ctx, stmt, runAt, now, lastError, id, JobPending)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkFailed records that we gave up on a job
+func (j *Job) MarkFailed(id int, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update jobs set status = $1, last_error = $2, updated_at = $3 where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, JobFailed, lastError, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Release gives up our claim on a job we did not get to, without counting
+// the attempt, so that any instance can run it straight away
+func (j *Job) Release(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+	stmt := `update jobs set locked_until = $1, attempts = greatest(attempts - 1, 0), updated_at = $1
+		where id = $2 and status = $3`
+
+	_, err := db.ExecContext(ctx, stmt, now, id, JobPending)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// LinkToken is the server side of a signed token we mail out in a link,
+// such as to activate an account or reset a password. The signed token
+// carries the nonce; a token is only good while its row here is unused.
+type LinkToken struct {
+	ID        int
+	Purpose   string
+	UserID    int
+	Nonce     string
+	UsedAt    sql.NullTime
+	CreatedAt time.Time
+}
+
+// Insert stores a new token, and returns its id.
+func (t *LinkToken) Insert(token LinkToken) (int, error) {
+	return insertLinkToken(db, token)
+}
+
+// InsertTx stores a new token as part of tx, and returns its id.
+func (t *LinkToken) InsertTx(tx *sql.Tx, token LinkToken) (int, error) {
+	return insertLinkToken(tx, token)
+}
+
+func insertLinkToken(q queryer, token LinkToken) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into link_tokens (purpose, user_id, nonce, created_at)
+		values ($1, $2, $3, $4) returning id`
+
+	var id int
+	err := q.QueryRowContext(ctx, stmt, token.Purpose, token.UserID, token.Nonce, time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// GetByNonce returns the token with the nonce, used or not.
+func (t *LinkToken) GetByNonce(nonce string) (*LinkToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, purpose, user_id, nonce, used_at, created_at
+	from link_tokens where nonce = $1`
+
+	var token LinkToken
+	row := db.QueryRowContext(ctx, query, nonce)
+
+	err := row.Scan(
+		&token.ID,
+		&token.Purpose,
+		&token.UserID,
+		&token.Nonce,
+		&token.UsedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// Use marks the token used. It reports false if it already was, so of
+// two requests racing with the same token, only one gets to use it.
+func (t *LinkToken) Use(id int) (bool, error) {
+	return useLinkToken(db, id)
+}
+
+// UseTx is Use, as part of tx; if tx rolls back, the token is still good.
+func (t *LinkToken) UseTx(tx *sql.Tx, id int) (bool, error) {
+	return useLinkToken(tx, id)
+}
+
+func useLinkToken(q queryer, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update link_tokens set used_at = $1 where id = $2 and used_at is null`
+
+	result, err := q.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// UseAll marks every unused token the user has for the purpose used, such
+// as the other reset links they asked for, once their password is reset.
+func (t *LinkToken) UseAll(userID int, purpose string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update link_tokens set used_at = $1 where user_id = $2 and purpose = $3 and used_at is null`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), userID, purpose)
+	return err
+}
@@ -0,0 +1,102 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// Advisory lock keys. Every instance that runs the same work tries for the
+// same key, and only the one that gets it does the work.
+const (
+	BillingLockKey int64 = 0x62696c6c // "bill"
+)
+
+// errLockLost is returned by Check once the connection holding the lock
+// has gone, and the lock with it.
+var errLockLost = errors.New("advisory lock lost")
+
+// AdvisoryLock is a Postgres session-level advisory lock. Postgres holds
+// it for as long as the connection that took it stays open, so it keeps a
+// connection out of the pool until Release; if we die, the lock goes with
+// the connection, and another instance can take it.
+type AdvisoryLock struct {
+	Key int64
+
+	mu   sync.Mutex
+	conn *sql.Conn
+}
+
+// TryAcquire takes the lock if nobody else holds it, and says whether we
+// hold it now. It doesn't wait.
+func (l *AdvisoryLock) TryAcquire() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn != nil {
+		return true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var acquired bool
+	err = conn.QueryRowContext(ctx, `select pg_try_advisory_lock($1)`, l.Key).Scan(&acquired)
+	if err != nil || !acquired {
+		conn.Close()
+		return false, err
+	}
+
+	l.conn = conn
+	return true, nil
+}
+
+// Check says whether we still hold the lock. If the connection holding it
+// has broken, the lock is gone, and Check returns an error; TryAcquire
+// can then try for it again.
+func (l *AdvisoryLock) Check() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return errLockLost
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if err := l.conn.PingContext(ctx); err != nil {
+		l.conn.Close()
+		l.conn = nil
+		return errors.Join(errLockLost, err)
+	}
+
+	return nil
+}
+
+// Release gives up the lock, if we hold it.
+func (l *AdvisoryLock) Release() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := l.conn.ExecContext(ctx, `select pg_advisory_unlock($1)`, l.Key)
+
+	// closing the connection releases the lock even if unlocking failed
+	l.conn.Close()
+	l.conn = nil
+
+	return err
+}
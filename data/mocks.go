@@ -3,14 +3,27 @@ package data
 import (
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 )
 
 func NewTestModels(dbPool *sql.DB) Models {
 	db = dbPool
 	return Models{
-		User: &UserTest{},
-		Plan: &PlanTest{},
+		User:        &UserTest{},
+		Plan:        &PlanTest{},
+		DeadLetter:  &DeadLetterTest{},
+		Outbox:      &OutboxTest{},
+		AppError:    &AppErrorTest{},
+		Job:         &JobTest{},
+		Invoice:     &InvoiceTest{},
+		TaxRate:     &TaxRateTest{},
+		Coupon:      &CouponTest{},
+		Payment:     &PaymentTest{},
+		LinkToken:   &LinkTokenTest{},
+		SigningKey:  &SigningKeyTest{},
+		BillingLock: &LockTest{},
+		Tx:          &TxTest{},
 	}
 }
 
@@ -28,6 +41,54 @@ type UserTest struct {
 	FailTest  bool
 }
 
+type DeadLetterTest struct {
+	FailTest bool
+}
+
+type OutboxTest struct {
+	FailTest bool
+}
+
+type AppErrorTest struct {
+	FailTest bool
+}
+
+type JobTest struct {
+	FailTest bool
+}
+
+type InvoiceTest struct {
+	FailTest bool
+}
+
+type TaxRateTest struct {
+	FailTest bool
+}
+
+type CouponTest struct {
+	FailTest bool
+}
+
+type PaymentTest struct {
+	FailTest bool
+}
+
+type LinkTokenTest struct {
+	FailTest bool
+}
+
+type SigningKeyTest struct {
+	FailTest bool
+}
+
+type LockTest struct {
+	FailTest bool
+}
+
+type TxTest struct {
+	FailTest bool
+}
+
 type PlanTest struct {
 	ID                  int
 	PlanName            string
@@ -87,6 +148,8 @@ func (u *UserTest) GetByEmail(email string) (*User, error) {
 		PlanName:            "Fake Plan",
 		PlanAmount:          1500,
 		PlanAmountFormatted: "$15.00",
+		Currency:            "USD",
+		Prices:              map[string]int{"EUR": 1400, "GBP": 1200},
 		CreatedAt:           time.Now(),
 		UpdatedAt:           time.Now(),
 	}
@@ -96,7 +159,8 @@ func (u *UserTest) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
-// GetOne returns one user by id
+// GetOne returns one user by id. They are a customer at the payment
+// gateway, as cus_test.
 func (u *UserTest) GetOne(id int) (*User, error) {
 
 	if u.FailTest {
@@ -104,15 +168,16 @@ func (u *UserTest) GetOne(id int) (*User, error) {
 	}
 
 	user := User{
-		ID:        id,
-		Email:     "killroy@here.com",
-		FirstName: "Killroy",
-		LastName:  "DeJoy",
-		Password:  "not-secret",
-		Active:    1,
-		IsAdmin:   1,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:                id,
+		Email:             "killroy@here.com",
+		FirstName:         "Killroy",
+		LastName:          "DeJoy",
+		Password:          "not-secret",
+		Active:            1,
+		IsAdmin:           1,
+		PaymentCustomerID: "cus_test",
+		CreatedAt:         time.Now(),
+		UpdatedAt:         time.Now(),
 	}
 
 	plan := Plan{
@@ -120,6 +185,8 @@ func (u *UserTest) GetOne(id int) (*User, error) {
 		PlanName:            "Fake Plan",
 		PlanAmount:          1500,
 		PlanAmountFormatted: "$15.00",
+		Currency:            "USD",
+		Prices:              map[string]int{"EUR": 1400, "GBP": 1200},
 		CreatedAt:           time.Now(),
 		UpdatedAt:           time.Now(),
 	}
@@ -139,6 +206,13 @@ func (u *UserTest) Update(user User) error {
 	return nil
 }
 
+func (u *UserTest) SetLocale(id int, locale string) error {
+	if u.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
 // Delete deletes one user from the database, by User.ID
 func (u *UserTest) Delete() error {
 	if u.FailTest {
@@ -163,6 +237,10 @@ func (u *UserTest) Insert(user User) (int, error) {
 	return 2, nil
 }
 
+func (u *UserTest) InsertTx(tx *sql.Tx, user User) (int, error) {
+	return u.Insert(user)
+}
+
 // ResetPassword is the method we will use to change a user's password.
 func (u *UserTest) ResetPassword(user User, password string) error {
 	if u.FailTest {
@@ -171,6 +249,10 @@ func (u *UserTest) ResetPassword(user User, password string) error {
 	return nil
 }
 
+func (u *UserTest) ResetPasswordTx(tx *sql.Tx, user User, password string) error {
+	return u.ResetPassword(user, password)
+}
+
 // PasswordMatches uses Go's bcrypt package to compare a user supplied password
 // with the hash we have stored for a given user in the database. If the password
 // and hash match, we return true; otherwise, we return false.
@@ -193,25 +275,47 @@ func (p *PlanTest) GetAll() ([]*Plan, error) {
 		PlanName:            "Fake Plan",
 		PlanAmount:          1500,
 		PlanAmountFormatted: "$15.00",
+		Currency:            "USD",
+		Prices:              map[string]int{"EUR": 1400, "GBP": 1200},
+		CreatedAt:           time.Now(),
+		UpdatedAt:           time.Now(),
+	}
+	gold := Plan{
+		ID:                  3,
+		PlanName:            "Fake Gold Plan",
+		PlanAmount:          3000,
+		PlanAmountFormatted: "$30.00",
+		Currency:            "USD",
+		Prices:              map[string]int{"EUR": 2800},
 		CreatedAt:           time.Now(),
 		UpdatedAt:           time.Now(),
 	}
-	plans = append(plans, &plan)
+	plans = append(plans, &plan, &gold)
 
 	return plans, nil
 }
 
-// GetOne returns one plan by id
+// GetOne returns one plan by id: one of those GetAll returns, or else
+// another like the first
 func (p *PlanTest) GetOne(id int) (*Plan, error) {
 	if p.FailTest {
 		return nil, sql.ErrNoRows
 	}
 
+	plans, _ := p.GetAll()
+	for _, plan := range plans {
+		if plan.ID == id {
+			return plan, nil
+		}
+	}
+
 	plan := Plan{
 		ID:                  id,
 		PlanName:            "Fake Plan",
 		PlanAmount:          1500,
 		PlanAmountFormatted: "$15.00",
+		Currency:            "USD",
+		Prices:              map[string]int{"EUR": 1400, "GBP": 1200},
 		CreatedAt:           time.Now(),
 		UpdatedAt:           time.Now(),
 	}
@@ -219,16 +323,598 @@ func (p *PlanTest) GetOne(id int) (*Plan, error) {
 	return &plan, nil
 }
 
-// SubscribeUserToPlan subscribes a user to one plan by insert
-// values into user_plans table
-func (p *PlanTest) SubscribeUserToPlan(user User, plan Plan) error {
+// SubscribeUserToPlan starts a subscription to plan, or moves the user's
+// live subscription onto it
+func (p *PlanTest) SubscribeUserToPlan(user User, plan Plan, fromPlanID int, periodStart time.Time) error {
 	if p.FailTest {
 		return errors.New("test ooops")
 	}
 	return nil
 }
 
+// GetSubscription returns the user's latest subscription, with its plan.
+// It is half way through its period. User 2's renewal for the period
+// wasn't paid, and they have been past due for 3 days.
+func (p *PlanTest) GetSubscription(userID int) (*Subscription, error) {
+	if p.FailTest {
+		return nil, sql.ErrNoRows
+	}
+
+	plan, _ := p.GetOne(1)
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -15)
+	sub := Subscription{
+		ID:                 1,
+		UserID:             userID,
+		PlanID:             plan.ID,
+		Status:             SubscriptionActive,
+		CurrentPeriodStart: start,
+		CurrentPeriodEnd:   start.AddDate(0, 1, 0),
+		CreatedAt:          time.Now(),
+		UpdatedAt:          time.Now(),
+		Plan:               plan,
+	}
+
+	if userID == 2 {
+		sub.Status = SubscriptionPastDue
+		sub.PastDueSince = sql.NullTime{Time: time.Now().AddDate(0, 0, -3), Valid: true}
+	}
+
+	return &sub, nil
+}
+
+// CancelSubscription cancels the user's live subscription
+func (p *PlanTest) CancelSubscription(userID int, atPeriodEnd bool) error {
+	if p.FailTest {
+		return ErrNoSubscription
+	}
+	return nil
+}
+
+// ResumeSubscription takes back a cancellation due at the end of the period
+func (p *PlanTest) ResumeSubscription(userID int) error {
+	if p.FailTest {
+		return ErrNoSubscription
+	}
+	return nil
+}
+
+// RenewSubscription moves a subscription on to its next period
+func (p *PlanTest) RenewSubscription(id int) error {
+	if p.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// DeferRenewal leaves a subscription to be renewed later
+func (p *PlanTest) DeferRenewal(id int, retryAt time.Time) error {
+	if p.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// DueSubscriptions returns the live subscriptions whose period has
+// ended: one, a month overdue
+func (p *PlanTest) DueSubscriptions(now time.Time, limit int) ([]*Subscription, error) {
+	if p.FailTest {
+		return nil, errors.New("test oops")
+	}
+
+	sub, _ := p.GetSubscription(1)
+	sub.CurrentPeriodStart, sub.CurrentPeriodEnd = sub.CurrentPeriodStart.AddDate(0, -1, 0), sub.CurrentPeriodStart
+
+	return []*Subscription{sub}, nil
+}
+
+// MarkPastDue marks the user's subscription past due
+func (p *PlanTest) MarkPastDue(userID int) (bool, error) {
+	if p.FailTest {
+		return false, ErrNoSubscription
+	}
+	return true, nil
+}
+
+// RecoverSubscription makes the user's past due subscription active again
+func (p *PlanTest) RecoverSubscription(userID int) error {
+	if p.FailTest {
+		return ErrNoSubscription
+	}
+	return nil
+}
+
+// DowngradeSubscription moves the user's past due subscription onto plan
+func (p *PlanTest) DowngradeSubscription(userID, planID int) error {
+	if p.FailTest {
+		return ErrNoSubscription
+	}
+	return nil
+}
+
+// SubscriptionHistory returns what has happened to the user's
+// subscriptions, newest first
+func (p *PlanTest) SubscriptionHistory(userID int) ([]*SubscriptionEvent, error) {
+	if p.FailTest {
+		return nil, errors.New("test oops")
+	}
+
+	events := []*SubscriptionEvent{
+		{ID: 2, SubscriptionID: 1, UserID: userID, Event: EventPlanChanged, FromPlanID: 2, ToPlanID: 1,
+			Status: SubscriptionActive, CreatedAt: time.Date(2022, 5, 20, 0, 0, 0, 0, time.UTC)},
+		{ID: 1, SubscriptionID: 1, UserID: userID, Event: EventCreated, ToPlanID: 2,
+			Status: SubscriptionActive, CreatedAt: time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC)},
+	}
+
+	return events, nil
+}
+
 // AmountForDisplay formats the price we have in the DB as a currency string
 func (p *PlanTest) AmountForDisplay() string {
 	return "$15.00"
 }
+
+// GetAll returns all dead letters, newest first
+func (d *DeadLetterTest) GetAll() ([]*DeadLetter, error) {
+	if d.FailTest {
+		return nil, errors.New("test oops")
+	}
+
+	letter, _ := d.GetOne(1)
+	return []*DeadLetter{letter}, nil
+}
+
+// GetOne returns one dead letter by id
+func (d *DeadLetterTest) GetOne(id int) (*DeadLetter, error) {
+	if d.FailTest {
+		return nil, sql.ErrNoRows
+	}
+
+	letter := DeadLetter{
+		ID:        id,
+		Recipient: "killroy@here.com",
+		Subject:   "Undeliverable",
+		Template:  "mail",
+		Payload:   []byte(`{"To":"killroy@here.com","Subject":"Undeliverable","Data":"Where you was?"}`),
+		LastError: "connection refused",
+		Attempts:  5,
+		CreatedAt: time.Now(),
+	}
+
+	return &letter, nil
+}
+
+// Insert stores a failed message, and returns the ID of the newly inserted row
+func (d *DeadLetterTest) Insert(letter DeadLetter) (int, error) {
+	if d.FailTest {
+		return 0, errors.New("test oops")
+	}
+	return 1, nil
+}
+
+// DeleteByID deletes one dead letter, typically once it has been replayed
+func (d *DeadLetterTest) DeleteByID(id int) error {
+	if d.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// Requeue moves a dead letter back to the mail outbox, and returns the ID
+// of the new outbox row
+func (d *DeadLetterTest) Requeue(id int, lease time.Duration) (int, error) {
+	if d.FailTest {
+		return 0, sql.ErrNoRows
+	}
+	return 1, nil
+}
+
+// Enqueue stores a new message, already claimed by the caller for lease,
+// and returns the ID of the newly inserted row
+func (o *OutboxTest) Enqueue(payload []byte, lease time.Duration) (int, error) {
+	if o.FailTest {
+		return 0, errors.New("test oops")
+	}
+	return 1, nil
+}
+
+// Claim locks up to limit pending messages whose lease has lapsed
+func (o *OutboxTest) EnqueueTx(tx *sql.Tx, payload []byte, lease time.Duration) (int, error) {
+	return o.Enqueue(payload, lease)
+}
+
+func (o *OutboxTest) Claim(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	if o.FailTest {
+		return nil, errors.New("test oops")
+	}
+	return nil, nil
+}
+
+// MarkSent records that a message was delivered
+func (o *OutboxTest) MarkSent(id int) error {
+	if o.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// MarkFailed records that we gave up on a message
+func (o *OutboxTest) MarkFailed(id int, lastError string) error {
+	if o.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// Release gives up our claim on a message we did not get to
+func (o *OutboxTest) Release(id int) error {
+	if o.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// Insert stores an error event, and returns the ID of the newly inserted row
+func (a *AppErrorTest) Insert(appErr AppError) (int, error) {
+	if a.FailTest {
+		return 0, errors.New("test oops")
+	}
+	return 1, nil
+}
+
+// Enqueue stores a new job to run at runAt, and returns the ID of the newly
+// inserted row
+func (j *JobTest) Enqueue(kind string, payload []byte, runAt time.Time) (int, error) {
+	if j.FailTest {
+		return 0, errors.New("test oops")
+	}
+	return 1, nil
+}
+
+// Claim locks up to limit pending jobs that are due
+func (j *JobTest) Claim(limit int, lease time.Duration) ([]*Job, error) {
+	if j.FailTest {
+		return nil, errors.New("test oops")
+	}
+	return nil, nil
+}
+
+// MarkDone records that a job succeeded
+func (j *JobTest) MarkDone(id int) error {
+	if j.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// Retry releases a job that failed, to run again at runAt
+func (j *JobTest) Retry(id int, runAt time.Time, lastError string) error {
+	if j.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// MarkFailed records that we gave up on a job
+func (j *JobTest) MarkFailed(id int, lastError string) error {
+	if j.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// Release gives up our claim on a job we did not get to
+func (j *JobTest) Release(id int) error {
+	if j.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// Insert stores an invoice and its lines, and returns the ID of the newly
+// inserted row
+func (i *InvoiceTest) Insert(invoice Invoice) (int, error) {
+	if i.FailTest {
+		return 0, errors.New("test oops")
+	}
+	return 1, nil
+}
+
+// GetOne returns one invoice, with its lines, by id
+func (i *InvoiceTest) GetOne(id int) (*Invoice, error) {
+	if i.FailTest {
+		return nil, sql.ErrNoRows
+	}
+
+	invoice := Invoice{
+		ID:          id,
+		Number:      id,
+		UserID:      1,
+		PlanID:      1,
+		Status:      InvoiceIssued,
+		PeriodStart: time.Date(2022, 5, 12, 0, 0, 0, 0, time.UTC),
+		PeriodEnd:   time.Date(2022, 6, 12, 0, 0, 0, 0, time.UTC),
+		IssuedAt:    time.Now(),
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+	invoice.AddLine("Fake Plan subscription", 1, 1500)
+
+	return &invoice, nil
+}
+
+// GetForPeriod returns the user's invoice for a plan and billing period.
+// Only user 2 has one: the renewal they haven't paid.
+// GetPaidThrough finds nothing: the mock plans' list prices were paid
+func (i *InvoiceTest) GetPaidThrough(userID, planID int, periodEnd time.Time) (*Invoice, error) {
+	if i.FailTest {
+		return nil, errors.New("test oops")
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (i *InvoiceTest) GetForPeriod(userID, planID int, periodStart time.Time) (*Invoice, error) {
+	if userID != 2 {
+		return nil, sql.ErrNoRows
+	}
+
+	invoice, err := i.GetOne(2)
+	if err != nil {
+		return nil, err
+	}
+	invoice.UserID = userID
+	invoice.PlanID = planID
+	invoice.PeriodStart, invoice.PeriodEnd = periodStart, periodStart.AddDate(0, 1, 0)
+
+	return invoice, nil
+}
+
+// UpdateStatus sets the status of an invoice
+func (i *InvoiceTest) UpdateStatus(id int, status string) error {
+	if i.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// Void voids an invoice that is waiting to be paid
+func (i *InvoiceTest) Void(id int) (bool, error) {
+	if i.FailTest {
+		return false, errors.New("test oops")
+	}
+	return true, nil
+}
+
+// TaxSummary totals the tax on invoices issued in a period
+func (i *InvoiceTest) TaxSummary(from, to time.Time) ([]*TaxSummary, error) {
+	if i.FailTest {
+		return nil, errors.New("test oops")
+	}
+
+	summary := []*TaxSummary{
+		{Currency: "EUR", Region: "DE", Name: "MwSt", Rate: 1900, Invoices: 2, Taxable: 3000, Amount: 570},
+		{Currency: "GBP", Region: "GB", Name: "VAT", Rate: 2000, Invoices: 3, Taxable: 4500, Amount: 900},
+	}
+
+	return summary, nil
+}
+
+// GetAll returns all tax rates, by region
+func (t *TaxRateTest) GetAll() ([]*TaxRate, error) {
+	if t.FailTest {
+		return nil, errors.New("test oops")
+	}
+
+	rates := []*TaxRate{
+		{ID: 1, Region: "DE", Name: "MwSt", Rate: 1900},
+		{ID: 2, Region: "GB", Name: "VAT", Rate: 2000},
+		{ID: 3, Region: "US-CA", Name: "Sales tax", Rate: 725},
+	}
+
+	return rates, nil
+}
+
+// testCoupons are the coupons CouponTest knows, by code. The user has
+// already redeemed ONCE.
+var testCoupons = []Coupon{
+	{ID: 1, Code: "WELCOME10", PercentOff: 10, Currency: "USD"},
+	{ID: 2, Code: "FIVEOFF", AmountOff: 500, Currency: "USD", MaxRedemptions: 100, Redemptions: 3},
+	{ID: 3, Code: "EXPIRED", PercentOff: 20, Currency: "USD",
+		ExpiresAt: sql.NullTime{Time: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), Valid: true}},
+	{ID: 4, Code: "GOLDONLY", PercentOff: 50, Currency: "USD", PlanID: 3},
+	{ID: 5, Code: "ONCE", PercentOff: 10, Currency: "USD"},
+	{ID: 6, Code: "GONE", PercentOff: 10, Currency: "USD", MaxRedemptions: 10, Redemptions: 10},
+	{ID: 7, Code: "FIVEEURO", AmountOff: 500, Currency: "EUR"},
+}
+
+// GetByCode returns the coupon with the given code, ignoring case
+func (c *CouponTest) GetByCode(code string) (*Coupon, error) {
+	if c.FailTest {
+		return nil, errors.New("test oops")
+	}
+
+	for _, coupon := range testCoupons {
+		if strings.EqualFold(coupon.Code, code) {
+			coupon := coupon
+			return &coupon, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetOne returns one coupon by id
+func (c *CouponTest) GetOne(id int) (*Coupon, error) {
+	if c.FailTest {
+		return nil, sql.ErrNoRows
+	}
+
+	for _, coupon := range testCoupons {
+		if coupon.ID == id {
+			coupon := coupon
+			return &coupon, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// Redeemed says whether the user has redeemed the coupon
+func (c *CouponTest) Redeemed(couponID, userID int) (bool, error) {
+	if c.FailTest {
+		return false, errors.New("test oops")
+	}
+	return couponID == 5, nil
+}
+
+// Insert stores a new payment, and returns its id
+func (p *PaymentTest) Insert(payment Payment) (int, error) {
+	if p.FailTest {
+		return 0, errors.New("test oops")
+	}
+	return 1, nil
+}
+
+// SetCharge records the charge made for a payment
+func (p *PaymentTest) SetCharge(id int, chargeID, status, failureMessage string) error {
+	if p.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// GetByChargeID returns the payment for the gateway's charge. It is
+// pending, for a new subscription to plan 1.
+func (p *PaymentTest) GetByChargeID(chargeID string) (*Payment, error) {
+	if p.FailTest {
+		return nil, sql.ErrNoRows
+	}
+
+	payment := Payment{
+		ID:        1,
+		UserID:    1,
+		InvoiceID: 1,
+		ChargeID:  chargeID,
+		Status:    PaymentPending,
+		Amount:    1800,
+		Currency:  "USD",
+		Checkout:  []byte(`{"UserID":1,"PlanID":1}`),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	return &payment, nil
+}
+
+// GetForInvoice returns the payments made for an invoice; there are none
+func (p *PaymentTest) GetForInvoice(invoiceID int) ([]*Payment, error) {
+	if p.FailTest {
+		return nil, errors.New("test oops")
+	}
+	return nil, nil
+}
+
+// SetStatus moves a payment from one status to another
+func (p *PaymentTest) SetStatus(id int, from, to, failureMessage string) (bool, error) {
+	if p.FailTest {
+		return false, errors.New("test oops")
+	}
+	return true, nil
+}
+
+func (t *LinkTokenTest) Insert(token LinkToken) (int, error) {
+	if t.FailTest {
+		return 0, errors.New("test oops")
+	}
+	return 1, nil
+}
+
+// GetByNonce returns an unused activation token for user 1
+func (t *LinkTokenTest) InsertTx(tx *sql.Tx, token LinkToken) (int, error) {
+	return t.Insert(token)
+}
+
+func (t *LinkTokenTest) GetByNonce(nonce string) (*LinkToken, error) {
+	if t.FailTest {
+		return nil, sql.ErrNoRows
+	}
+
+	token := LinkToken{
+		ID:        1,
+		Purpose:   "activate",
+		UserID:    1,
+		Nonce:     nonce,
+		CreatedAt: time.Now(),
+	}
+
+	return &token, nil
+}
+
+func (t *LinkTokenTest) Use(id int) (bool, error) {
+	if t.FailTest {
+		return false, errors.New("test oops")
+	}
+	return true, nil
+}
+
+func (t *LinkTokenTest) UseTx(tx *sql.Tx, id int) (bool, error) {
+	return t.Use(id)
+}
+
+func (t *LinkTokenTest) UseAll(userID int, purpose string) error {
+	if t.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// Active returns the one test key
+func (k *SigningKeyTest) Active() ([]*SigningKey, error) {
+	if k.FailTest {
+		return nil, errors.New("test oops")
+	}
+
+	key := SigningKey{
+		ID:        1,
+		KeyID:     "test-key",
+		Secret:    "oops-did-it-again",
+		CreatedAt: time.Now(),
+	}
+
+	return []*SigningKey{&key}, nil
+}
+
+func (k *SigningKeyTest) Rotate(key SigningKey, keep int) error {
+	if k.FailTest {
+		return errors.New("test oops")
+	}
+	return nil
+}
+
+// TryAcquire takes the lock; it is always free
+func (l *LockTest) TryAcquire() (bool, error) {
+	if l.FailTest {
+		return false, errors.New("test oops")
+	}
+	return true, nil
+}
+
+// Check says whether we still hold the lock
+func (l *LockTest) Check() error {
+	if l.FailTest {
+		return errLockLost
+	}
+	return nil
+}
+
+// Release gives up the lock
+func (l *LockTest) Release() error {
+	return nil
+}
+
+// InTx runs fn without a transaction; the test models ignore the tx
+func (t *TxTest) InTx(fn func(tx *sql.Tx) error) error {
+	if t.FailTest {
+		return errors.New("test oops")
+	}
+	return fn(nil)
+}
@@ -2,6 +2,7 @@ package data
 
 import (
 	"database/sql"
+	"log/slog"
 	"time"
 )
 
@@ -9,14 +10,33 @@ const dbTimeout = time.Second * 3
 
 var db *sql.DB
 
+// logger is the application's logger; see New.
+var logger = slog.Default()
+
 // New is the function used to create an instance of the data package. It returns the type
-// Model, which embeds all the types we want to be available to our application.
-func New(dbPool *sql.DB) Models {
+// Model, which embeds all the types we want to be available to our application. The
+// models log through l, or through slog's default logger if l is nil.
+func New(dbPool *sql.DB, l *slog.Logger) Models {
 	db = dbPool
+	if l != nil {
+		logger = l
+	}
 
 	return Models{
-		User: &User{},
-		Plan: &Plan{},
+		User:        &User{},
+		Plan:        &Plan{},
+		DeadLetter:  &DeadLetter{},
+		Outbox:      &OutboxMessage{},
+		AppError:    &AppError{},
+		Job:         &Job{},
+		Invoice:     &Invoice{},
+		TaxRate:     &TaxRate{},
+		Coupon:      &Coupon{},
+		Payment:     &Payment{},
+		LinkToken:   &LinkToken{},
+		SigningKey:  &SigningKey{},
+		BillingLock: &AdvisoryLock{Key: BillingLockKey},
+		Tx:          &Transactor{},
 	}
 }
 
@@ -24,6 +44,20 @@ func New(dbPool *sql.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User UserType
-	Plan PlanType
+	User       UserType
+	Plan       PlanType
+	DeadLetter DeadLetterType
+	Outbox     OutboxType
+	AppError   AppErrorType
+	Job        JobType
+	Invoice    InvoiceType
+	TaxRate    TaxRateType
+	Coupon     CouponType
+	Payment    PaymentType
+	LinkToken  LinkTokenType
+	SigningKey SigningKeyType
+	// held by the one instance that runs the billing scheduler
+	BillingLock LockType
+	// runs writes to several models in one transaction
+	Tx TxType
 }
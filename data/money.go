@@ -0,0 +1,144 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultLocale is used for anyone whose locale we don't know or support,
+// and DefaultCurrency for amounts with no currency given
+const (
+	DefaultLocale   = "en-US"
+	DefaultCurrency = "USD"
+)
+
+// Currency describes how amounts in an ISO 4217 currency are written.
+// Amounts are always stored in the currency's minor unit, such as cents,
+// and MinorUnits says how many decimal places that is.
+type Currency struct {
+	Code       string
+	Symbol     string
+	MinorUnits int
+}
+
+// Locale describes how a locale writes numbers, and the currency its
+// people pay in by default
+type Locale struct {
+	Tag      string
+	Group    string
+	Decimal  string
+	Currency string
+	// the symbol follows the number, after a no-break space, as in
+	// "1.000,00 €"
+	SymbolAfter bool
+}
+
+var currencies = map[string]Currency{
+	"USD": {Code: "USD", Symbol: "$", MinorUnits: 2},
+	"CAD": {Code: "CAD", Symbol: "CA$", MinorUnits: 2},
+	"EUR": {Code: "EUR", Symbol: "€", MinorUnits: 2},
+	"GBP": {Code: "GBP", Symbol: "£", MinorUnits: 2},
+	"JPY": {Code: "JPY", Symbol: "¥", MinorUnits: 0},
+}
+
+var locales = map[string]Locale{
+	"en-US": {Tag: "en-US", Group: ",", Decimal: ".", Currency: "USD"},
+	"en-CA": {Tag: "en-CA", Group: ",", Decimal: ".", Currency: "CAD"},
+	"en-GB": {Tag: "en-GB", Group: ",", Decimal: ".", Currency: "GBP"},
+	"de-DE": {Tag: "de-DE", Group: ".", Decimal: ",", Currency: "EUR", SymbolAfter: true},
+	"fr-FR": {Tag: "fr-FR", Group: "\u202f", Decimal: ",", Currency: "EUR", SymbolAfter: true},
+	"ja-JP": {Tag: "ja-JP", Group: ",", Decimal: ".", Currency: "JPY"},
+}
+
+// the locale to use for a bare language tag, such as "de"
+var languageLocales = map[string]string{
+	"en": "en-US",
+	"de": "de-DE",
+	"fr": "fr-FR",
+	"ja": "ja-JP",
+}
+
+// CurrencyFor returns the currency with the given code. We still format
+// codes we don't know, as "12.34 XYZ".
+func CurrencyFor(code string) Currency {
+	if code == "" {
+		code = DefaultCurrency
+	}
+	code = strings.ToUpper(code)
+	if c, ok := currencies[code]; ok {
+		return c
+	}
+	return Currency{Code: code, Symbol: code, MinorUnits: 2}
+}
+
+// LocaleFor returns the locale for a tag such as "de-DE" or "de", or the
+// default locale if we don't support it
+func LocaleFor(tag string) Locale {
+	if l, ok := MatchLocale(tag); ok {
+		return l
+	}
+	return locales[DefaultLocale]
+}
+
+// MatchLocale returns the locale for a tag, or failing that the one we
+// use for its language, so "de-AT" gets "de-DE"
+func MatchLocale(tag string) (Locale, bool) {
+	if l, ok := locales[tag]; ok {
+		return l, true
+	}
+
+	lang, _, _ := strings.Cut(strings.ToLower(tag), "-")
+	if matched, ok := languageLocales[lang]; ok {
+		return locales[matched], true
+	}
+
+	return Locale{}, false
+}
+
+// FormatMoney writes an amount, in the currency's minor unit, the way the
+// locale writes it, as in "$1,000.00" or "1.000,00 €"
+func FormatMoney(amount int, currency, locale string) string {
+	c := CurrencyFor(currency)
+	l := LocaleFor(locale)
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	scale := 1
+	for i := 0; i < c.MinorUnits; i++ {
+		scale *= 10
+	}
+
+	number := groupDigits(fmt.Sprintf("%d", amount/scale), l.Group)
+	if c.MinorUnits > 0 {
+		number += l.Decimal + fmt.Sprintf("%0*d", c.MinorUnits, amount%scale)
+	}
+
+	if l.SymbolAfter || c.Symbol == c.Code {
+		return sign + number + "\u00a0" + c.Symbol
+	}
+	return sign + c.Symbol + number
+}
+
+// groupDigits puts sep between each group of three digits
+func groupDigits(digits, sep string) string {
+	if len(digits) <= 3 {
+		return digits
+	}
+
+	var b strings.Builder
+	head := len(digits) % 3
+	if head > 0 {
+		b.WriteString(digits[:head])
+	}
+	for i := head; i < len(digits); i += 3 {
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
@@ -0,0 +1,164 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Outbox statuses
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+// OutboxMessage is one queued mail message. Payload holds the message as
+// JSON. A row is claimed by setting LockedUntil; if the claiming process
+// dies, the row becomes claimable again once the lock lapses.
+type OutboxMessage struct {
+	ID          int
+	Payload     []byte
+	Status      string
+	Attempts    int
+	LastError   string
+	LockedUntil time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// Enqueue stores a new message, already claimed by the caller for lease,
+// and returns the ID of the newly inserted row
+func (o *OutboxMessage) Enqueue(payload []byte, lease time.Duration) (int, error) {
+	return enqueueOutbox(db, payload, lease)
+}
+
+// EnqueueTx stores a new message as part of tx, so it is only sent if tx
+// commits, and returns the ID of the newly inserted row
+func (o *OutboxMessage) EnqueueTx(tx *sql.Tx, payload []byte, lease time.Duration) (int, error) {
+	return enqueueOutbox(tx, payload, lease)
+}
+
+func enqueueOutbox(q queryer, payload []byte, lease time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	var newID int
+	stmt := `insert into mail_outbox (payload, status, attempts, locked_until, created_at, updated_at)
+		values ($1, $2, 1, $3, $4, $5) returning id`
+
+	err := q.QueryRowContext(ctx, stmt,
+		payload,
+		OutboxPending,
+		now.Add(lease),
+		now,
+		now,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Claim locks up to limit pending messages whose lease has lapsed, and
+// returns them. Rows locked by another instance are skipped rather than
+// waited on, so several instances can claim from the outbox at once.
+func (o *OutboxMessage) Claim(limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `
+	update mail_outbox set
+		locked_until = $2,
+		attempts = attempts + 1,
+		updated_at = $3
+	where id in (
+		select id from mail_outbox
+		where status = 'pending' and locked_until < $3
+		order by id
+		limit $1
+		for update skip locked
+	)
+	returning id, payload, status, attempts, locked_until, created_at, updated_at`
+
+	rows, err := db.QueryContext(ctx, query, limit, now.Add(lease), now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*OutboxMessage
+
+	for rows.Next() {
+		var msg OutboxMessage
+		err := rows.Scan(
+			&msg.ID,
+			&msg.Payload,
+			&msg.Status,
+			&msg.Attempts,
+			&msg.LockedUntil,
+			&msg.CreatedAt,
+			&msg.UpdatedAt,
+		)
+		if err != nil {
+			logger.Error("error scanning outbox mail", "error", err)
+			return nil, err
+		}
+
+		messages = append(messages, &msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// MarkSent records that a message was delivered
+func (o *OutboxMessage) MarkSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set status = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, OutboxSent, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkFailed records that we gave up on a message
+func (o *OutboxMessage) MarkFailed(id int, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set status = $1, last_error = $2, updated_at = $3 where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, OutboxFailed, lastError, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Release gives up our claim on a message we did not get to, so that any
+// instance can send it without waiting for the lease to lapse
+func (o *OutboxMessage) Release(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update mail_outbox set locked_until = $1, updated_at = $1 where id = $2 and status = $3`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), id, OutboxPending)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
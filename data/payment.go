@@ -0,0 +1,192 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Payment statuses
+const (
+	PaymentPending   = "pending"
+	PaymentSucceeded = "succeeded"
+	PaymentFailed    = "failed"
+	PaymentRefunded  = "refunded"
+)
+
+// ErrPaymentOpen is returned by Insert for an invoice that already has a
+// payment pending or paid.
+var ErrPaymentOpen = errors.New("invoice already has a payment pending or paid")
+
+// Payment is a charge made at the payment gateway for an invoice. It is
+// stored, pending, before the charge is made, and ChargeID is set once it
+// has been. A pending payment is settled later, by the gateway's webhook;
+// Checkout holds, as JSON, what to do once it succeeds.
+type Payment struct {
+	ID             int
+	UserID         int
+	InvoiceID      int
+	ChargeID       string
+	Status         string
+	Amount         int
+	Currency       string
+	FailureMessage string
+	Checkout       []byte
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// Insert stores a payment about to be charged, and returns its id. An
+// invoice has at most one payment pending or paid: if it already has one,
+// Insert returns ErrPaymentOpen, so two tries at paying it at once can't
+// both charge it.
+func (p *Payment) Insert(payment Payment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into payments (user_id, invoice_id, status, amount, currency,
+		failure_message, checkout, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		on conflict do nothing
+		returning id`
+
+	var id int
+	err := db.QueryRowContext(ctx, stmt,
+		payment.UserID,
+		payment.InvoiceID,
+		payment.Status,
+		payment.Amount,
+		payment.Currency,
+		payment.FailureMessage,
+		payment.Checkout,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrPaymentOpen
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// SetCharge records the charge made for a payment, and what came of it.
+// Until then the gateway's webhook for the charge can't find the payment,
+// and is sent again.
+func (p *Payment) SetCharge(id int, chargeID, status, failureMessage string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update payments set charge_id = $1, status = $2, failure_message = $3, updated_at = $4
+		where id = $5 and charge_id is null`
+
+	_, err := db.ExecContext(ctx, stmt, chargeID, status, failureMessage, time.Now(), id)
+	return err
+}
+
+// GetByChargeID returns the payment for the gateway's charge
+func (p *Payment) GetByChargeID(chargeID string) (*Payment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, invoice_id, coalesce(charge_id, ''), status, amount, currency, failure_message,
+		checkout, created_at, updated_at
+	from payments where charge_id = $1`
+
+	var payment Payment
+	row := db.QueryRowContext(ctx, query, chargeID)
+
+	err := row.Scan(
+		&payment.ID,
+		&payment.UserID,
+		&payment.InvoiceID,
+		&payment.ChargeID,
+		&payment.Status,
+		&payment.Amount,
+		&payment.Currency,
+		&payment.FailureMessage,
+		&payment.Checkout,
+		&payment.CreatedAt,
+		&payment.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &payment, nil
+}
+
+// GetForInvoice returns the payments made for an invoice, oldest first
+func (p *Payment) GetForInvoice(invoiceID int) ([]*Payment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, invoice_id, coalesce(charge_id, ''), status, amount, currency, failure_message,
+		checkout, created_at, updated_at
+	from payments where invoice_id = $1 order by id`
+
+	rows, err := db.QueryContext(ctx, query, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []*Payment
+
+	for rows.Next() {
+		var payment Payment
+		err := rows.Scan(
+			&payment.ID,
+			&payment.UserID,
+			&payment.InvoiceID,
+			&payment.ChargeID,
+			&payment.Status,
+			&payment.Amount,
+			&payment.Currency,
+			&payment.FailureMessage,
+			&payment.Checkout,
+			&payment.CreatedAt,
+			&payment.UpdatedAt,
+		)
+		if err != nil {
+			logger.Error("error scanning payment", "error", err)
+			return nil, err
+		}
+
+		payments = append(payments, &payment)
+	}
+
+	return payments, rows.Err()
+}
+
+// Open says whether the payment has taken, or may yet take, the money.
+func (p *Payment) Open() bool {
+	return p.Status == PaymentPending || p.Status == PaymentSucceeded
+}
+
+// SetStatus moves a payment from one status to another, and says whether
+// it did. It doesn't if the payment had already left from, so a webhook
+// delivered twice is only acted on once.
+func (p *Payment) SetStatus(id int, from, to, failureMessage string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update payments set status = $1, failure_message = $2, updated_at = $3
+		where id = $4 and status = $5`
+
+	result, err := db.ExecContext(ctx, stmt, to, failureMessage, time.Now(), id, from)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
@@ -2,17 +2,20 @@ package data
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"time"
 )
 
-// Plan is the type for subscription plans
+// Plan is the type for subscription plans. PlanAmount is the price in
+// Currency; Prices holds what it costs in other currencies, if it is
+// sold in them. New members get TrialDays free before they are billed.
 type Plan struct {
 	ID                  int
 	PlanName            string
 	PlanAmount          int
 	PlanAmountFormatted string
+	Currency            string
+	Prices              map[string]int
+	TrialDays           int
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
 }
@@ -21,7 +24,7 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at
+	query := `select id, plan_name, plan_amount, currency, trial_days, created_at, updated_at
 	from plans order by id`
 
 	rows, err := db.QueryContext(ctx, query)
@@ -38,19 +41,29 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 			&plan.ID,
 			&plan.PlanName,
 			&plan.PlanAmount,
+			&plan.Currency,
+			&plan.TrialDays,
 			&plan.CreatedAt,
 			&plan.UpdatedAt,
 		)
 
 		plan.PlanAmountFormatted = plan.AmountForDisplay()
 		if err != nil {
-			log.Println("Error scanning", err)
+			logger.Error("error scanning plan", "error", err)
 			return nil, err
 		}
 
 		plans = append(plans, &plan)
 	}
 
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = loadPrices(ctx, plans...); err != nil {
+		return nil, err
+	}
+
 	return plans, nil
 }
 
@@ -59,7 +72,7 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at from plans where id = $1`
+	query := `select id, plan_name, plan_amount, currency, trial_days, created_at, updated_at from plans where id = $1`
 
 	var plan Plan
 	row := db.QueryRowContext(ctx, query, id)
@@ -68,6 +81,8 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Currency,
+		&plan.TrialDays,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
@@ -76,38 +91,65 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 		return nil, err
 	}
 
+	if err = loadPrices(ctx, &plan); err != nil {
+		return nil, err
+	}
+
 	// Add formatted amount
 	plan.PlanAmountFormatted = plan.AmountForDisplay()
 
 	return &plan, nil
 }
 
-// SubscribeUserToPlan subscribes a user to one plan by insert
-// values into user_plans table
-func (p *Plan) SubscribeUserToPlan(user User, plan Plan) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-	defer cancel()
-
-	// delete existing plan, if any
-	stmt := `delete from user_plans where user_id = $1`
-	_, err := db.ExecContext(ctx, stmt, user.ID)
-	if err != nil {
-		return err
+// loadPrices fills in the prices of plans in other currencies. There are
+// only ever a handful of plans, so it reads every price.
+func loadPrices(ctx context.Context, plans ...*Plan) error {
+	byID := make(map[int]*Plan, len(plans))
+	for _, plan := range plans {
+		plan.Prices = make(map[string]int)
+		byID[plan.ID] = plan
 	}
 
-	// subscribe to new plan
-	stmt = `insert into user_plans (user_id, plan_id, created_at, updated_at)
-			values ($1, $2, $3, $4)`
+	query := `select plan_id, currency, amount from plan_prices`
 
-	_, err = db.ExecContext(ctx, stmt, user.ID, plan.ID, time.Now(), time.Now())
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer rows.Close()
+
+	for rows.Next() {
+		var planID, amount int
+		var currency string
+		if err := rows.Scan(&planID, &currency, &amount); err != nil {
+			logger.Error("error scanning plan price", "error", err)
+			return err
+		}
+		if plan, ok := byID[planID]; ok {
+			plan.Prices[currency] = amount
+		}
+	}
+
+	return rows.Err()
 }
 
 // AmountForDisplay formats the price we have in the DB as a currency string
 func (p *Plan) AmountForDisplay() string {
-	amount := float64(p.PlanAmount) / 100.0
-	return fmt.Sprintf("$%.2f", amount)
+	return FormatMoney(p.PlanAmount, p.Currency, DefaultLocale)
+}
+
+// Price returns what the plan costs in currency, and the currency that is
+// in; if the plan isn't sold in currency, that is the plan's own.
+func (p *Plan) Price(currency string) (int, string) {
+	if amount, ok := p.Prices[currency]; ok && currency != p.Currency {
+		return amount, currency
+	}
+	return p.PlanAmount, p.Currency
+}
+
+// PriceForDisplay formats the price in currency, if the plan is sold in
+// it, the way locale writes it
+func (p *Plan) PriceForDisplay(currency, locale string) string {
+	amount, currency := p.Price(currency)
+	return FormatMoney(amount, currency, locale)
 }
@@ -0,0 +1,84 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SigningKey is one of the keys that sign the links we mail out. Tokens
+// carry the KeyID of the key that signed them. The newest key that isn't
+// retired signs new tokens; any key that isn't retired verifies them.
+type SigningKey struct {
+	ID        int
+	KeyID     string
+	Secret    string
+	CreatedAt time.Time
+	RetiredAt sql.NullTime
+}
+
+// Active returns the keys that aren't retired, newest first.
+func (k *SigningKey) Active() ([]*SigningKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, key_id, secret, created_at, retired_at
+	from signing_keys where retired_at is null order by created_at desc, id desc`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+
+	for rows.Next() {
+		var key SigningKey
+		err := rows.Scan(
+			&key.ID,
+			&key.KeyID,
+			&key.Secret,
+			&key.CreatedAt,
+			&key.RetiredAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Rotate stores key as the new current key, and retires all but the keep
+// keys before it.
+func (k *SigningKey) Rotate(key SigningKey, keep int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `insert into signing_keys (key_id, secret, created_at) values ($1, $2, $3)`
+	_, err = tx.ExecContext(ctx, stmt, key.KeyID, key.Secret, time.Now())
+	if err != nil {
+		return err
+	}
+
+	stmt = `update signing_keys set retired_at = $1
+		where retired_at is null and id not in (
+			select id from signing_keys where retired_at is null
+			order by created_at desc, id desc limit $2
+		)`
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), keep+1)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
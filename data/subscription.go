@@ -0,0 +1,690 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Subscription statuses
+const (
+	SubscriptionTrialing = "trialing"
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionCanceled = "canceled"
+)
+
+// Subscription history events
+const (
+	EventCreated         = "created"
+	EventPlanChanged     = "plan_changed"
+	EventRenewed         = "renewed"
+	EventTrialEnded      = "trial_ended"
+	EventCancelScheduled = "cancel_scheduled"
+	EventResumed         = "resumed"
+	EventCanceled        = "canceled"
+	EventPastDue         = "past_due"
+	EventRecovered       = "recovered"
+)
+
+// ErrNoSubscription is returned when a user has no live subscription to
+// act on
+var ErrNoSubscription = errors.New("no current subscription")
+
+// ErrSubscriptionChanged is returned when a user's subscription has moved
+// to another plan since the caller read it
+var ErrSubscriptionChanged = errors.New("subscription has changed plan")
+
+// Subscription is a user's subscription to a plan. It renews at
+// CurrentPeriodEnd, unless CancelAtPeriodEnd is set, in which case it is
+// canceled then instead. A user has at most one subscription that isn't
+// canceled. One whose renewal wasn't paid is past due from PastDueSince,
+// and keeps its plan until it is paid or the grace period runs out.
+type Subscription struct {
+	ID                 int
+	UserID             int
+	PlanID             int
+	Status             string
+	CurrentPeriodStart time.Time
+	CurrentPeriodEnd   time.Time
+	CancelAtPeriodEnd  bool
+	CanceledAt         sql.NullTime
+	PastDueSince       sql.NullTime
+	// renewals that errored, and when to try again
+	RenewalAttempts int
+	RenewAfter      sql.NullTime
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+	Plan            *Plan
+}
+
+// SubscriptionEvent is one entry in a subscription's history. History is
+// only ever added to; the database refuses to change or delete it.
+type SubscriptionEvent struct {
+	ID             int
+	SubscriptionID int
+	UserID         int
+	Event          string
+	FromPlanID     int
+	ToPlanID       int
+	Status         string
+	CreatedAt      time.Time
+}
+
+// nextPeriod returns the billing period that starts at start
+func nextPeriod(start time.Time) (time.Time, time.Time) {
+	return start, start.AddDate(0, 1, 0)
+}
+
+// PeriodForDisplay is the current period, as shown to the user
+func (s *Subscription) PeriodForDisplay() string {
+	return fmt.Sprintf("%s to %s", s.CurrentPeriodStart.Format("Jan 2, 2006"), s.CurrentPeriodEnd.Format("Jan 2, 2006"))
+}
+
+// StatusForDisplay is the status, as shown to the user
+func (s *Subscription) StatusForDisplay() string {
+	return statusForDisplay(s.Status)
+}
+
+// Description says what happened, as shown to the user
+func (e SubscriptionEvent) Description() string {
+	switch e.Event {
+	case EventCreated:
+		return "Subscribed"
+	case EventPlanChanged:
+		return "Changed plan"
+	case EventRenewed:
+		return "Renewed"
+	case EventTrialEnded:
+		return "Trial ended"
+	case EventCancelScheduled:
+		return "Set to cancel at the end of the period"
+	case EventResumed:
+		return "Took back cancellation"
+	case EventCanceled:
+		return "Canceled"
+	case EventPastDue:
+		return "Payment failed"
+	case EventRecovered:
+		return "Payment received"
+	}
+	return e.Event
+}
+
+func statusForDisplay(status string) string {
+	switch status {
+	case SubscriptionTrialing:
+		return "Trial"
+	case SubscriptionActive:
+		return "Active"
+	case SubscriptionPastDue:
+		return "Past due"
+	case SubscriptionCanceled:
+		return "Canceled"
+	}
+	return status
+}
+
+// Live says whether the subscription still gives access to its plan
+func (s *Subscription) Live() bool {
+	return s.Status != SubscriptionCanceled
+}
+
+// GetSubscription returns the user's latest subscription, with its plan,
+// canceled or not
+func (p *Plan) GetSubscription(userID int) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select s.id, s.user_id, s.plan_id, s.status, s.current_period_start, s.current_period_end,
+		s.cancel_at_period_end, s.canceled_at, s.past_due_since, s.created_at, s.updated_at,
+		p.id, p.plan_name, p.plan_amount, p.currency, p.trial_days, p.created_at, p.updated_at
+	from subscriptions s
+	join plans p on (p.id = s.plan_id)
+	where s.user_id = $1
+	order by s.id desc
+	limit 1`
+
+	var sub Subscription
+	var plan Plan
+	err := db.QueryRowContext(ctx, query, userID).Scan(
+		&sub.ID,
+		&sub.UserID,
+		&sub.PlanID,
+		&sub.Status,
+		&sub.CurrentPeriodStart,
+		&sub.CurrentPeriodEnd,
+		&sub.CancelAtPeriodEnd,
+		&sub.CanceledAt,
+		&sub.PastDueSince,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+		&plan.ID,
+		&plan.PlanName,
+		&plan.PlanAmount,
+		&plan.Currency,
+		&plan.TrialDays,
+		&plan.CreatedAt,
+		&plan.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
+	sub.Plan = &plan
+
+	return &sub, nil
+}
+
+// SubscribeUserToPlan starts a subscription to plan, or moves the user's
+// live subscription onto it. A new subscription's first period starts at
+// periodStart, the start of the period it was billed for, and a first
+// subscription to a plan with a trial starts with the trial. A plan
+// change keeps the current period and status, and takes back any
+// cancellation. fromPlanID is the plan the caller found the user on, and
+// billed the change from, or 0 if they had no subscription; if that has
+// changed since, say by the same change sent twice, nothing is done and
+// ErrSubscriptionChanged is returned.
+func (p *Plan) SubscribeUserToPlan(user User, plan Plan, fromPlanID int, periodStart time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sub, err := liveSubscription(ctx, tx, user.ID)
+	if err != nil && !errors.Is(err, ErrNoSubscription) {
+		return err
+	}
+
+	current := 0
+	if sub != nil {
+		current = sub.PlanID
+	}
+	if current != fromPlanID {
+		return ErrSubscriptionChanged
+	}
+
+	switch {
+	case sub == nil:
+		now := time.Now()
+		start, end := nextPeriod(periodStart)
+		sub = &Subscription{
+			UserID:             user.ID,
+			PlanID:             plan.ID,
+			Status:             SubscriptionActive,
+			CurrentPeriodStart: start,
+			CurrentPeriodEnd:   end,
+		}
+
+		// trials are for new members only
+		var subscribed bool
+		err = tx.QueryRowContext(ctx, `select exists(select 1 from subscriptions where user_id = $1)`,
+			user.ID).Scan(&subscribed)
+		if err != nil {
+			return err
+		}
+		if !subscribed && plan.TrialDays > 0 {
+			sub.Status = SubscriptionTrialing
+			sub.CurrentPeriodEnd = start.AddDate(0, 0, plan.TrialDays)
+		}
+
+		stmt := `insert into subscriptions (user_id, plan_id, status, current_period_start,
+			current_period_end, cancel_at_period_end, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, false, $6, $7) returning id`
+
+		err = tx.QueryRowContext(ctx, stmt,
+			sub.UserID,
+			sub.PlanID,
+			sub.Status,
+			sub.CurrentPeriodStart,
+			sub.CurrentPeriodEnd,
+			now,
+			now,
+		).Scan(&sub.ID)
+		if err != nil {
+			return err
+		}
+
+		err = recordEvent(ctx, tx, sub, EventCreated, 0)
+
+	case sub.PlanID == plan.ID && !sub.CancelAtPeriodEnd:
+		// already on it
+		return nil
+
+	case sub.PlanID == plan.ID:
+		err = setCancelAtPeriodEnd(ctx, tx, sub, false)
+
+	default:
+		from := sub.PlanID
+		sub.PlanID = plan.ID
+		sub.CancelAtPeriodEnd = false
+
+		stmt := `update subscriptions set plan_id = $1, cancel_at_period_end = false, updated_at = $2
+			where id = $3`
+
+		_, err = tx.ExecContext(ctx, stmt, sub.PlanID, time.Now(), sub.ID)
+		if err == nil {
+			err = recordEvent(ctx, tx, sub, EventPlanChanged, from)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CancelSubscription cancels the user's live subscription, either now or,
+// if atPeriodEnd is set, once the period they have paid for is over
+func (p *Plan) CancelSubscription(userID int, atPeriodEnd bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sub, err := liveSubscription(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if atPeriodEnd {
+		if sub.CancelAtPeriodEnd {
+			return nil
+		}
+		err = setCancelAtPeriodEnd(ctx, tx, sub, true)
+	} else {
+		err = endSubscription(ctx, tx, sub, time.Now())
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ResumeSubscription takes back a cancellation that was due at the end of
+// the period
+func (p *Plan) ResumeSubscription(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sub, err := liveSubscription(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if !sub.CancelAtPeriodEnd {
+		return nil
+	}
+
+	if err = setCancelAtPeriodEnd(ctx, tx, sub, false); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RenewSubscription moves a subscription whose period, or trial, is over
+// on to the next period, or cancels it if that was asked for. It does
+// nothing to a subscription that isn't due, so it is safe to call twice.
+func (p *Plan) RenewSubscription(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sub, err := scanSubscription(tx.QueryRowContext(ctx, selectSubscription+` where id = $1 for update`, id))
+	if err != nil {
+		return err
+	}
+
+	if !sub.Live() || sub.CurrentPeriodEnd.After(time.Now()) {
+		return nil
+	}
+
+	if sub.CancelAtPeriodEnd {
+		err = endSubscription(ctx, tx, sub, sub.CurrentPeriodEnd)
+	} else {
+		event := EventRenewed
+		if sub.Status == SubscriptionTrialing {
+			sub.Status = SubscriptionActive
+			event = EventTrialEnded
+		}
+		sub.CurrentPeriodStart, sub.CurrentPeriodEnd = nextPeriod(sub.CurrentPeriodEnd)
+
+		stmt := `update subscriptions set status = $1, current_period_start = $2, current_period_end = $3,
+			renewal_attempts = 0, renew_after = null, updated_at = $4
+			where id = $5`
+
+		_, err = tx.ExecContext(ctx, stmt, sub.Status, sub.CurrentPeriodStart, sub.CurrentPeriodEnd, time.Now(), sub.ID)
+		if err == nil {
+			err = recordEvent(ctx, tx, sub, event, 0)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MarkPastDue marks the user's subscription past due, as its renewal
+// wasn't paid, and says whether it did. It doesn't if the subscription was
+// already past due.
+func (p *Plan) MarkPastDue(userID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	sub, err := liveSubscription(ctx, tx, userID)
+	if err != nil {
+		return false, err
+	}
+	if sub.Status == SubscriptionPastDue {
+		return false, nil
+	}
+
+	now := time.Now()
+	stmt := `update subscriptions set status = $1, past_due_since = $2, updated_at = $3 where id = $4`
+
+	if _, err := tx.ExecContext(ctx, stmt, SubscriptionPastDue, now, now, sub.ID); err != nil {
+		return false, err
+	}
+	sub.Status = SubscriptionPastDue
+
+	if err := recordEvent(ctx, tx, sub, EventPastDue, 0); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// RecoverSubscription makes the user's past due subscription active again,
+// once what they owed is paid. It does nothing to one that isn't past due.
+func (p *Plan) RecoverSubscription(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sub, err := liveSubscription(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if sub.Status != SubscriptionPastDue {
+		return nil
+	}
+
+	stmt := `update subscriptions set status = $1, past_due_since = null, updated_at = $2 where id = $3`
+
+	if _, err := tx.ExecContext(ctx, stmt, SubscriptionActive, time.Now(), sub.ID); err != nil {
+		return err
+	}
+	sub.Status = SubscriptionActive
+
+	if err := recordEvent(ctx, tx, sub, EventRecovered, 0); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DowngradeSubscription moves the user's past due subscription onto plan,
+// usually a free one, when the grace period for paying runs out. It is
+// active again, and the debt is written off.
+func (p *Plan) DowngradeSubscription(userID, planID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sub, err := liveSubscription(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	if sub.Status != SubscriptionPastDue {
+		return nil
+	}
+
+	from := sub.PlanID
+	sub.PlanID = planID
+	sub.Status = SubscriptionActive
+
+	stmt := `update subscriptions set plan_id = $1, status = $2, past_due_since = null, updated_at = $3
+		where id = $4`
+
+	if _, err := tx.ExecContext(ctx, stmt, sub.PlanID, sub.Status, time.Now(), sub.ID); err != nil {
+		return err
+	}
+
+	if err := recordEvent(ctx, tx, sub, EventPlanChanged, from); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DueSubscriptions returns up to limit subscriptions whose period has
+// ended by now, the longest overdue first. Past due subscriptions aren't
+// renewed until they are paid, and ones whose renewal errored aren't
+// returned again until they are due a retry.
+func (p *Plan) DueSubscriptions(now time.Time, limit int) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := selectSubscription + ` where status in ($1, $2) and current_period_end <= $3
+		and (renew_after is null or renew_after <= $3)
+		order by current_period_end, id
+		limit $4`
+
+	rows, err := db.QueryContext(ctx, query, SubscriptionActive, SubscriptionTrialing, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []*Subscription
+
+	for rows.Next() {
+		var sub Subscription
+		err := rows.Scan(
+			&sub.ID,
+			&sub.UserID,
+			&sub.PlanID,
+			&sub.Status,
+			&sub.CurrentPeriodStart,
+			&sub.CurrentPeriodEnd,
+			&sub.CancelAtPeriodEnd,
+			&sub.CanceledAt,
+			&sub.PastDueSince,
+			&sub.RenewalAttempts,
+			&sub.RenewAfter,
+			&sub.CreatedAt,
+			&sub.UpdatedAt,
+		)
+		if err != nil {
+			logger.Error("error scanning subscription", "error", err)
+			return nil, err
+		}
+		subs = append(subs, &sub)
+	}
+
+	return subs, rows.Err()
+}
+
+// DeferRenewal counts a renewal of the subscription that errored, and
+// leaves it until retryAt before it is tried again
+func (p *Plan) DeferRenewal(id int, retryAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update subscriptions set renewal_attempts = renewal_attempts + 1, renew_after = $1,
+		updated_at = $2
+		where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, retryAt, time.Now(), id)
+	return err
+}
+
+// SubscriptionHistory returns everything that has happened to the user's
+// subscriptions, newest first
+func (p *Plan) SubscriptionHistory(userID int) ([]*SubscriptionEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, subscription_id, user_id, event, coalesce(from_plan_id, 0),
+		coalesce(to_plan_id, 0), status, created_at
+	from subscription_events
+	where user_id = $1
+	order by id desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*SubscriptionEvent
+
+	for rows.Next() {
+		var ev SubscriptionEvent
+		err := rows.Scan(
+			&ev.ID,
+			&ev.SubscriptionID,
+			&ev.UserID,
+			&ev.Event,
+			&ev.FromPlanID,
+			&ev.ToPlanID,
+			&ev.Status,
+			&ev.CreatedAt,
+		)
+		if err != nil {
+			logger.Error("error scanning subscription event", "error", err)
+			return nil, err
+		}
+
+		events = append(events, &ev)
+	}
+
+	return events, rows.Err()
+}
+
+const selectSubscription = `select id, user_id, plan_id, status, current_period_start, current_period_end,
+	cancel_at_period_end, canceled_at, past_due_since, renewal_attempts, renew_after, created_at, updated_at
+	from subscriptions`
+
+// liveSubscription locks and returns the user's subscription that isn't
+// canceled, if there is one
+func liveSubscription(ctx context.Context, tx *sql.Tx, userID int) (*Subscription, error) {
+	query := selectSubscription + ` where user_id = $1 and status <> $2 order by id desc limit 1 for update`
+
+	sub, err := scanSubscription(tx.QueryRowContext(ctx, query, userID, SubscriptionCanceled))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoSubscription
+	}
+	return sub, err
+}
+
+func scanSubscription(row *sql.Row) (*Subscription, error) {
+	var sub Subscription
+	err := row.Scan(
+		&sub.ID,
+		&sub.UserID,
+		&sub.PlanID,
+		&sub.Status,
+		&sub.CurrentPeriodStart,
+		&sub.CurrentPeriodEnd,
+		&sub.CancelAtPeriodEnd,
+		&sub.CanceledAt,
+		&sub.PastDueSince,
+		&sub.RenewalAttempts,
+		&sub.RenewAfter,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func setCancelAtPeriodEnd(ctx context.Context, tx *sql.Tx, sub *Subscription, cancelAtEnd bool) error {
+	stmt := `update subscriptions set cancel_at_period_end = $1, updated_at = $2 where id = $3`
+
+	if _, err := tx.ExecContext(ctx, stmt, cancelAtEnd, time.Now(), sub.ID); err != nil {
+		return err
+	}
+	sub.CancelAtPeriodEnd = cancelAtEnd
+
+	event := EventResumed
+	if cancelAtEnd {
+		event = EventCancelScheduled
+	}
+	return recordEvent(ctx, tx, sub, event, 0)
+}
+
+func endSubscription(ctx context.Context, tx *sql.Tx, sub *Subscription, at time.Time) error {
+	stmt := `update subscriptions set status = $1, canceled_at = $2, updated_at = $3 where id = $4`
+
+	if _, err := tx.ExecContext(ctx, stmt, SubscriptionCanceled, at, time.Now(), sub.ID); err != nil {
+		return err
+	}
+	sub.Status = SubscriptionCanceled
+	sub.CanceledAt = sql.NullTime{Time: at, Valid: true}
+
+	return recordEvent(ctx, tx, sub, EventCanceled, 0)
+}
+
+// recordEvent adds to the subscription's history, as part of the change
+// it records. fromPlanID is only for plan changes.
+func recordEvent(ctx context.Context, tx *sql.Tx, sub *Subscription, event string, fromPlanID int) error {
+	stmt := `insert into subscription_events (subscription_id, user_id, event, from_plan_id, to_plan_id,
+		status, created_at)
+		values ($1, $2, $3, nullif($4, 0), $5, $6, $7)`
+
+	_, err := tx.ExecContext(ctx, stmt,
+		sub.ID,
+		sub.UserID,
+		event,
+		fromPlanID,
+		sub.PlanID,
+		sub.Status,
+		time.Now(),
+	)
+	return err
+}
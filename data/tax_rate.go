@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TaxRate is one tax charged in a region, such as VAT in "GB" or sales tax
+// in "US-CA". A region may have more than one. Rate is in hundredths of a
+// percent, so 7.25% is 725.
+type TaxRate struct {
+	ID        int
+	Region    string
+	Name      string
+	Rate      int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// RateForDisplay formats the rate as a percentage
+func (t TaxRate) RateForDisplay() string {
+	return rateForDisplay(t.Rate)
+}
+
+func rateForDisplay(rate int) string {
+	if rate%100 == 0 {
+		return fmt.Sprintf("%d%%", rate/100)
+	}
+	return fmt.Sprintf("%d.%02d%%", rate/100, rate%100)
+}
+
+// GetAll returns all tax rates, by region
+func (t *TaxRate) GetAll() ([]*TaxRate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, region, name, rate, created_at, updated_at
+	from tax_rates order by region, id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rates []*TaxRate
+
+	for rows.Next() {
+		var rate TaxRate
+		err := rows.Scan(
+			&rate.ID,
+			&rate.Region,
+			&rate.Name,
+			&rate.Rate,
+			&rate.CreatedAt,
+			&rate.UpdatedAt,
+		)
+		if err != nil {
+			logger.Error("error scanning tax rate", "error", err)
+			return nil, err
+		}
+
+		rates = append(rates, &rate)
+	}
+
+	return rates, rows.Err()
+}
@@ -0,0 +1,37 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+)
+
+// queryer is what *sql.DB and *sql.Tx have in common, so a statement can
+// run on its own or as part of a transaction.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// Transactor runs a function in a transaction, so that the writes the
+// model methods taking a *sql.Tx make in it commit, or roll back,
+// together.
+type Transactor struct{}
+
+// InTx begins a transaction and runs fn in it. The transaction commits if
+// fn returns nil, and rolls back otherwise.
+func (t *Transactor) InTx(fn func(tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
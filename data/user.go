@@ -2,8 +2,8 @@ package data
 
 import (
 	"context"
+	"database/sql"
 	"errors"
-	"log"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -18,9 +18,18 @@ type User struct {
 	Password  string
 	Active    int
 	IsAdmin   int
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Plan      *Plan
+	// where the user is taxed, such as "GB" or "US-CA"
+	Region string
+	// how the user reads numbers and dates, such as "de-DE"; it also
+	// decides the currency they pay in
+	Locale string
+	// the user's customer ID at the payment gateway, once they have paid
+	PaymentCustomerID string
+	// when the password was last reset; null if it never was
+	PasswordChangedAt sql.NullTime
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	Plan              *Plan
 }
 
 // GetAll returns a slice of all users, sorted by last name
@@ -37,6 +46,10 @@ func (u *User) GetAll() ([]*User, error) {
        	password,
        	user_active,
        	is_admin,
+       	region,
+       	locale,
+       	payment_customer_id,
+       	password_changed_at,
        	created_at,
        	updated_at
 	from
@@ -62,11 +75,15 @@ func (u *User) GetAll() ([]*User, error) {
 			&user.Password,
 			&user.Active,
 			&user.IsAdmin,
+			&user.Region,
+			&user.Locale,
+			&user.PaymentCustomerID,
+			&user.PasswordChangedAt,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
 		if err != nil {
-			log.Println("Error scanning", err)
+			logger.Error("error scanning user", "error", err)
 			return nil, err
 		}
 
@@ -90,6 +107,10 @@ func (u *User) GetByEmail(email string) (*User, error) {
 			    password,
 			    user_active,
 			    is_admin,
+			    region,
+			    locale,
+			    payment_customer_id,
+			    password_changed_at,
 			    created_at,
 			    updated_at
 			from
@@ -108,6 +129,10 @@ func (u *User) GetByEmail(email string) (*User, error) {
 		&user.Password,
 		&user.Active,
 		&user.IsAdmin,
+		&user.Region,
+		&user.Locale,
+		&user.PaymentCustomerID,
+		&user.PasswordChangedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -117,18 +142,21 @@ func (u *User) GetByEmail(email string) (*User, error) {
 	}
 
 	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from
+	query = `select p.id, p.plan_name, p.plan_amount, p.currency, p.created_at, p.updated_at from
 			plans p
-			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			join subscriptions s on (p.id = s.plan_id)
+			where s.user_id = $1 and s.status <> $2
+			order by s.id desc
+			limit 1`
 
 	var plan Plan
-	row = db.QueryRowContext(ctx, query, user.ID)
+	row = db.QueryRowContext(ctx, query, user.ID, SubscriptionCanceled)
 
 	err = row.Scan(
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Currency,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
@@ -145,7 +173,8 @@ func (u *User) GetOne(id int) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, user_active, is_admin, created_at, updated_at
+	query := `select id, email, first_name, last_name, password, user_active, is_admin, region, locale, payment_customer_id,
+				password_changed_at, created_at, updated_at
 				from users
 				where id = $1`
 
@@ -160,6 +189,10 @@ func (u *User) GetOne(id int) (*User, error) {
 		&user.Password,
 		&user.Active,
 		&user.IsAdmin,
+		&user.Region,
+		&user.Locale,
+		&user.PaymentCustomerID,
+		&user.PasswordChangedAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -169,18 +202,21 @@ func (u *User) GetOne(id int) (*User, error) {
 	}
 
 	// get plan, if any
-	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from
+	query = `select p.id, p.plan_name, p.plan_amount, p.currency, p.created_at, p.updated_at from
 			plans p
-			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			join subscriptions s on (p.id = s.plan_id)
+			where s.user_id = $1 and s.status <> $2
+			order by s.id desc
+			limit 1`
 
 	var plan Plan
-	row = db.QueryRowContext(ctx, query, user.ID)
+	row = db.QueryRowContext(ctx, query, user.ID, SubscriptionCanceled)
 
 	err = row.Scan(
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&plan.Currency,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
@@ -188,14 +224,14 @@ func (u *User) GetOne(id int) (*User, error) {
 	if err == nil {
 		user.Plan = &plan
 	} else {
-		log.Println("Error getting plan", err)
+		logger.Error("error getting plan", "user_id", user.ID, "error", err)
 	}
 
 	return &user, nil
 }
 
 // Update updates one user in the database, using the information
-// stored in the receiver u
+// stored in user
 func (u *User) Update(user User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
@@ -205,16 +241,22 @@ func (u *User) Update(user User) error {
 		first_name = $2,
 		last_name = $3,
 		user_active = $4,
-		updated_at = $5
-		where id = $6`
+		region = $5,
+		locale = $6,
+		payment_customer_id = $7,
+		updated_at = $8
+		where id = $9`
 
 	_, err := db.ExecContext(ctx, stmt,
-		u.Email,
-		u.FirstName,
-		u.LastName,
-		u.Active,
+		user.Email,
+		user.FirstName,
+		user.LastName,
+		user.Active,
+		user.Region,
+		user.Locale,
+		user.PaymentCustomerID,
 		time.Now(),
-		u.ID,
+		user.ID,
 	)
 
 	if err != nil {
@@ -241,6 +283,15 @@ func (u *User) DeleteByID(id int) error {
 
 // Insert inserts a new user into the database, and returns the ID of the newly inserted row
 func (u *User) Insert(user User) (int, error) {
+	return insertUser(db, user)
+}
+
+// InsertTx inserts the user as part of tx, and returns the new id.
+func (u *User) InsertTx(tx *sql.Tx, user User) (int, error) {
+	return insertUser(tx, user)
+}
+
+func insertUser(q queryer, user User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
@@ -250,15 +301,17 @@ func (u *User) Insert(user User) (int, error) {
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, user_active, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, user_active, region, locale, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
 
-	err = db.QueryRowContext(ctx, stmt,
+	err = q.QueryRowContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
 		user.Active,
+		user.Region,
+		user.Locale,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -270,8 +323,31 @@ func (u *User) Insert(user User) (int, error) {
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
+// SetLocale gives a user with no locale yet the one passed; a user who
+// already has one keeps it
+func (u *User) SetLocale(id int, locale string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set locale = $1, updated_at = $2 where id = $3 and locale = ''`
+
+	_, err := db.ExecContext(ctx, stmt, locale, time.Now(), id)
+	return err
+}
+
+// ResetPassword is the method we will use to change a user's password. It
+// also stamps when the password changed, which retires reset links and
+// sessions from before.
 func (u *User) ResetPassword(user User, password string) error {
+	return resetPassword(db, user, password)
+}
+
+// ResetPasswordTx is ResetPassword, as part of tx.
+func (u *User) ResetPasswordTx(tx *sql.Tx, user User, password string) error {
+	return resetPassword(tx, user, password)
+}
+
+func resetPassword(q queryer, user User, password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
@@ -280,8 +356,8 @@ func (u *User) ResetPassword(user User, password string) error {
 		return err
 	}
 
-	stmt := `update users set password = $1 where id = $2`
-	_, err = db.ExecContext(ctx, stmt, hashedPassword, user.ID)
+	stmt := `update users set password = $1, password_changed_at = now(), updated_at = now() where id = $2`
+	_, err = q.ExecContext(ctx, stmt, hashedPassword, user.ID)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// recorder is a database driver that records the statements run through
+// it, and their arguments, instead of running them.
+type recorder struct {
+	mu    sync.Mutex
+	execs [][]driver.Value
+}
+
+type recorderConn struct{ r *recorder }
+
+func (c *recorderConn) Prepare(query string) (driver.Stmt, error) { return &recorderStmt{c.r}, nil }
+func (c *recorderConn) Close() error                              { return nil }
+func (c *recorderConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type recorderStmt struct{ r *recorder }
+
+func (s *recorderStmt) Close() error  { return nil }
+func (s *recorderStmt) NumInput() int { return -1 }
+
+func (s *recorderStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+
+	s.r.execs = append(s.r.execs, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recorderStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+var registerRecorder sync.Once
+
+// useRecorder points the package at a recorder for the test.
+func useRecorder(t *testing.T) *recorder {
+	rec := &recorder{}
+	registerRecorder.Do(func() {
+		sql.Register("recorder", &recorderDriver{})
+	})
+	recorders.Store(t.Name(), rec)
+
+	conn, err := sql.Open("recorder", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := db
+	db = conn
+	t.Cleanup(func() {
+		db = saved
+		conn.Close()
+	})
+	return rec
+}
+
+// recorderDriver hands each test its own recorder, by name.
+type recorderDriver struct{}
+
+var recorders sync.Map
+
+func (recorderDriver) Open(name string) (driver.Conn, error) {
+	rec, ok := recorders.Load(name)
+	if !ok {
+		return nil, errors.New("no recorder for " + name)
+	}
+	return &recorderConn{rec.(*recorder)}, nil
+}
+
+func TestUser_Update(t *testing.T) {
+	rec := useRecorder(t)
+
+	// the receiver is whatever model the app holds, not the user to save
+	model := &User{ID: 1, Email: "model@here.com"}
+	err := model.Update(User{ID: 7, Email: "lois@here.com", FirstName: "Lois"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.execs) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(rec.execs))
+	}
+
+	args := rec.execs[0]
+	if args[0] != "lois@here.com" || args[1] != "Lois" {
+		t.Errorf("expected the given user's email and name, got %v", args[:2])
+	}
+	if args[len(args)-1] != int64(7) {
+		t.Errorf("expected to update user 7, got %v", args[len(args)-1])
+	}
+}
@@ -1,6 +1,6 @@
 module final-project
 
-go 1.18
+go 1.21
 
 require (
 	github.com/PuerkitoBio/goquery v1.5.1 // indirect
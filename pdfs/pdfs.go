@@ -0,0 +1,8 @@
+// Package pdfs embeds the PDF documents the app builds on, so the binary
+// does not depend on the directory it is started from.
+package pdfs
+
+import "embed"
+
+//go:embed manual.pdf
+var FS embed.FS
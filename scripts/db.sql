@@ -6,6 +6,8 @@ CREATE TABLE public.plans (
                               id integer NOT NULL,
                               plan_name character varying(255),
                               plan_amount integer,
+                              currency character(3) DEFAULT 'USD' NOT NULL,
+                              trial_days integer DEFAULT 0 NOT NULL,
                               created_at timestamp without time zone,
                               updated_at timestamp without time zone
 );
@@ -38,24 +40,163 @@ CREATE SEQUENCE public.user_id_seq
 
 
 --
--- Name: user_plans; Type: TABLE; Schema: public; Owner: -
+-- Name: plan_prices; Type: TABLE; Schema: public; Owner: -
 --
 
-CREATE TABLE public.user_plans (
+CREATE TABLE public.plan_prices (
+                                    plan_id integer NOT NULL,
+                                    currency character(3) NOT NULL,
+                                    amount integer NOT NULL
+);
+
+
+--
+-- Name: subscriptions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.subscriptions (
+                                      id integer NOT NULL,
+                                      user_id integer NOT NULL,
+                                      plan_id integer NOT NULL,
+                                      status character varying(20) NOT NULL,
+                                      current_period_start timestamp without time zone NOT NULL,
+                                      current_period_end timestamp without time zone NOT NULL,
+                                      cancel_at_period_end boolean DEFAULT false NOT NULL,
+                                      canceled_at timestamp without time zone,
+                                      past_due_since timestamp without time zone,
+                                      renewal_attempts integer DEFAULT 0 NOT NULL,
+                                      renew_after timestamp without time zone,
+                                      created_at timestamp without time zone,
+                                      updated_at timestamp without time zone
+);
+
+
+--
+-- Name: subscriptions_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.subscriptions ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.subscriptions_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: subscription_events; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.subscription_events (
+                                            id integer NOT NULL,
+                                            subscription_id integer NOT NULL,
+                                            user_id integer NOT NULL,
+                                            event character varying(30) NOT NULL,
+                                            from_plan_id integer,
+                                            to_plan_id integer,
+                                            status character varying(20) NOT NULL,
+                                            created_at timestamp without time zone NOT NULL
+);
+
+
+--
+-- Name: subscription_events_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.subscription_events ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.subscription_events_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: mail_dead_letters; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.mail_dead_letters (
+                                          id integer NOT NULL,
+                                          recipient character varying(255),
+                                          subject character varying(255),
+                                          template character varying(255),
+                                          payload jsonb,
+                                          last_error text,
+                                          attempts integer,
+                                          created_at timestamp without time zone
+);
+
+
+--
+-- Name: mail_dead_letters_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.mail_dead_letters ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.mail_dead_letters_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: mail_outbox; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.mail_outbox (
+                                    id integer NOT NULL,
+                                    payload jsonb NOT NULL,
+                                    status character varying(20) DEFAULT 'pending' NOT NULL,
+                                    attempts integer DEFAULT 0 NOT NULL,
+                                    last_error text,
+                                    locked_until timestamp without time zone NOT NULL,
+                                    created_at timestamp without time zone,
+                                    updated_at timestamp without time zone
+);
+
+
+--
+-- Name: mail_outbox_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.mail_outbox ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.mail_outbox_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: app_errors; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.app_errors (
                                    id integer NOT NULL,
+                                   source character varying(50) NOT NULL,
+                                   severity character varying(20) NOT NULL,
                                    user_id integer,
-                                   plan_id integer,
-                                   created_at timestamp without time zone,
-                                   updated_at timestamp without time zone
+                                   request_id character varying(64),
+                                   message text,
+                                   payload jsonb,
+                                   created_at timestamp without time zone
 );
 
 
 --
--- Name: user_plans_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+-- Name: app_errors_id_seq; Type: SEQUENCE; Schema: public; Owner: -
 --
 
-ALTER TABLE public.user_plans ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
-    SEQUENCE NAME public.user_plans_id_seq
+ALTER TABLE public.app_errors ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.app_errors_id_seq
     START WITH 1
     INCREMENT BY 1
     NO MINVALUE
@@ -64,6 +205,333 @@ ALTER TABLE public.user_plans ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
 );
 
 
+--
+-- Name: jobs; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.jobs (
+                             id integer NOT NULL,
+                             kind character varying(50) NOT NULL,
+                             payload jsonb NOT NULL,
+                             status character varying(20) DEFAULT 'pending' NOT NULL,
+                             attempts integer DEFAULT 0 NOT NULL,
+                             run_at timestamp without time zone NOT NULL,
+                             locked_until timestamp without time zone NOT NULL,
+                             last_error text,
+                             created_at timestamp without time zone,
+                             updated_at timestamp without time zone
+);
+
+
+--
+-- Name: jobs_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.jobs ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.jobs_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: invoices; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.invoices (
+                                 id integer NOT NULL,
+                                 number integer NOT NULL,
+                                 user_id integer NOT NULL,
+                                 plan_id integer,
+                                 coupon_id integer,
+                                 status character varying(20) DEFAULT 'issued' NOT NULL,
+                                 currency character(3) DEFAULT 'USD' NOT NULL,
+                                 locale character varying(20) DEFAULT '' NOT NULL,
+                                 period_start timestamp without time zone NOT NULL,
+                                 period_end timestamp without time zone NOT NULL,
+                                 subtotal integer NOT NULL,
+                                 tax integer DEFAULT 0 NOT NULL,
+                                 total integer NOT NULL,
+                                 tax_inclusive boolean DEFAULT false NOT NULL,
+                                 issued_at timestamp without time zone,
+                                 created_at timestamp without time zone,
+                                 updated_at timestamp without time zone
+);
+
+
+--
+-- Name: invoices_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.invoices ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.invoices_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: invoice_lines; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.invoice_lines (
+                                      id integer NOT NULL,
+                                      invoice_id integer NOT NULL,
+                                      description character varying(255),
+                                      quantity integer DEFAULT 1 NOT NULL,
+                                      unit_amount integer NOT NULL,
+                                      amount integer NOT NULL,
+                                      credit boolean DEFAULT false NOT NULL
+);
+
+
+--
+-- Name: invoice_lines_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.invoice_lines ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.invoice_lines_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: invoice_tax_lines; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.invoice_tax_lines (
+                                          id integer NOT NULL,
+                                          invoice_id integer NOT NULL,
+                                          region character varying(20) NOT NULL,
+                                          name character varying(255) NOT NULL,
+                                          rate integer NOT NULL,
+                                          taxable integer NOT NULL,
+                                          amount integer NOT NULL
+);
+
+
+--
+-- Name: invoice_tax_lines_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.invoice_tax_lines ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.invoice_tax_lines_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: tax_rates; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.tax_rates (
+                                  id integer NOT NULL,
+                                  region character varying(20) NOT NULL,
+                                  name character varying(255) NOT NULL,
+                                  rate integer NOT NULL,
+                                  created_at timestamp without time zone,
+                                  updated_at timestamp without time zone
+);
+
+
+--
+-- Name: tax_rates_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.tax_rates ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.tax_rates_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+INSERT INTO "public"."tax_rates"("region","name","rate","created_at","updated_at")
+VALUES
+    (E'DE',E'MwSt',1900,E'2022-03-14 00:00:00',E'2022-03-14 00:00:00'),
+    (E'GB',E'VAT',2000,E'2022-03-14 00:00:00',E'2022-03-14 00:00:00'),
+    (E'US-CA',E'Sales tax',725,E'2022-03-14 00:00:00',E'2022-03-14 00:00:00');
+
+
+--
+-- Name: payments; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.payments (
+                                 id integer NOT NULL,
+                                 user_id integer NOT NULL,
+                                 invoice_id integer NOT NULL,
+                                 charge_id character varying(255),
+                                 status character varying(20) NOT NULL,
+                                 amount integer NOT NULL,
+                                 currency character(3) NOT NULL,
+                                 failure_message text DEFAULT '' NOT NULL,
+                                 checkout jsonb,
+                                 created_at timestamp without time zone,
+                                 updated_at timestamp without time zone
+);
+
+
+--
+-- Name: payments_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.payments ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.payments_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: coupons; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.coupons (
+                                id integer NOT NULL,
+                                code character varying(50) NOT NULL,
+                                percent_off integer DEFAULT 0 NOT NULL,
+                                amount_off integer DEFAULT 0 NOT NULL,
+                                currency character(3) DEFAULT 'USD' NOT NULL,
+                                plan_id integer,
+                                expires_at timestamp without time zone,
+                                max_redemptions integer DEFAULT 0 NOT NULL,
+                                redemptions integer DEFAULT 0 NOT NULL,
+                                created_at timestamp without time zone,
+                                updated_at timestamp without time zone
+);
+
+
+--
+-- Name: coupons_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.coupons ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.coupons_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+INSERT INTO "public"."coupons"("code","percent_off","amount_off","currency","max_redemptions","created_at","updated_at")
+VALUES
+    (E'WELCOME10',10,0,E'USD',0,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'FIVEOFF',0,500,E'USD',100,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
+
+
+--
+-- Name: coupon_redemptions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.coupon_redemptions (
+                                           id integer NOT NULL,
+                                           coupon_id integer NOT NULL,
+                                           user_id integer NOT NULL,
+                                           created_at timestamp without time zone
+);
+
+
+--
+-- Name: coupon_redemptions_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.coupon_redemptions ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.coupon_redemptions_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: link_tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.link_tokens (
+                                    id integer NOT NULL,
+                                    purpose character varying(20) NOT NULL,
+                                    user_id integer NOT NULL,
+                                    nonce character varying(64) NOT NULL,
+                                    used_at timestamp without time zone,
+                                    created_at timestamp without time zone
+);
+
+
+--
+-- Name: link_tokens_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.link_tokens ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.link_tokens_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: signing_keys; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.signing_keys (
+                                     id integer NOT NULL,
+                                     key_id character varying(20) NOT NULL,
+                                     secret character varying(255) NOT NULL,
+                                     created_at timestamp without time zone,
+                                     retired_at timestamp without time zone
+);
+
+
+--
+-- Name: signing_keys_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.signing_keys ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.signing_keys_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: invoice_numbers; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.invoice_numbers (
+                                        id integer NOT NULL,
+                                        last_number integer DEFAULT 0 NOT NULL
+);
+
+INSERT INTO "public"."invoice_numbers"("id","last_number") VALUES (1,0);
+
+
 CREATE TABLE public.users (
                               id integer DEFAULT nextval('public.user_id_seq'::regclass) NOT NULL,
                               email character varying(255),
@@ -72,6 +540,10 @@ CREATE TABLE public.users (
                               password character varying(60),
                               user_active integer DEFAULT 0,
                               is_admin integer default 0,
+                              region character varying(20) DEFAULT '' NOT NULL,
+                              locale character varying(20) DEFAULT '' NOT NULL,
+                              payment_customer_id character varying(255) DEFAULT '' NOT NULL,
+                              password_changed_at timestamp without time zone,
                               created_at timestamp without time zone,
                               updated_at timestamp without time zone
 );
@@ -87,33 +559,224 @@ SELECT pg_catalog.setval('public.plans_id_seq', 1, false);
 SELECT pg_catalog.setval('public.user_id_seq', 2, true);
 
 
-SELECT pg_catalog.setval('public.user_plans_id_seq', 1, false);
+SELECT pg_catalog.setval('public.subscriptions_id_seq', 1, false);
+
+INSERT INTO "public"."plans"("plan_name","plan_amount","trial_days","created_at","updated_at")
+VALUES
+    (E'Bronze Plan',1000,14,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'Silver Plan',2000,0,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
+    (E'Gold Plan',3000,0,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
 
-INSERT INTO "public"."plans"("plan_name","plan_amount","created_at","updated_at")
+INSERT INTO "public"."plan_prices"("plan_id","currency","amount")
 VALUES
-    (E'Bronze Plan',1000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
-    (E'Silver Plan',2000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00'),
-    (E'Gold Plan',3000,E'2022-05-12 00:00:00',E'2022-05-12 00:00:00');
+    (1,E'EUR',900),
+    (1,E'GBP',800),
+    (1,E'JPY',1400),
+    (2,E'EUR',1900),
+    (2,E'GBP',1600),
+    (2,E'JPY',2800),
+    (3,E'EUR',2800),
+    (3,E'GBP',2400),
+    (3,E'JPY',4200);
 
 
 ALTER TABLE ONLY public.plans
     ADD CONSTRAINT plans_pkey PRIMARY KEY (id);
 
 
-ALTER TABLE ONLY public.user_plans
-    ADD CONSTRAINT user_plans_pkey PRIMARY KEY (id);
+ALTER TABLE ONLY public.plan_prices
+    ADD CONSTRAINT plan_prices_pkey PRIMARY KEY (plan_id, currency);
+
+
+ALTER TABLE ONLY public.plan_prices
+    ADD CONSTRAINT plan_prices_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.subscriptions
+    ADD CONSTRAINT subscriptions_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.subscription_events
+    ADD CONSTRAINT subscription_events_pkey PRIMARY KEY (id);
 
 
 ALTER TABLE ONLY public.users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
 
-ALTER TABLE ONLY public.user_plans
-    ADD CONSTRAINT user_plans_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+ALTER TABLE ONLY public.mail_dead_letters
+    ADD CONSTRAINT mail_dead_letters_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.mail_outbox
+    ADD CONSTRAINT mail_outbox_pkey PRIMARY KEY (id);
+
+
+CREATE INDEX mail_outbox_claim_idx ON public.mail_outbox USING btree (status, locked_until);
+
+
+ALTER TABLE ONLY public.app_errors
+    ADD CONSTRAINT app_errors_pkey PRIMARY KEY (id);
+
+
+CREATE INDEX app_errors_created_at_idx ON public.app_errors USING btree (created_at);
+
+
+ALTER TABLE ONLY public.jobs
+    ADD CONSTRAINT jobs_pkey PRIMARY KEY (id);
+
+
+CREATE INDEX jobs_claim_idx ON public.jobs USING btree (status, run_at);
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_number_key UNIQUE (number);
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_period_key UNIQUE (user_id, plan_id, period_start);
+
+
+ALTER TABLE ONLY public.invoices
+    ADD CONSTRAINT invoices_coupon_id_fkey FOREIGN KEY (coupon_id) REFERENCES public.coupons(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
+
+
+CREATE INDEX invoices_issued_at_idx ON public.invoices USING btree (issued_at);
+
+
+ALTER TABLE ONLY public.invoice_lines
+    ADD CONSTRAINT invoice_lines_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.invoice_lines
+    ADD CONSTRAINT invoice_lines_invoice_id_fkey FOREIGN KEY (invoice_id) REFERENCES public.invoices(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.invoice_numbers
+    ADD CONSTRAINT invoice_numbers_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.invoice_tax_lines
+    ADD CONSTRAINT invoice_tax_lines_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.invoice_tax_lines
+    ADD CONSTRAINT invoice_tax_lines_invoice_id_fkey FOREIGN KEY (invoice_id) REFERENCES public.invoices(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.tax_rates
+    ADD CONSTRAINT tax_rates_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.payments
+    ADD CONSTRAINT payments_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.payments
+    ADD CONSTRAINT payments_charge_id_key UNIQUE (charge_id);
+
+
+ALTER TABLE ONLY public.payments
+    ADD CONSTRAINT payments_invoice_id_fkey FOREIGN KEY (invoice_id) REFERENCES public.invoices(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
+
+
+ALTER TABLE ONLY public.payments
+    ADD CONSTRAINT payments_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
 
+ALTER TABLE ONLY public.coupons
+    ADD CONSTRAINT coupons_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.coupons
+    ADD CONSTRAINT coupons_code_key UNIQUE (code);
+
+
+ALTER TABLE ONLY public.coupons
+    ADD CONSTRAINT coupons_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_coupon_id_user_id_key UNIQUE (coupon_id, user_id);
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_coupon_id_fkey FOREIGN KEY (coupon_id) REFERENCES public.coupons(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.coupon_redemptions
+    ADD CONSTRAINT coupon_redemptions_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.link_tokens
+    ADD CONSTRAINT link_tokens_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.link_tokens
+    ADD CONSTRAINT link_tokens_nonce_key UNIQUE (nonce);
+
+
+ALTER TABLE ONLY public.link_tokens
+    ADD CONSTRAINT link_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+ALTER TABLE ONLY public.signing_keys
+    ADD CONSTRAINT signing_keys_pkey PRIMARY KEY (id);
+
+
+ALTER TABLE ONLY public.signing_keys
+    ADD CONSTRAINT signing_keys_key_id_key UNIQUE (key_id);
+
+
+ALTER TABLE ONLY public.subscriptions
+    ADD CONSTRAINT subscriptions_plan_id_fkey FOREIGN KEY (plan_id) REFERENCES public.plans(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
+
+
+ALTER TABLE ONLY public.subscriptions
+    ADD CONSTRAINT subscriptions_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+
+
+-- a user has at most one subscription that isn't canceled
+CREATE UNIQUE INDEX subscriptions_live_key ON public.subscriptions USING btree (user_id) WHERE ((status)::text <> 'canceled'::text);
+
+
+-- the billing scheduler looks for live subscriptions whose period has ended
+CREATE INDEX subscriptions_due_idx ON public.subscriptions USING btree (current_period_end) WHERE ((status)::text <> 'canceled'::text);
+
+
+-- an invoice has at most one payment that has taken, or may yet take, the money
+CREATE UNIQUE INDEX payments_open_key ON public.payments USING btree (invoice_id) WHERE ((status)::text = ANY ((ARRAY['pending'::character varying, 'succeeded'::character varying])::text[]));
+
+
+CREATE INDEX subscription_events_user_id_idx ON public.subscription_events USING btree (user_id);
+
+
+--
+-- Name: reject_history_change(); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.reject_history_change() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$;
+
+
+--
+-- Name: subscription_events subscription_events_append_only; Type: TRIGGER; Schema: public; Owner: -
+--
 
-ALTER TABLE ONLY public.user_plans
-    ADD CONSTRAINT user_plans_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE RESTRICT ON DELETE CASCADE;
+CREATE TRIGGER subscription_events_append_only BEFORE UPDATE OR DELETE ON public.subscription_events FOR EACH ROW EXECUTE FUNCTION public.reject_history_change();
 
 
 